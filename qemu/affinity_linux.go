@@ -0,0 +1,334 @@
+//go:build linux
+// +build linux
+
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// SchedPolicy is a Linux scheduling policy.
+type SchedPolicy int
+
+const (
+	// SchedOther is the default time-sharing Linux scheduling policy.
+	SchedOther SchedPolicy = 0
+
+	// SchedFIFO is the first in, first out realtime scheduling policy.
+	SchedFIFO SchedPolicy = 1
+
+	// SchedRR is the round-robin realtime scheduling policy.
+	SchedRR SchedPolicy = 2
+)
+
+// ThreadScheduler applies CPU affinity and scheduling settings to the host
+// threads of a QEMU process.
+type ThreadScheduler interface {
+	// Threads returns the IDs of all the threads of the process pid.
+	Threads(pid int) ([]int, error)
+
+	// SetAffinity restricts the thread tid to the host CPUs listed in cpus.
+	SetAffinity(tid int, cpus []int) error
+
+	// SetScheduler sets the scheduling policy and the realtime priority
+	// of the thread tid.
+	SetScheduler(tid int, policy SchedPolicy, priority int) error
+
+	// SetNice sets the nice value of the thread tid.
+	SetNice(tid int, nice int) error
+}
+
+// ThreadSchedule describes how a QEMU thread should be scheduled on the host.
+type ThreadSchedule struct {
+	// CPUs is the set of host CPUs the thread is allowed to run on.
+	// The affinity of the thread is left untouched if CPUs is empty.
+	CPUs []int
+
+	// Policy is the scheduling policy of the thread.  The policy of the
+	// thread is left untouched if Policy is nil.
+	Policy *SchedPolicy
+
+	// Priority is the realtime priority of the thread, between 1 and 99.
+	// It must be zero with SchedOther, or when Policy is nil.
+	Priority int
+
+	// Nice is the nice value of the thread.  It is optional.
+	Nice *int
+}
+
+// ThreadPinning describes how the vCPU, IO and emulator threads of a QEMU
+// process should be scheduled on the host.
+type ThreadPinning struct {
+	// VCPUs maps the index of a vCPU to the schedule of its thread.
+	VCPUs map[int]ThreadSchedule
+
+	// IOThreads maps the ID of an IOThread to the schedule of its thread.
+	IOThreads map[string]ThreadSchedule
+
+	// Emulator is the schedule of all the threads of the QEMU process that
+	// are neither vCPU nor IO threads.  It is optional.
+	Emulator *ThreadSchedule
+
+	// Scheduler is used to apply the schedules.  The host scheduler is
+	// used if Scheduler is nil.
+	Scheduler ThreadScheduler
+}
+
+// hostThreadScheduler is the ThreadScheduler that relies on the Linux
+// system calls.
+type hostThreadScheduler struct{}
+
+func (hostThreadScheduler) Threads(pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	var tids []int
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+
+	return tids, nil
+}
+
+func (hostThreadScheduler) SetAffinity(tid int, cpus []int) error {
+	const bitsPerWord = 64
+	maxCPU := 0
+	for _, c := range cpus {
+		if c < 0 {
+			return fmt.Errorf("invalid host CPU %d", c)
+		}
+		if c > maxCPU {
+			maxCPU = c
+		}
+	}
+
+	mask := make([]uint64, maxCPU/bitsPerWord+1)
+	for _, c := range cpus {
+		mask[c/bitsPerWord] |= 1 << uint(c%bitsPerWord)
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+		uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (hostThreadScheduler) SetScheduler(tid int, policy SchedPolicy, priority int) error {
+	param := struct{ priority int32 }{int32(priority)}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(tid),
+		uintptr(policy), uintptr(unsafe.Pointer(&param)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (hostThreadScheduler) SetNice(tid int, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+}
+
+// validate returns an error if the policy and the priority of the schedule s
+// would be refused by the kernel.
+func (s ThreadSchedule) validate() error {
+	if s.Policy == nil {
+		if s.Priority != 0 {
+			return fmt.Errorf("priority %d requires a scheduling policy", s.Priority)
+		}
+		return nil
+	}
+
+	switch *s.Policy {
+	case SchedOther:
+		if s.Priority != 0 {
+			return fmt.Errorf("priority %d requires a realtime scheduling policy", s.Priority)
+		}
+	case SchedFIFO, SchedRR:
+		if s.Priority < 1 || s.Priority > 99 {
+			return fmt.Errorf("realtime priority %d is not between 1 and 99", s.Priority)
+		}
+	default:
+		return fmt.Errorf("unknown scheduling policy %d", *s.Policy)
+	}
+
+	return nil
+}
+
+// apply applies the schedule s to the thread tid using the scheduler sched.
+func (s ThreadSchedule) apply(sched ThreadScheduler, tid int) error {
+	if len(s.CPUs) > 0 {
+		if err := sched.SetAffinity(tid, s.CPUs); err != nil {
+			return fmt.Errorf("unable to set the affinity of thread %d: %v", tid, err)
+		}
+	}
+
+	if s.Policy != nil {
+		if err := sched.SetScheduler(tid, *s.Policy, s.Priority); err != nil {
+			return fmt.Errorf("unable to set the scheduling policy of thread %d: %v", tid, err)
+		}
+	}
+
+	if s.Nice != nil {
+		if err := sched.SetNice(tid, *s.Nice); err != nil {
+			return fmt.Errorf("unable to set the nice value of thread %d: %v", tid, err)
+		}
+	}
+
+	return nil
+}
+
+// qemuThreads returns the host threads running the vCPUs, indexed by vCPU
+// index, and the host threads running the IOThreads, indexed by IOThread ID.
+func (q *QMP) qemuThreads(ctx context.Context) (map[int]int, map[string]int, error) {
+	cpus, err := q.ExecQueryCpusFast(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ioThreads, err := q.ExecuteQueryIOThreads(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vcpuThreads := make(map[int]int)
+	for _, c := range cpus {
+		vcpuThreads[c.CPUIndex] = c.ThreadID
+	}
+
+	ioThreadThreads := make(map[string]int)
+	for _, t := range ioThreads {
+		ioThreadThreads[t.ID] = t.ThreadID
+	}
+
+	return vcpuThreads, ioThreadThreads, nil
+}
+
+// applyEmulator applies the schedule s to all the threads of the process pid
+// that are not listed in skip.
+func (s ThreadSchedule) applyEmulator(sched ThreadScheduler, pid int, skip map[int]bool) error {
+	tids, err := sched.Threads(pid)
+	if err != nil {
+		return fmt.Errorf("unable to list the threads of process %d: %v", pid, err)
+	}
+
+	for _, tid := range tids {
+		if skip[tid] {
+			continue
+		}
+		if err = s.apply(sched, tid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks all the schedules of pinning, so that none is applied if
+// one of them is invalid.
+func (pinning ThreadPinning) validate() error {
+	for index, s := range pinning.VCPUs {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("invalid schedule for vCPU %d: %v", index, err)
+		}
+	}
+
+	for id, s := range pinning.IOThreads {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("invalid schedule for IOThread %s: %v", id, err)
+		}
+	}
+
+	if pinning.Emulator != nil {
+		if err := pinning.Emulator.validate(); err != nil {
+			return fmt.Errorf("invalid schedule for the emulator threads: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// PinThreads applies the schedules described by pinning to the threads of
+// the QEMU process pid.  The host threads running the vCPUs and the IOThreads
+// are discovered with the query-cpus-fast and query-iothreads commands.  It is
+// an error for pinning to refer to a vCPU or an IOThread that does not exist.
+func (q *QMP) PinThreads(ctx context.Context, pid int, pinning ThreadPinning) error {
+	sched := pinning.Scheduler
+	if sched == nil {
+		sched = hostThreadScheduler{}
+	}
+
+	if err := pinning.validate(); err != nil {
+		return err
+	}
+
+	vcpuThreads, ioThreadThreads, err := q.qemuThreads(ctx)
+	if err != nil {
+		return err
+	}
+
+	for index, s := range pinning.VCPUs {
+		tid, ok := vcpuThreads[index]
+		if !ok {
+			return fmt.Errorf("vCPU %d not found", index)
+		}
+		if err = s.apply(sched, tid); err != nil {
+			return err
+		}
+	}
+
+	for id, s := range pinning.IOThreads {
+		tid, ok := ioThreadThreads[id]
+		if !ok {
+			return fmt.Errorf("IOThread %s not found", id)
+		}
+		if err = s.apply(sched, tid); err != nil {
+			return err
+		}
+	}
+
+	if pinning.Emulator == nil {
+		return nil
+	}
+
+	// Threads that are not running a vCPU or an IOThread are emulator threads.
+	skip := make(map[int]bool)
+	for _, tid := range vcpuThreads {
+		skip[tid] = true
+	}
+	for _, tid := range ioThreadThreads {
+		skip[tid] = true
+	}
+
+	return pinning.Emulator.applyEmulator(sched, pid, skip)
+}
@@ -0,0 +1,217 @@
+//go:build linux
+// +build linux
+
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type testThread struct {
+	cpus      []int
+	scheduled bool
+	policy    SchedPolicy
+	priority  int
+	nice      int
+}
+
+type testThreadScheduler struct {
+	threads map[int]*testThread
+}
+
+func newTestThreadScheduler(tids ...int) *testThreadScheduler {
+	s := &testThreadScheduler{threads: make(map[int]*testThread)}
+	for _, tid := range tids {
+		s.threads[tid] = &testThread{}
+	}
+	return s
+}
+
+func (s *testThreadScheduler) Threads(pid int) ([]int, error) {
+	var tids []int
+	for tid := range s.threads {
+		tids = append(tids, tid)
+	}
+	return tids, nil
+}
+
+func (s *testThreadScheduler) SetAffinity(tid int, cpus []int) error {
+	s.threads[tid].cpus = cpus
+	return nil
+}
+
+func (s *testThreadScheduler) SetScheduler(tid int, policy SchedPolicy, priority int) error {
+	s.threads[tid].scheduled = true
+	s.threads[tid].policy = policy
+	s.threads[tid].priority = priority
+	return nil
+}
+
+func (s *testThreadScheduler) SetNice(tid int, nice int) error {
+	s.threads[tid].nice = nice
+	return nil
+}
+
+func startPinningQMPLoop(t *testing.T) (*QMP, chan struct{}) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	cpus := []CPUInfoFast{
+		{CPUIndex: 0, ThreadID: 101},
+		{CPUIndex: 1, ThreadID: 102},
+	}
+	ioThreads := []IOThreadInfo{
+		{ID: "iothread0", ThreadID: 103},
+	}
+	buf.AddCommand("query-cpus-fast", nil, "return", cpus)
+	buf.AddCommand("query-iothreads", nil, "return", ioThreads)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	return q, disconnectedCh
+}
+
+// Checks that the vCPU, IO and emulator threads are pinned according to the
+// requested schedules.
+func TestPinThreads(t *testing.T) {
+	sched := newTestThreadScheduler(100, 101, 102, 103, 104)
+	nice := -5
+	fifo := SchedFIFO
+	pinning := ThreadPinning{
+		VCPUs: map[int]ThreadSchedule{
+			0: {CPUs: []int{2}, Policy: &fifo, Priority: 10},
+			1: {CPUs: []int{3}, Policy: &fifo, Priority: 10},
+		},
+		IOThreads: map[string]ThreadSchedule{
+			"iothread0": {CPUs: []int{4}, Nice: &nice},
+		},
+		Emulator:  &ThreadSchedule{CPUs: []int{0, 1}},
+		Scheduler: sched,
+	}
+
+	q, disconnectedCh := startPinningQMPLoop(t)
+	err := q.PinThreads(context.Background(), 100, pinning)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+
+	expected := map[int]*testThread{
+		100: {cpus: []int{0, 1}},
+		101: {cpus: []int{2}, scheduled: true, policy: SchedFIFO, priority: 10},
+		102: {cpus: []int{3}, scheduled: true, policy: SchedFIFO, priority: 10},
+		103: {cpus: []int{4}, nice: -5},
+		104: {cpus: []int{0, 1}},
+	}
+	if !reflect.DeepEqual(sched.threads, expected) {
+		for tid, thread := range sched.threads {
+			t.Logf("thread %d: %+v", tid, *thread)
+		}
+		t.Fatalf("Unexpected thread schedules")
+	}
+}
+
+// Checks that SchedOther is applied, so that a realtime thread can be reset
+// to the default scheduling policy.
+func TestPinThreadsSchedOther(t *testing.T) {
+	sched := newTestThreadScheduler(100, 101, 102, 103)
+	sched.threads[101].policy = SchedFIFO
+	sched.threads[101].priority = 10
+	other := SchedOther
+	pinning := ThreadPinning{
+		VCPUs: map[int]ThreadSchedule{
+			0: {Policy: &other},
+		},
+		Scheduler: sched,
+	}
+
+	q, disconnectedCh := startPinningQMPLoop(t)
+	err := q.PinThreads(context.Background(), 100, pinning)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+
+	expected := &testThread{scheduled: true, policy: SchedOther}
+	if !reflect.DeepEqual(sched.threads[101], expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, sched.threads[101])
+	}
+}
+
+// Checks that pinning an unknown vCPU fails.
+func TestPinThreadsUnknownVCPU(t *testing.T) {
+	sched := newTestThreadScheduler(100, 101, 102, 103)
+	pinning := ThreadPinning{
+		VCPUs: map[int]ThreadSchedule{
+			2: {CPUs: []int{2}},
+		},
+		Scheduler: sched,
+	}
+
+	q, disconnectedCh := startPinningQMPLoop(t)
+	err := q.PinThreads(context.Background(), 100, pinning)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the schedules refused by the kernel are rejected before any
+// thread is changed.
+func TestPinThreadsInvalidSchedule(t *testing.T) {
+	other := SchedOther
+	fifo := SchedFIFO
+	rr := SchedRR
+	unknown := SchedPolicy(42)
+	schedules := []ThreadSchedule{
+		{Priority: 10},
+		{Policy: &other, Priority: 10},
+		{Policy: &fifo},
+		{Policy: &rr, Priority: 100},
+		{Policy: &unknown},
+	}
+
+	for _, s := range schedules {
+		sched := newTestThreadScheduler(100, 101, 102, 103)
+		pinning := ThreadPinning{
+			VCPUs: map[int]ThreadSchedule{
+				0: {CPUs: []int{2}},
+				1: s,
+			},
+			Scheduler: sched,
+		}
+
+		q, disconnectedCh := startPinningQMPLoop(t)
+		err := q.PinThreads(context.Background(), 100, pinning)
+		if err == nil {
+			t.Errorf("Expected error for %+v", s)
+		}
+		q.Shutdown()
+		<-disconnectedCh
+
+		if sched.threads[101].cpus != nil {
+			t.Errorf("Unexpected change of vCPU 0 for %+v", s)
+		}
+	}
+}
@@ -67,14 +67,11 @@ func Example() {
 
 	// Let's try to shutdown the VM.  If it hasn't shutdown in 10 seconds we'll
 	// send a quit message.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	err = q.ExecuteSystemPowerdown(ctx)
-	cancel()
+	_, err = qemu.Shutdown(context.Background(), q, qemu.ShutdownOptions{
+		PowerdownTimeout: 10 * time.Second,
+	})
 	if err != nil {
-		err = q.ExecuteQuit(context.Background())
-		if err != nil {
-			panic(err)
-		}
+		panic(err)
 	}
 
 	q.Shutdown()
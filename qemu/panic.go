@@ -0,0 +1,294 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GuestPanicHyperV is the crash information reported by a guest through the
+// Hyper-V crash MSRs, e.g. the bug check code and its parameters of Windows.
+type GuestPanicHyperV struct {
+	Arg1 uint64
+	Arg2 uint64
+	Arg3 uint64
+	Arg4 uint64
+	Arg5 uint64
+}
+
+// GuestPanicS390 is the crash information reported for an s390 guest.
+type GuestPanicS390 struct {
+	// Core is the CPU which crashed.
+	Core uint32
+
+	// PSWMask and PSWAddr are the program status word of the CPU.
+	PSWMask uint64
+	PSWAddr uint64
+
+	// Reason is the reason of the crash, e.g. disabled-wait.
+	Reason string
+}
+
+// GuestPanic is the data of a GUEST_PANICKED or GUEST_CRASHLOADED event.
+type GuestPanic struct {
+	// Crashloaded is true for a GUEST_CRASHLOADED event, emitted when the
+	// guest loaded a crash kernel, and false for a GUEST_PANICKED event.
+	Crashloaded bool
+
+	// Action is the action taken by qemu, i.e. pause, poweroff or run.
+	Action string
+
+	// HyperV is the crash information of a guest using the Hyper-V crash
+	// MSRs, if any.
+	HyperV *GuestPanicHyperV
+
+	// S390 is the crash information of an s390 guest, if any.
+	S390 *GuestPanicS390
+}
+
+// DecodeGuestPanic returns the data of a GUEST_PANICKED or GUEST_CRASHLOADED
+// event.
+func DecodeGuestPanic(ev QMPEvent) (GuestPanic, error) {
+	var p GuestPanic
+
+	switch ev.Name {
+	case "GUEST_PANICKED":
+	case "GUEST_CRASHLOADED":
+		p.Crashloaded = true
+	default:
+		return p, fmt.Errorf("unexpected event %s", ev.Name)
+	}
+
+	data := ev.Data
+	if len(ev.rawData) != 0 {
+		// The crash parameters are 64-bit addresses and codes, which
+		// float64 cannot hold exactly, so they are decoded again from
+		// the json data of the event.
+		data = nil
+		dec := json.NewDecoder(bytes.NewReader(ev.rawData))
+		dec.UseNumber()
+		if err := dec.Decode(&data); err != nil {
+			return p, fmt.Errorf("unable to decode %s event: %v", ev.Name, err)
+		}
+	}
+
+	p.Action, _ = data["action"].(string)
+
+	info, ok := data["info"].(map[string]interface{})
+	if !ok {
+		return p, nil
+	}
+
+	switch info["type"] {
+	case "hyper-v":
+		p.HyperV = &GuestPanicHyperV{
+			Arg1: eventUint64(info, "arg1"),
+			Arg2: eventUint64(info, "arg2"),
+			Arg3: eventUint64(info, "arg3"),
+			Arg4: eventUint64(info, "arg4"),
+			Arg5: eventUint64(info, "arg5"),
+		}
+	case "s390":
+		p.S390 = &GuestPanicS390{
+			Core:    uint32(eventUint64(info, "core")),
+			PSWMask: eventUint64(info, "psw-mask"),
+			PSWAddr: eventUint64(info, "psw-addr"),
+		}
+		p.S390.Reason, _ = info["reason"].(string)
+	}
+
+	return p, nil
+}
+
+// eventUint64 returns the number key of the data of an event.  The number
+// is a json.Number for the events received by the QMP loop, and a float64
+// for the events whose data was built by the caller.
+func eventUint64(data map[string]interface{}, key string) uint64 {
+	switch n := data[key].(type) {
+	case json.Number:
+		v, _ := strconv.ParseUint(string(n), 10, 64)
+		return v
+	case float64:
+		switch {
+		case n <= 0:
+			return 0
+		case n >= math.MaxUint64:
+			return math.MaxUint64
+		}
+		return uint64(n)
+	}
+
+	return 0
+}
+
+// GuestPanicOptions is the reaction of a GuestPanicWatcher to the guest
+// panics.
+type GuestPanicOptions struct {
+	// DumpDir is the directory the guest memory is dumped to when the
+	// guest panics.  The memory is not dumped if DumpDir is empty.  The
+	// memory can only be dumped if qemu pauses the guest on panics, see
+	// PanicActionPause.
+	DumpDir string
+
+	// DumpFormat is the format of the dump, elf by default.
+	DumpFormat DumpFormat
+
+	// DumpPaging dumps the guest memory as mapped by the guest, rather
+	// than its physical memory.
+	DumpPaging bool
+
+	// Quit makes qemu quit once the guest memory is dumped.
+	Quit bool
+
+	// Handler is called once the reaction to a panic is over, with the
+	// path of the dump, if any, and the error of the reaction.  It is
+	// also called on GUEST_CRASHLOADED events, which need no reaction as
+	// the guest dumps itself.
+	Handler func(p GuestPanic, dump string, err error)
+}
+
+// GuestPanicWatcher reacts to the guest panics reported by a QMP instance.
+type GuestPanicWatcher struct {
+	q      *QMP
+	l      *qmpEventListener
+	opts   GuestPanicOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	lock     sync.Mutex
+	reacting bool
+}
+
+// WatchGuestPanics starts reacting to the GUEST_PANICKED events as
+// configured by opts.  A single panic is handled at a time, and the panics
+// reported while the previous one is handled are ignored.  The watcher
+// stops when the QMP connection is lost or Stop is called.
+func (q *QMP) WatchGuestPanics(opts GuestPanicOptions) *GuestPanicWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &GuestPanicWatcher{
+		q:      q,
+		l:      q.addEventListener(),
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.loop()
+
+	return w
+}
+
+func (w *GuestPanicWatcher) loop() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.l.done:
+			return
+		case <-w.q.disconnectedCh:
+			return
+		case ev := <-w.l.ch:
+			w.event(ev)
+		}
+	}
+}
+
+// event handles an event of the QMP loop, and ignores the events other than
+// the guest panics.  The reactions run in their own goroutine, so that the
+// events keep being received while they issue QMP commands.
+func (w *GuestPanicWatcher) event(ev QMPEvent) {
+	p, err := DecodeGuestPanic(ev)
+	if err != nil {
+		return
+	}
+
+	if p.Crashloaded {
+		if w.opts.Handler != nil {
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				w.opts.Handler(p, "", nil)
+			}()
+		}
+		return
+	}
+
+	w.lock.Lock()
+	reacting := w.reacting
+	w.reacting = true
+	w.lock.Unlock()
+	if reacting {
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.react(p)
+
+		w.lock.Lock()
+		w.reacting = false
+		w.lock.Unlock()
+	}()
+}
+
+func (w *GuestPanicWatcher) react(p GuestPanic) {
+	var dump string
+	var err error
+
+	if w.opts.DumpDir != "" {
+		dump = filepath.Join(w.opts.DumpDir,
+			fmt.Sprintf("guest-panic-%s.dump", time.Now().Format("20060102-150405.000000000")))
+		opts := DumpGuestMemoryOptions{
+			Format: w.opts.DumpFormat,
+			Paging: w.opts.DumpPaging,
+		}
+		if _, err = w.q.DumpGuestMemory(w.ctx, "file:"+dump, opts, nil); err != nil {
+			err = fmt.Errorf("unable to dump the guest memory: %v", err)
+		}
+	}
+
+	// The guest is not usable anymore, even if it could not be dumped.
+	if w.opts.Quit {
+		if qerr := w.q.ExecuteQuit(w.ctx); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+
+	if w.opts.Handler != nil {
+		w.opts.Handler(p, dump, err)
+	}
+}
+
+// Stop stops the watcher, and waits for the current reaction to a panic to
+// end.
+func (w *GuestPanicWatcher) Stop() {
+	w.cancel()
+	w.q.removeEventListener(w.l)
+	<-w.done
+	w.wg.Wait()
+}
@@ -0,0 +1,263 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Checks that GUEST_PANICKED and GUEST_CRASHLOADED events are decoded.
+func TestDecodeGuestPanic(t *testing.T) {
+	tests := []struct {
+		ev       QMPEvent
+		expected GuestPanic
+	}{
+		{
+			QMPEvent{
+				Name: "GUEST_PANICKED",
+				Data: map[string]interface{}{"action": "pause"},
+			},
+			GuestPanic{Action: "pause"},
+		},
+		{
+			QMPEvent{
+				Name: "GUEST_PANICKED",
+				Data: map[string]interface{}{
+					"action": "pause",
+					"info": map[string]interface{}{
+						"type": "hyper-v",
+						"arg1": float64(0xd1),
+						"arg2": float64(0x10),
+						"arg3": float64(2),
+						"arg4": float64(0),
+						"arg5": float64(0xfffff80000000000),
+					},
+				},
+			},
+			GuestPanic{
+				Action: "pause",
+				HyperV: &GuestPanicHyperV{
+					Arg1: 0xd1,
+					Arg2: 0x10,
+					Arg3: 2,
+					Arg5: 0xfffff80000000000,
+				},
+			},
+		},
+		{
+			QMPEvent{
+				Name: "GUEST_PANICKED",
+				Data: map[string]interface{}{
+					"action": "poweroff",
+					"info": map[string]interface{}{
+						"type":     "s390",
+						"core":     float64(1),
+						"psw-mask": float64(0x2000180000000),
+						"psw-addr": float64(0x1234),
+						"reason":   "disabled-wait",
+					},
+				},
+			},
+			GuestPanic{
+				Action: "poweroff",
+				S390: &GuestPanicS390{
+					Core:    1,
+					PSWMask: 0x2000180000000,
+					PSWAddr: 0x1234,
+					Reason:  "disabled-wait",
+				},
+			},
+		},
+		{
+			QMPEvent{
+				Name: "GUEST_CRASHLOADED",
+				Data: map[string]interface{}{"action": "run"},
+			},
+			GuestPanic{Crashloaded: true, Action: "run"},
+		},
+	}
+
+	for _, test := range tests {
+		p, err := DecodeGuestPanic(test.ev)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("Expected %+v, got %+v", test.expected, p)
+		}
+	}
+
+	if _, err := DecodeGuestPanic(QMPEvent{Name: "SHUTDOWN"}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+type guestPanicResult struct {
+	p    GuestPanic
+	dump string
+	err  error
+}
+
+func watchGuestPanicsTest(t *testing.T, buf *qmpTestCommandBuffer, opts GuestPanicOptions) guestPanicResult {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	resCh := make(chan guestPanicResult, 1)
+	opts.Handler = func(p GuestPanic, dump string, err error) {
+		resCh <- guestPanicResult{p, dump, err}
+	}
+	w := q.WatchGuestPanics(opts)
+
+	var wg sync.WaitGroup
+	buf.startEventLoop(&wg)
+
+	var res guestPanicResult
+	select {
+	case res = <-resCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the panic to be handled")
+	}
+
+	wg.Wait()
+	w.Stop()
+	q.Shutdown()
+	<-disconnectedCh
+
+	return res
+}
+
+// Checks that the guest memory is dumped and qemu quits when the guest
+// panics.
+//
+// We start a QMPLoop and a guest panic watcher, and send a GUEST_PANICKED
+// event followed by a DUMP_COMPLETED event.
+//
+// The handler should receive the panic and the path of the dump, after the
+// dump-guest-memory and quit commands.
+func TestWatchGuestPanics(t *testing.T) {
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	buf.AddCommand("quit", nil, "return", nil)
+	buf.AddEvent("GUEST_PANICKED", 50*time.Millisecond, map[string]interface{}{
+		"action": "pause",
+	}, nil)
+	buf.AddEvent("DUMP_COMPLETED", 10*time.Millisecond, map[string]interface{}{
+		"result": map[string]interface{}{
+			"status":    "completed",
+			"completed": float64(1024),
+			"total":     float64(1024),
+		},
+	}, nil)
+
+	dir := t.TempDir()
+	res := watchGuestPanicsTest(t, buf, GuestPanicOptions{
+		DumpDir: dir,
+		Quit:    true,
+	})
+
+	if res.err != nil {
+		t.Errorf("Unexpected error: %v", res.err)
+	}
+	if res.p.Action != "pause" {
+		t.Errorf("Unexpected panic %+v", res.p)
+	}
+	if filepath.Dir(res.dump) != dir || !strings.HasPrefix(filepath.Base(res.dump), "guest-panic-") {
+		t.Errorf("Unexpected dump path %s", res.dump)
+	}
+	if buf.currentCmd != 2 {
+		t.Errorf("Expected 2 commands, got %d", buf.currentCmd)
+	}
+}
+
+// Checks that a failed dump is reported to the handler.
+func TestWatchGuestPanicsDumpError(t *testing.T) {
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	buf.AddEvent("GUEST_PANICKED", 50*time.Millisecond, map[string]interface{}{
+		"action": "pause",
+	}, nil)
+	buf.AddEvent("DUMP_COMPLETED", 10*time.Millisecond, map[string]interface{}{
+		"result": map[string]interface{}{
+			"status": "failed",
+		},
+		"error": "No space left on device",
+	}, nil)
+
+	res := watchGuestPanicsTest(t, buf, GuestPanicOptions{DumpDir: t.TempDir()})
+
+	if res.err == nil || !strings.Contains(res.err.Error(), "No space left on device") {
+		t.Errorf("Expected a dump error, got %v", res.err)
+	}
+}
+
+// Checks that GUEST_CRASHLOADED events are only reported to the handler.
+func TestWatchGuestPanicsCrashloaded(t *testing.T) {
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddEvent("GUEST_CRASHLOADED", 50*time.Millisecond, map[string]interface{}{
+		"action": "run",
+	}, nil)
+
+	res := watchGuestPanicsTest(t, buf, GuestPanicOptions{
+		DumpDir: t.TempDir(),
+		Quit:    true,
+	})
+
+	if !res.p.Crashloaded || res.dump != "" || res.err != nil {
+		t.Errorf("Unexpected result %+v", res)
+	}
+	if buf.currentCmd != 0 {
+		t.Errorf("Expected no command, got %d", buf.currentCmd)
+	}
+}
+
+// Checks that the 64-bit crash parameters of the events received by the QMP
+// loop are decoded exactly.
+func TestWatchGuestPanicsHyperV(t *testing.T) {
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddEvent("GUEST_PANICKED", 50*time.Millisecond, map[string]interface{}{
+		"action": "pause",
+		"info": map[string]interface{}{
+			"type": "hyper-v",
+			"arg1": uint64(0xffffffff81000001),
+			"arg2": uint64(math.MaxUint64),
+			"arg3": uint64(1),
+			"arg4": uint64(0),
+			"arg5": uint64(1<<53 + 1),
+		},
+	}, nil)
+
+	res := watchGuestPanicsTest(t, buf, GuestPanicOptions{})
+
+	expected := &GuestPanicHyperV{
+		Arg1: 0xffffffff81000001,
+		Arg2: math.MaxUint64,
+		Arg3: 1,
+		Arg5: 1<<53 + 1,
+	}
+	if !reflect.DeepEqual(res.p.HyperV, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, res.p.HyperV)
+	}
+}
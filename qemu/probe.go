@@ -0,0 +1,278 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Capabilities describes what a qemu binary supports.  It is returned by
+// ProbeBinary, and can be saved to and loaded from a file to avoid probing
+// the binary every time it is used.
+type Capabilities struct {
+	// Path is the path of the qemu binary.
+	Path string `json:"path"`
+
+	// ModTime is the modification time of the qemu binary when it was
+	// probed.
+	ModTime time.Time `json:"mod-time"`
+
+	// Version is the qemu version and the QMP capabilities.
+	Version QMPVersion `json:"version"`
+
+	// Machines are the supported machine types.
+	Machines []MachineInfo `json:"machines"`
+
+	// Accelerators are the names of the accelerators compiled into the
+	// binary, e.g. kvm.  They are not necessarily usable on the host, e.g.
+	// kvm is listed even if /dev/kvm is not available.
+	Accelerators []string `json:"accelerators"`
+
+	// CPUModels are the supported CPU models.
+	CPUModels []CPUDefinition `json:"cpu-models"`
+
+	// DeviceTypes are the names of the supported device drivers.
+	DeviceTypes []string `json:"device-types"`
+
+	// QMPSchema is the QMP schema.
+	QMPSchema []SchemaInfo `json:"qmp-schema"`
+}
+
+// probeParams are the parameters used to start a qemu binary to probe it.
+var probeParams = []string{
+	"-machine", "none",
+	"-S",
+	"-nodefaults",
+	"-no-user-config",
+	"-display", "none",
+	"-qmp", "stdio",
+}
+
+// probeConn is a QMP connection over the standard input and output of a
+// qemu process.
+type probeConn struct {
+	io.ReadCloser
+	stdin io.WriteCloser
+}
+
+func (c probeConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c probeConn) Close() error {
+	_ = c.stdin.Close()
+	return c.ReadCloser.Close()
+}
+
+// ProbeBinary returns the capabilities of the qemu binary path.  The binary
+// is started without a guest, with a QMP monitor on its standard input and
+// output, and is queried for its version, machine types, accelerators, CPU
+// models, device drivers and QMP schema.  The binary is stopped before the
+// function returns.
+func ProbeBinary(ctx context.Context, path string) (*Capabilities, error) {
+	binary, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	/* #nosec */
+	cmd := exec.CommandContext(ctx, binary, probeParams...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	q := startQMPLoop(probeConn{stdout, stdin}, QMPConfig{Logger: qmpNullLogger{}}, connectedCh, disconnectedCh)
+
+	caps, err := q.probe(ctx, connectedCh, disconnectedCh)
+
+	q.Shutdown()
+	<-disconnectedCh
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to probe %s: %v: %s", binary, err, stderr.String())
+	}
+
+	caps.Path = binary
+	caps.ModTime = info.ModTime()
+
+	return caps, nil
+}
+
+func (q *QMP) probe(ctx context.Context, connectedCh <-chan *QMPVersion, disconnectedCh <-chan struct{}) (*Capabilities, error) {
+	var caps Capabilities
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-disconnectedCh:
+		return nil, fmt.Errorf("lost connection to qemu")
+	case version := <-connectedCh:
+		if version == nil {
+			return nil, fmt.Errorf("failed to find QMP version information")
+		}
+		caps.Version = *version
+	}
+
+	err := q.ExecuteQMPCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if caps.Machines, err = q.ExecQueryMachines(ctx); err != nil {
+		return nil, err
+	}
+
+	accels, err := q.ExecQomListTypes(ctx, "accel", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accels {
+		caps.Accelerators = append(caps.Accelerators, strings.TrimSuffix(a.Name, "-accel"))
+	}
+
+	if caps.CPUModels, err = q.ExecQueryCPUDefinitions(ctx); err != nil {
+		return nil, err
+	}
+
+	devices, err := q.ExecQomListTypes(ctx, "device", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		caps.DeviceTypes = append(caps.DeviceTypes, d.Name)
+	}
+
+	if caps.QMPSchema, err = q.ExecQueryQmpSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	// qemu is killed anyway if it does not quit.
+	_ = q.ExecuteQuit(ctx)
+
+	return &caps, nil
+}
+
+// LoadCapabilities loads the capabilities saved to the file path.
+func LoadCapabilities(path string) (*Capabilities, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var caps Capabilities
+	if err = json.Unmarshal(data, &caps); err != nil {
+		return nil, fmt.Errorf("unable to convert json to capabilities: %v", err)
+	}
+
+	return &caps, nil
+}
+
+// Save saves the capabilities to the file path.
+func (caps *Capabilities) Save(path string) error {
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return fmt.Errorf("unable to convert capabilities to json: %v", err)
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Stale returns true if the qemu binary has been modified since it was
+// probed.
+func (caps *Capabilities) Stale() (bool, error) {
+	info, err := os.Stat(caps.Path)
+	if err != nil {
+		return false, err
+	}
+
+	return !info.ModTime().Equal(caps.ModTime), nil
+}
+
+// HasMachine returns true if the machine type name, or its alias, is
+// supported.
+func (caps *Capabilities) HasMachine(name string) bool {
+	for _, m := range caps.Machines {
+		if m.Name == name || m.Alias == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasAccelerator returns true if the accelerator name is compiled into the
+// binary.  It does not check whether the host can use it.
+func (caps *Capabilities) HasAccelerator(name string) bool {
+	for _, a := range caps.Accelerators {
+		if a == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasDevice returns true if the device driver name is supported.
+func (caps *Capabilities) HasDevice(name string) bool {
+	for _, d := range caps.DeviceTypes {
+		if d == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasCommand returns true if the QMP command name is supported.
+func (caps *Capabilities) HasCommand(name string) bool {
+	for _, s := range caps.QMPSchema {
+		if s.MetaType == "command" && s.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const fakeQemuBinary = `#!/bin/sh
+echo '{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}, "package": ""}, "capabilities": []}}'
+while read -r line; do
+	case "$line" in
+	*qmp_capabilities*)
+		echo '{"return": {}}' ;;
+	*query-machines*)
+		echo '{"return": [{"name": "pc-q35-6.2", "alias": "q35", "cpu-max": 288, "hotpluggable-cpus": true, "numa-mem-supported": false, "deprecated": false}]}' ;;
+	*'"implements":"accel"'*)
+		echo '{"return": [{"name": "kvm-accel", "parent": "accel"}, {"name": "tcg-accel", "parent": "accel"}]}' ;;
+	*qom-list-types*)
+		echo '{"return": [{"name": "virtio-net-pci", "parent": "virtio-net-pci-base"}]}' ;;
+	*query-cpu-definitions*)
+		echo '{"return": [{"name": "host", "typename": "host-x86_64-cpu", "static": false, "deprecated": false}]}' ;;
+	*query-qmp-schema*)
+		echo '{"return": [{"name": "query-status", "meta-type": "command"}, {"name": "STOP", "meta-type": "event"}]}' ;;
+	*quit*)
+		echo '{"return": {}}'
+		exit 0 ;;
+	esac
+done
+`
+
+func writeFakeQemuBinary(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "qemu-system-fake")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake qemu binary: %v", err)
+	}
+
+	return path
+}
+
+// Checks that ProbeBinary collects the capabilities of a qemu binary.
+//
+// A fake qemu binary answering the probe commands is probed and the returned
+// capabilities are checked, as well as the results of the Has methods.
+//
+// ProbeBinary should succeed and return the capabilities reported by the
+// fake binary.
+func TestProbeBinary(t *testing.T) {
+	path := writeFakeQemuBinary(t, fakeQemuBinary)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	caps, err := ProbeBinary(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if caps.Path != path {
+		t.Errorf("Unexpected path %s", caps.Path)
+	}
+	if caps.Version.Major != 6 || caps.Version.Minor != 2 {
+		t.Errorf("Unexpected version %d.%d", caps.Version.Major, caps.Version.Minor)
+	}
+	if !reflect.DeepEqual(caps.Accelerators, []string{"kvm", "tcg"}) {
+		t.Errorf("Unexpected accelerators %v", caps.Accelerators)
+	}
+	if !reflect.DeepEqual(caps.DeviceTypes, []string{"virtio-net-pci"}) {
+		t.Errorf("Unexpected device types %v", caps.DeviceTypes)
+	}
+	if len(caps.CPUModels) != 1 || caps.CPUModels[0].Name != "host" {
+		t.Errorf("Unexpected CPU models %v", caps.CPUModels)
+	}
+
+	if !caps.HasMachine("q35") || !caps.HasMachine("pc-q35-6.2") || caps.HasMachine("virt") {
+		t.Errorf("Unexpected machine support %v", caps.Machines)
+	}
+	if !caps.HasAccelerator("kvm") || caps.HasAccelerator("hvf") {
+		t.Errorf("Unexpected accelerator support %v", caps.Accelerators)
+	}
+	if !caps.HasDevice("virtio-net-pci") || caps.HasDevice("e1000") {
+		t.Errorf("Unexpected device support %v", caps.DeviceTypes)
+	}
+	if !caps.HasCommand("query-status") || caps.HasCommand("STOP") {
+		t.Errorf("Unexpected command support %v", caps.QMPSchema)
+	}
+}
+
+// Checks that ProbeBinary fails if the binary exits.
+//
+// A fake qemu binary that exits without sending a greeting is probed.
+//
+// ProbeBinary should fail.
+func TestProbeBinaryExit(t *testing.T) {
+	path := writeFakeQemuBinary(t, "#!/bin/sh\necho 'qemu: failed' >&2\nexit 1\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := ProbeBinary(ctx, path); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+// Checks that capabilities can be saved and loaded.
+//
+// Capabilities are saved to a file, loaded back and compared, and checked
+// for staleness against the binary they describe.
+//
+// The loaded capabilities should match the saved ones and not be stale.
+func TestCapabilitiesSaveLoad(t *testing.T) {
+	path := writeFakeQemuBinary(t, fakeQemuBinary)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	caps, err := ProbeBinary(ctx, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cache := filepath.Join(t.TempDir(), "caps.json")
+	if err = caps.Save(cache); err != nil {
+		t.Fatalf("Unable to save capabilities: %v", err)
+	}
+
+	loaded, err := LoadCapabilities(cache)
+	if err != nil {
+		t.Fatalf("Unable to load capabilities: %v", err)
+	}
+
+	if !reflect.DeepEqual(caps.Machines, loaded.Machines) ||
+		!reflect.DeepEqual(caps.QMPSchema, loaded.QMPSchema) ||
+		!caps.ModTime.Equal(loaded.ModTime) {
+		t.Errorf("Loaded capabilities %+v differ from %+v", loaded, caps)
+	}
+
+	stale, err := loaded.Stale()
+	if err != nil || stale {
+		t.Errorf("Unexpected staleness %v, %v", stale, err)
+	}
+}
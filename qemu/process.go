@@ -0,0 +1,489 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processStderrSize is the number of bytes of the standard error of a qemu
+// process kept by Process.
+const processStderrSize = 64 * 1024
+
+// qmpChardevID is the ID of the chardev of the QMP monitor created by
+// StartQemuWithQMP.
+const qmpChardevID = "govmm-qmp"
+
+// qmpSocketPollInterval is the interval at which Process.ConnectQMP checks
+// whether qemu has created its QMP socket.
+const qmpSocketPollInterval = 10 * time.Millisecond
+
+// ringBuffer is an io.Writer keeping the last size bytes written to it.
+type ringBuffer struct {
+	sync.Mutex
+	buf  []byte
+	size int
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	n := len(p)
+	if n >= r.size {
+		r.buf = append(r.buf[:0], p[n-r.size:]...)
+		return n, nil
+	}
+
+	if over := len(r.buf) + n - r.size; over > 0 {
+		r.buf = append(r.buf[:0], r.buf[over:]...)
+	}
+	r.buf = append(r.buf, p...)
+
+	return n, nil
+}
+
+func (r *ringBuffer) String() string {
+	r.Lock()
+	defer r.Unlock()
+
+	return string(r.buf)
+}
+
+// Process is a qemu process started by StartQemu or StartQemuWithQMP.
+type Process struct {
+	cmd       *exec.Cmd
+	stderr    *ringBuffer
+	out       *stderrWriter
+	qmpSocket string
+	done      chan struct{}
+	err       error
+}
+
+// StartQemu starts a new qemu instance, and returns without waiting for it
+// to exit.  The Config parameter contains a set of qemu parameters and
+// settings, which are turned into the qemu command line by Config.Build.
+// As the returned Process tracks the qemu process, config.Knobs.Daemonize
+// must not be set.
+//
+// This function writes its log output via logger parameter.
+func StartQemu(config Config, logger QMPLog) (*Process, error) {
+	return startQemu(config, nil, logger)
+}
+
+// StartQemuWithQMP starts a new qemu instance like StartQemu, along with a
+// QMP monitor on a socket pair created by govmm and connected to qemu when
+// it starts, so that no socket needs to be waited for.  It waits for the QMP
+// greeting of qemu, and returns the QMP instance along with the process.
+// The cfg and disconnectedCh parameters are the ones of QMPStart.  If the
+// QMP connection fails, qemu is killed.
+func StartQemuWithQMP(ctx context.Context, config Config, cfg QMPConfig, disconnectedCh chan struct{},
+	logger QMPLog) (*Process, *QMP, *QMPVersion, error) {
+	// SOCK_CLOEXEC is not available on all platforms, so the fork lock
+	// is held until close-on-exec is set to keep the sockets from leaking
+	// into processes started concurrently.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		close(disconnectedCh)
+		return nil, nil, nil, fmt.Errorf("unable to create the QMP socket pair: %v", err)
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "qmp")
+	remote := os.NewFile(uintptr(fds[1]), "qmp-qemu")
+
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		remote.Close()
+		close(disconnectedCh)
+		return nil, nil, nil, fmt.Errorf("unable to use the QMP socket pair: %v", err)
+	}
+
+	p, err := startQemu(config, remote, logger)
+	remote.Close()
+	if err != nil {
+		conn.Close()
+		close(disconnectedCh)
+		return nil, nil, nil, err
+	}
+
+	q, version, err := qmpConnect(ctx, conn, cfg, disconnectedCh)
+	if err != nil {
+		_ = p.Kill()
+		_ = p.Wait()
+		return nil, nil, nil, fmt.Errorf("unable to connect to QMP: %v: %s", err, p.Stderr())
+	}
+
+	return p, q, version, nil
+}
+
+func startQemu(config Config, qmp *os.File, logger QMPLog) (*Process, error) {
+	if logger == nil {
+		logger = qmpNullLogger{}
+	}
+
+	if config.Knobs.Daemonize {
+		return nil, fmt.Errorf("StartQemu does not support daemonized qemu instances")
+	}
+
+	args, fds, err := config.build(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if qmp != nil {
+		// The extra files are passed to qemu from file descriptor 3.
+		fds = append(fds, qmp)
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=%s,fd=%d", qmpChardevID, len(fds)+2),
+			"-mon", fmt.Sprintf("chardev=%s,mode=control", qmpChardevID))
+	}
+
+	cmd := qemuCommand(config.context(), config.Path, args, fds, config.sysProcAttr(), logger)
+
+	p := &Process{
+		cmd:    cmd,
+		stderr: &ringBuffer{size: processStderrSize},
+		done:   make(chan struct{}),
+	}
+	cmd.Stderr = p.stderr
+	if p.out = config.stderrWriter(logger); p.out != nil {
+		cmd.Stderr = io.MultiWriter(p.stderr, p.out)
+	}
+
+	for _, q := range config.QMPSockets {
+		if q.Valid() && q.Server {
+			p.qmpSocket = q.Name
+			break
+		}
+	}
+
+	logger.Infof("starting %s with: %v", cmd.Args[0], args)
+
+	if err = cmd.Start(); err != nil {
+		logger.Errorf("Unable to start %s: %v", cmd.Args[0], err)
+		return nil, err
+	}
+
+	go func() {
+		p.err = cmd.Wait()
+		if p.out != nil {
+			p.out.Flush()
+		}
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+// PID returns the process ID of qemu.
+func (p *Process) PID() int {
+	return p.cmd.Process.Pid
+}
+
+// Done returns a channel closed when qemu exits.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits for qemu to exit, and returns the error reported by
+// exec.Cmd.Wait, e.g. an *exec.ExitError if qemu exited with a non zero
+// status.  It can be called several times.
+func (p *Process) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// ExitCode returns the exit status of qemu, or -1 if qemu is still running
+// or was terminated by a signal.
+func (p *Process) ExitCode() int {
+	select {
+	case <-p.done:
+		return p.cmd.ProcessState.ExitCode()
+	default:
+		return -1
+	}
+}
+
+// Stderr returns the last bytes written by qemu to its standard error.
+func (p *Process) Stderr() string {
+	return p.stderr.String()
+}
+
+// Signal sends the signal sig to qemu.
+func (p *Process) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// Kill kills qemu.  It does not wait for qemu to exit.
+func (p *Process) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+// ConnectQMP connects to the first QMP server socket of the configuration
+// qemu was started with, once qemu has created it.  It fails if qemu exits
+// or ctx is done before the socket is created.  The cfg and disconnectedCh
+// parameters are the ones of QMPStart.
+func (p *Process) ConnectQMP(ctx context.Context, cfg QMPConfig, disconnectedCh chan struct{}) (*QMP, *QMPVersion, error) {
+	if p.qmpSocket == "" {
+		close(disconnectedCh)
+		return nil, nil, fmt.Errorf("no QMP server socket in the configuration")
+	}
+
+	for {
+		if _, err := os.Stat(p.qmpSocket); err == nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			close(disconnectedCh)
+			return nil, nil, ctx.Err()
+		case <-p.done:
+			close(disconnectedCh)
+			return nil, nil, fmt.Errorf("qemu exited: %v: %s", p.err, p.Stderr())
+		case <-time.After(qmpSocketPollInterval):
+		}
+	}
+
+	return QMPStart(ctx, p.qmpSocket, cfg, disconnectedCh)
+}
+
+// ShutdownStage is the stage of Shutdown which ended the VM.
+type ShutdownStage string
+
+const (
+	// ShutdownStagePowerdown means that the guest shut down after the
+	// ACPI powerdown request.
+	ShutdownStagePowerdown ShutdownStage = "powerdown"
+
+	// ShutdownStageQuit means that qemu exited after the quit command.
+	ShutdownStageQuit ShutdownStage = "quit"
+
+	// ShutdownStageKill means that qemu was killed.
+	ShutdownStageKill ShutdownStage = "kill"
+)
+
+// defaultPowerdownTimeout and defaultQuitTimeout are the default timeouts of
+// the Shutdown stages.
+const (
+	defaultPowerdownTimeout = 10 * time.Second
+	defaultQuitTimeout      = 5 * time.Second
+)
+
+// shutdownDrainTimeout bounds the time Shutdown waits for the QMP loop to
+// exit once qemu has exited.
+const shutdownDrainTimeout = 200 * time.Millisecond
+
+// ShutdownOptions are the options of Shutdown.
+type ShutdownOptions struct {
+	// PowerdownTimeout is the time the guest is given to shut down after
+	// the ACPI powerdown request.  It defaults to 10 seconds.
+	PowerdownTimeout time.Duration
+
+	// QuitTimeout is the time qemu is given to exit after the quit
+	// command.  It defaults to 5 seconds.
+	QuitTimeout time.Duration
+
+	// Process is the qemu process, killed if it does not exit after the
+	// quit command.  It is optional.
+	Process *Process
+}
+
+// ShutdownResult describes how Shutdown ended the VM.
+type ShutdownResult struct {
+	// Stage is the stage which ended the VM.
+	Stage ShutdownStage
+
+	// Guest is true if the shutdown was initiated by the guest.
+	Guest bool
+
+	// Reason is the reason of the shutdown reported by the SHUTDOWN
+	// event, e.g. guest-shutdown.  It is empty if no SHUTDOWN event was
+	// received.
+	Reason string
+}
+
+// Shutdown shuts the VM monitored by q down.  It first asks the guest to
+// shut down with an ACPI powerdown request, and waits for the SHUTDOWN
+// event or for qemu to exit.  If the guest does not shut down in time, it
+// sends the quit command and waits for qemu to exit, and then kills
+// opts.Process if it is set.  The returned ShutdownResult reports the stage
+// which ended the VM, and the shutdown reason reported by qemu.
+func Shutdown(ctx context.Context, q *QMP, opts ShutdownOptions) (ShutdownResult, error) {
+	var res ShutdownResult
+
+	if opts.PowerdownTimeout == 0 {
+		opts.PowerdownTimeout = defaultPowerdownTimeout
+	}
+	if opts.QuitTimeout == 0 {
+		opts.QuitTimeout = defaultQuitTimeout
+	}
+
+	l := q.addEventListener()
+	defer q.removeEventListener(l)
+
+	res.Stage = ShutdownStagePowerdown
+	ended, err := q.shutdownStage(ctx, l, opts.Process, opts.PowerdownTimeout, &res, q.ExecuteSystemPowerdown)
+	if ended || err != nil {
+		return res, err
+	}
+
+	res.Stage = ShutdownStageQuit
+	ended, err = q.shutdownStage(ctx, l, opts.Process, opts.QuitTimeout, &res, q.ExecuteQuit)
+	if ended || err != nil {
+		return res, err
+	}
+
+	if opts.Process == nil {
+		return res, fmt.Errorf("qemu did not exit after the quit command")
+	}
+
+	// The events are no longer received, so the listener must not block
+	// the QMP loop while qemu is killed.
+	q.removeEventListener(l)
+
+	res.Stage = ShutdownStageKill
+	if err = opts.Process.Kill(); err != nil {
+		return res, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return res, ctx.Err()
+	case <-opts.Process.Done():
+		return res, nil
+	}
+}
+
+// shutdownStage runs the command of a Shutdown stage, and waits for the VM
+// to end for timeout.  It returns true if the VM ended.
+func (q *QMP) shutdownStage(ctx context.Context, l *qmpEventListener, p *Process, timeout time.Duration,
+	res *ShutdownResult, command func(context.Context) error) (bool, error) {
+	stageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var exited <-chan struct{}
+	if p != nil {
+		exited = p.Done()
+	}
+
+	// The events are received while the command runs, so that the QMP
+	// loop is not blocked.  The command fails if qemu exits before
+	// replying, which is detected below.
+	cmdDone := make(chan struct{})
+	go func() {
+		_ = command(stageCtx)
+		close(cmdDone)
+	}()
+
+	var ended, shutdown bool
+	var err error
+
+	for !ended && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-stageCtx.Done():
+			err = errStageTimeout
+		case <-q.disconnectedCh:
+			ended = true
+		case <-exited:
+			ended = true
+		case ev := <-l.ch:
+			shutdown = res.update(ev)
+			ended = shutdown
+		}
+	}
+
+	if err == errStageTimeout {
+		err = nil
+	}
+
+	// The command must return before the next stage or the QMP instance
+	// is shut down.
+	cancel()
+	for cmdDone != nil {
+		select {
+		case <-cmdDone:
+			cmdDone = nil
+		case ev := <-l.ch:
+			shutdown = res.update(ev) || shutdown
+		}
+	}
+
+	if ended && !shutdown {
+		q.drainShutdownEvents(ctx, l, res)
+	}
+
+	return ended || shutdown, err
+}
+
+// drainShutdownEvents receives the events left once qemu has exited, in
+// order to record the SHUTDOWN event qemu sends before exiting.
+func (q *QMP) drainShutdownEvents(ctx context.Context, l *qmpEventListener, res *ShutdownResult) {
+	// All the events have been delivered once the QMP loop has exited,
+	// which happens shortly after qemu has exited.
+	timer := time.NewTimer(shutdownDrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-q.disconnectedCh:
+	case <-timer.C:
+	}
+
+	for {
+		select {
+		case ev := <-l.ch:
+			res.update(ev)
+		default:
+			return
+		}
+	}
+}
+
+// errStageTimeout is used by shutdownStage when a stage times out.
+var errStageTimeout = errors.New("shutdown stage timed out")
+
+// update records the shutdown reason of the SHUTDOWN event ev, and returns
+// true if ev is a SHUTDOWN event.
+func (res *ShutdownResult) update(ev QMPEvent) bool {
+	if ev.Name != "SHUTDOWN" {
+		return false
+	}
+
+	res.Guest, _ = ev.Data["guest"].(bool)
+	res.Reason, _ = ev.Data["reason"].(string)
+
+	return true
+}
@@ -0,0 +1,454 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startFakeQemu starts the fake qemu binary script with StartQemu.
+func startFakeQemu(t *testing.T, script string, sockets ...QMPSocket) *Process {
+	if os.Getuid() != 0 {
+		t.Skip("StartQemu sets the credentials of qemu, which requires root")
+	}
+
+	config := Config{
+		Path:       writeFakeQemuBinary(t, script),
+		QMPSockets: sockets,
+	}
+
+	p, err := StartQemu(config, qmpTestLogger{})
+	if err != nil {
+		t.Fatalf("Unable to start qemu: %v", err)
+	}
+
+	return p
+}
+
+func TestRingBuffer(t *testing.T) {
+	r := &ringBuffer{size: 8}
+
+	_, _ = r.Write([]byte("abc"))
+	_, _ = r.Write([]byte("defgh"))
+	if s := r.String(); s != "abcdefgh" {
+		t.Errorf("Unexpected content %q", s)
+	}
+
+	_, _ = r.Write([]byte("ij"))
+	if s := r.String(); s != "cdefghij" {
+		t.Errorf("Unexpected content %q", s)
+	}
+
+	n, _ := r.Write([]byte("0123456789"))
+	if s := r.String(); n != 10 || s != "23456789" {
+		t.Errorf("Unexpected content %q after writing %d bytes", s, n)
+	}
+}
+
+// Checks that a qemu process started with StartQemu can be waited for.
+//
+// A fake qemu binary writing to stderr and exiting with status 3 is
+// started.
+//
+// Wait should return an error, and the exit code and stderr of the
+// process should be available.
+func TestStartQemuExit(t *testing.T) {
+	p := startFakeQemu(t, "#!/bin/sh\necho 'qemu: invalid option' >&2\nexit 3\n")
+
+	if p.PID() <= 0 {
+		t.Errorf("Unexpected PID %d", p.PID())
+	}
+
+	if err := p.Wait(); err == nil {
+		t.Fatalf("Expected error")
+	}
+	<-p.Done()
+
+	if code := p.ExitCode(); code != 3 {
+		t.Errorf("Unexpected exit code %d", code)
+	}
+	if s := p.Stderr(); s != "qemu: invalid option\n" {
+		t.Errorf("Unexpected stderr %q", s)
+	}
+}
+
+// Checks that a qemu process started with StartQemu can be killed.
+//
+// A fake qemu binary that does not exit is started and killed.
+//
+// The process should exit, and its exit code should be -1.
+func TestStartQemuKill(t *testing.T) {
+	p := startFakeQemu(t, "#!/bin/sh\nexec sleep 10\n")
+
+	if code := p.ExitCode(); code != -1 {
+		t.Errorf("Unexpected exit code %d of a running process", code)
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Unable to signal qemu: %v", err)
+	}
+	if err := p.Wait(); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if code := p.ExitCode(); code != -1 {
+		t.Errorf("Unexpected exit code %d", code)
+	}
+
+	p = startFakeQemu(t, "#!/bin/sh\nexec sleep 10\n")
+	if err := p.Kill(); err != nil {
+		t.Fatalf("Unable to kill qemu: %v", err)
+	}
+	_ = p.Wait()
+}
+
+// Checks that StartQemu refuses to daemonize qemu.
+//
+// StartQemu is called with the Daemonize knob.
+//
+// An error should be returned.
+func TestStartQemuDaemonize(t *testing.T) {
+	config := Config{
+		Path: "/nonexistent/qemu",
+		Knobs: Knobs{
+			Daemonize: true,
+		},
+	}
+
+	if _, err := StartQemu(config, nil); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+// Checks that ConnectQMP waits for the QMP socket.
+//
+// A fake qemu binary is started, and the QMP socket is created after a
+// delay.
+//
+// ConnectQMP should connect to the socket once it is created.
+func TestProcessConnectQMP(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "qmp.sock")
+	p := startFakeQemu(t, "#!/bin/sh\nexec sleep 10\n", QMPSocket{
+		Type:   Unix,
+		Name:   socket,
+		Server: true,
+		NoWait: true,
+	})
+	defer func() {
+		_ = p.Kill()
+		_ = p.Wait()
+	}()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			return
+		}
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}, "package": ""}, "capabilities": []}}` + "\n"))
+		buf := make([]byte, 1)
+		_, _ = conn.Read(buf)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnectedCh := make(chan struct{})
+	q, version, err := p.ConnectQMP(ctx, QMPConfig{Logger: qmpTestLogger{}}, disconnectedCh)
+	if err != nil {
+		t.Fatalf("Unable to connect to QMP: %v", err)
+	}
+	if version.Major != 6 {
+		t.Errorf("Unexpected version %v", version)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that ConnectQMP fails when qemu exits.
+//
+// A fake qemu binary exiting without creating its QMP socket is started.
+//
+// ConnectQMP should fail and report the stderr of qemu.
+func TestProcessConnectQMPExit(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "qmp.sock")
+	p := startFakeQemu(t, "#!/bin/sh\necho 'qemu: no socket' >&2\nexit 1\n", QMPSocket{
+		Type:   Unix,
+		Name:   socket,
+		Server: true,
+	})
+
+	disconnectedCh := make(chan struct{})
+	_, _, err := p.ConnectQMP(context.Background(), QMPConfig{Logger: qmpTestLogger{}}, disconnectedCh)
+	if err == nil || !strings.Contains(err.Error(), "qemu: no socket") {
+		t.Fatalf("Expected error with the qemu stderr: %v", err)
+	}
+	<-disconnectedCh
+}
+
+// Checks that StartQemuWithQMP returns a connected QMP instance.
+//
+// A fake qemu binary answering QMP commands on the socket passed as file
+// descriptor 3 is started.
+//
+// StartQemuWithQMP should return the QMP instance, on which commands can be
+// executed.
+func TestStartQemuWithQMP(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("StartQemu sets the credentials of qemu, which requires root")
+	}
+
+	script := `#!/bin/sh
+case "$*" in
+*"-chardev socket,id=govmm-qmp,fd=3 -mon chardev=govmm-qmp,mode=control"*) ;;
+*) exit 1 ;;
+esac
+echo '{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}, "package": ""}, "capabilities": []}}' >&3
+while read -r line <&3; do
+	case "$line" in
+	*qmp_capabilities*)
+		echo '{"return": {}}' >&3 ;;
+	*quit*)
+		echo '{"return": {}}' >&3
+		exit 0 ;;
+	esac
+done
+`
+	config := Config{
+		Path: writeFakeQemuBinary(t, script),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnectedCh := make(chan struct{})
+	p, q, version, err := StartQemuWithQMP(ctx, config, QMPConfig{Logger: qmpTestLogger{}}, disconnectedCh, nil)
+	if err != nil {
+		t.Fatalf("Unable to start qemu: %v", err)
+	}
+	if version.Major != 6 {
+		t.Errorf("Unexpected version %v", version)
+	}
+
+	if err = q.ExecuteQMPCapabilities(ctx); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err = q.ExecuteQuit(ctx); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err = p.Wait(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	<-disconnectedCh
+}
+
+// Checks that StartQemuWithQMP fails if qemu exits before the QMP greeting.
+//
+// A fake qemu binary exiting immediately is started.
+//
+// StartQemuWithQMP should fail and the disconnected channel be closed.
+func TestStartQemuWithQMPExit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("StartQemu sets the credentials of qemu, which requires root")
+	}
+
+	config := Config{
+		Path: writeFakeQemuBinary(t, "#!/bin/sh\necho 'qemu: failed' >&2\nexit 1\n"),
+	}
+
+	disconnectedCh := make(chan struct{})
+	_, _, _, err := StartQemuWithQMP(context.Background(), config, QMPConfig{Logger: qmpTestLogger{}}, disconnectedCh, nil)
+	if err == nil || !strings.Contains(err.Error(), "qemu: failed") {
+		t.Fatalf("Expected error with the qemu stderr: %v", err)
+	}
+	<-disconnectedCh
+}
+
+// Checks that Shutdown returns when the guest shuts down.
+//
+// We start a QMPLoop, and call Shutdown.  The guest shuts down after the
+// system_powerdown command.
+//
+// Shutdown should report the powerdown stage and the shutdown reason.
+func TestShutdownPowerdown(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("system_powerdown", nil, "return", nil)
+	buf.AddEvent("POWERDOWN", 50*time.Millisecond, nil, nil)
+	buf.AddEvent("SHUTDOWN", 10*time.Millisecond, map[string]interface{}{
+		"guest":  true,
+		"reason": "guest-shutdown",
+	}, nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	var wg sync.WaitGroup
+	buf.startEventLoop(&wg)
+
+	res, err := Shutdown(context.Background(), q, ShutdownOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := ShutdownResult{
+		Stage:  ShutdownStagePowerdown,
+		Guest:  true,
+		Reason: "guest-shutdown",
+	}
+	if res != expected {
+		t.Errorf("Expected %+v, got %+v", expected, res)
+	}
+
+	wg.Wait()
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that Shutdown fails when qemu does not exit and no process is
+// known.
+//
+// We start a QMPLoop, and call Shutdown.  Neither the guest nor qemu shut
+// down.
+//
+// Shutdown should fail after the quit stage.
+func TestShutdownNoProcess(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("system_powerdown", nil, "return", nil)
+	buf.AddCommand("quit", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	res, err := Shutdown(context.Background(), q, ShutdownOptions{
+		PowerdownTimeout: 50 * time.Millisecond,
+		QuitTimeout:      50 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if res.Stage != ShutdownStageQuit {
+		t.Errorf("Unexpected stage %s", res.Stage)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// shutdownFakeQemu starts a fake qemu binary script with StartQemuWithQMP,
+// and shuts it down with Shutdown.
+func shutdownFakeQemu(t *testing.T, script string) ShutdownResult {
+	if os.Getuid() != 0 {
+		t.Skip("StartQemu sets the credentials of qemu, which requires root")
+	}
+
+	config := Config{
+		Path: writeFakeQemuBinary(t, script),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnectedCh := make(chan struct{})
+	p, q, _, err := StartQemuWithQMP(ctx, config, QMPConfig{Logger: qmpTestLogger{}}, disconnectedCh, nil)
+	if err != nil {
+		t.Fatalf("Unable to start qemu: %v", err)
+	}
+
+	res, err := Shutdown(ctx, q, ShutdownOptions{
+		PowerdownTimeout: 100 * time.Millisecond,
+		QuitTimeout:      100 * time.Millisecond,
+		Process:          p,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_ = p.Wait()
+	q.Shutdown()
+	<-disconnectedCh
+
+	return res
+}
+
+// Checks that Shutdown sends the quit command if the guest does not shut
+// down.
+//
+// A fake qemu binary ignoring system_powerdown and exiting on quit is shut
+// down.
+//
+// Shutdown should report the quit stage and the reason of the SHUTDOWN
+// event sent by qemu.
+func TestShutdownQuit(t *testing.T) {
+	res := shutdownFakeQemu(t, `#!/bin/sh
+echo '{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}, "package": ""}, "capabilities": []}}' >&3
+while read -r line <&3; do
+	case "$line" in
+	*system_powerdown*)
+		echo '{"return": {}}' >&3 ;;
+	*quit*)
+		echo '{"return": {}}' >&3
+		echo '{"event": "SHUTDOWN", "data": {"guest": false, "reason": "host-qmp-quit"}}' >&3
+		exit 0 ;;
+	esac
+done
+`)
+
+	expected := ShutdownResult{
+		Stage:  ShutdownStageQuit,
+		Reason: "host-qmp-quit",
+	}
+	if res != expected {
+		t.Errorf("Expected %+v, got %+v", expected, res)
+	}
+}
+
+// Checks that Shutdown kills qemu if it does not quit.
+//
+// A fake qemu binary ignoring all the commands is shut down.
+//
+// Shutdown should report the kill stage.
+func TestShutdownKill(t *testing.T) {
+	res := shutdownFakeQemu(t, `#!/bin/sh
+echo '{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}, "package": ""}, "capabilities": []}}' >&3
+exec sleep 10
+`)
+
+	if res.Stage != ShutdownStageKill {
+		t.Errorf("Unexpected stage %s", res.Stage)
+	}
+}
@@ -27,7 +27,7 @@ package qemu
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
@@ -62,6 +62,27 @@ type Device interface {
 	QemuParams(config *Config) []string
 }
 
+// CheckedDevice is a Device which reports why its qemu parameters cannot
+// be built, instead of returning no parameters.  All the devices of this
+// package implement it.
+type CheckedDevice interface {
+	Device
+
+	// QemuParamsErr returns the qemu parameters of the device, or an
+	// error if they cannot be built for config.
+	QemuParamsErr(config *Config) ([]string, error)
+}
+
+// deviceQemuParams returns the qemu parameters of the device d, and the
+// error preventing them from being built if d is a CheckedDevice.
+func deviceQemuParams(d Device, config *Config) ([]string, error) {
+	if c, ok := d.(CheckedDevice); ok {
+		return c.QemuParamsErr(config)
+	}
+
+	return d.QemuParams(config), nil
+}
+
 // DeviceDriver is the device driver string.
 type DeviceDriver string
 
@@ -102,6 +123,9 @@ const (
 	// VirtioBalloon is the memory balloon device driver.
 	VirtioBalloon DeviceDriver = "virtio-balloon"
 
+	// VirtioMem is the paravirtualized memory device driver.
+	VirtioMem DeviceDriver = "virtio-mem"
+
 	//VhostUserSCSI represents a SCSI vhostuser device type.
 	VhostUserSCSI DeviceDriver = "vhost-user-scsi"
 
@@ -212,6 +236,17 @@ func (transport VirtioTransport) getName(config *Config) string {
 	return string(transport)
 }
 
+// checkDeviceName returns an error if name, the QEMU device name for the
+// current transport, is empty because the device does not support the
+// transport.
+func (transport VirtioTransport) checkDeviceName(name string, config *Config) error {
+	if name == "" {
+		return fmt.Errorf("the %s transport is not supported by the device", transport.getName(config))
+	}
+
+	return nil
+}
+
 // disableModern returns the parameters with the disable-modern option.
 // In case the device driver is not a PCI device and it doesn't have the option
 // an empty string is returned.
@@ -234,6 +269,12 @@ const (
 	// MemoryBackendFile represents a guest memory mapped file.
 	MemoryBackendFile ObjectType = "memory-backend-file"
 
+	// MemoryBackendRAM represents a guest memory backed by anonymous memory.
+	MemoryBackendRAM ObjectType = "memory-backend-ram"
+
+	// MemoryBackendMemfd represents a guest memory backed by an anonymous file.
+	MemoryBackendMemfd ObjectType = "memory-backend-memfd"
+
 	// MemoryBackendEPC represents a guest memory backend EPC for SGX.
 	MemoryBackendEPC ObjectType = "memory-backend-epc"
 
@@ -247,6 +288,35 @@ const (
 	SecExecGuest ObjectType = "s390-pv-guest"
 	// PEFGuest represent ppc64le PEF(Protected Execution Facility) object.
 	PEFGuest ObjectType = "pef-guest"
+
+	// IOThreadObject represents an IO thread.
+	IOThreadObject ObjectType = "iothread"
+
+	// ThrottleGroupObject represents a group of block devices sharing
+	// the same I/O limits.
+	ThrottleGroupObject ObjectType = "throttle-group"
+
+	// SecretObject represents a secret.
+	SecretObject ObjectType = "secret"
+
+	// TLSCredsX509 represents x509 certificate TLS credentials.
+	TLSCredsX509 ObjectType = "tls-creds-x509"
+
+	// TLSCredsPSK represents pre-shared key TLS credentials.
+	TLSCredsPSK ObjectType = "tls-creds-psk"
+
+	// TLSCredsAnon represents anonymous TLS credentials.
+	TLSCredsAnon ObjectType = "tls-creds-anon"
+
+	// RngRandom represents an entropy source reading from a host file.
+	RngRandom ObjectType = "rng-random"
+
+	// RngEgd represents an entropy source reading from an entropy
+	// gathering daemon.
+	RngEgd ObjectType = "rng-egd"
+
+	// RngBuiltin represents the qemu builtin entropy source.
+	RngBuiltin ObjectType = "rng-builtin"
 )
 
 // Object is a qemu object representation.
@@ -291,25 +361,57 @@ type Object struct {
 	Prealloc bool
 }
 
-// Valid returns true if the Object structure is valid and complete.
-func (object Object) Valid() bool {
+// validate returns an error describing why the Object structure is not
+// valid and complete, or nil if it is.
+func (object Object) validate() error {
+	if object.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
 	switch object.Type {
 	case MemoryBackendFile:
-		return object.ID != "" && object.MemPath != "" && object.Size != 0
+		if object.MemPath == "" {
+			return fmt.Errorf("MemPath is not set")
+		}
+		if object.Size == 0 {
+			return fmt.Errorf("Size is not set")
+		}
 	case MemoryBackendEPC:
-		return object.ID != "" && object.Size != 0
+		if object.Size == 0 {
+			return fmt.Errorf("Size is not set")
+		}
 	case TDXGuest:
-		return object.ID != "" && object.File != "" && object.DeviceID != ""
+		if object.File == "" {
+			return fmt.Errorf("File is not set")
+		}
+		if object.DeviceID == "" {
+			return fmt.Errorf("DeviceID is not set")
+		}
 	case SEVGuest:
-		return object.ID != "" && object.File != "" && object.CBitPos != 0 && object.ReducedPhysBits != 0
+		if object.File == "" {
+			return fmt.Errorf("File is not set")
+		}
+		if object.CBitPos == 0 {
+			return fmt.Errorf("CBitPos is not set")
+		}
+		if object.ReducedPhysBits == 0 {
+			return fmt.Errorf("ReducedPhysBits is not set")
+		}
 	case SecExecGuest:
-		return object.ID != ""
 	case PEFGuest:
-		return object.ID != "" && object.File != ""
-
+		if object.File == "" {
+			return fmt.Errorf("File is not set")
+		}
 	default:
-		return false
+		return fmt.Errorf("unsupported object type %q", object.Type)
 	}
+
+	return nil
+}
+
+// Valid returns true if the Object structure is valid and complete.
+func (object Object) Valid() bool {
+	return object.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this Object device.
@@ -321,26 +423,17 @@ func (object Object) QemuParams(config *Config) []string {
 
 	switch object.Type {
 	case MemoryBackendFile:
-		objectParams = append(objectParams, string(object.Type))
-		objectParams = append(objectParams, fmt.Sprintf("id=%s", object.ID))
-		objectParams = append(objectParams, fmt.Sprintf("mem-path=%s", object.MemPath))
-		objectParams = append(objectParams, fmt.Sprintf("size=%d", object.Size))
+		objectParams = objectPropertyParams(object.Type, object.ID, object.properties())
 
 		deviceParams = append(deviceParams, string(object.Driver))
 		deviceParams = append(deviceParams, fmt.Sprintf("id=%s", object.DeviceID))
 		deviceParams = append(deviceParams, fmt.Sprintf("memdev=%s", object.ID))
 
 		if object.ReadOnly {
-			objectParams = append(objectParams, "readonly=on")
 			deviceParams = append(deviceParams, "unarmed=on")
 		}
 	case MemoryBackendEPC:
-		objectParams = append(objectParams, string(object.Type))
-		objectParams = append(objectParams, fmt.Sprintf("id=%s", object.ID))
-		objectParams = append(objectParams, fmt.Sprintf("size=%d", object.Size))
-		if object.Prealloc {
-			objectParams = append(objectParams, "prealloc=on")
-		}
+		objectParams = objectPropertyParams(object.Type, object.ID, object.properties())
 
 	case TDXGuest:
 		objectParams = append(objectParams, string(object.Type))
@@ -390,214 +483,1044 @@ func (object Object) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
-// Virtio9PMultidev filesystem behaviour to deal
-// with multiple devices being shared with a 9p export.
-type Virtio9PMultidev string
+// QemuParamsErr returns the qemu parameters built out of this Object
+// device, or an error if they cannot be built.
+func (object Object) QemuParamsErr(config *Config) ([]string, error) {
+	return object.QemuParams(config), nil
+}
 
-const (
-	// Remap shares multiple devices with only one export.
-	Remap Virtio9PMultidev = "remap"
+// properties returns the properties of the memory backend objects.
+func (object Object) properties() []objectProperty {
+	var props []objectProperty
 
-	// Warn assumes that only one device is shared by the same export.
-	// Only a warning message is logged (once) by qemu on host side.
-	// This is the default behaviour.
-	Warn Virtio9PMultidev = "warn"
+	switch object.Type {
+	case MemoryBackendFile:
+		props = append(props, objectProperty{"mem-path", object.MemPath})
+		props = append(props, objectProperty{"size", object.Size})
+		if object.ReadOnly {
+			props = append(props, objectProperty{"readonly", true})
+		}
+	case MemoryBackendEPC:
+		props = append(props, objectProperty{"size", object.Size})
+		if object.Prealloc {
+			props = append(props, objectProperty{"prealloc", true})
+		}
+	}
 
-	// Forbid like "warn" but also deny access to additional devices on guest.
-	Forbid Virtio9PMultidev = "forbid"
-)
+	return props
+}
 
-// FSDriver represents a qemu filesystem driver.
-type FSDriver string
+// QMPArgs returns the object-add arguments built out of this Object.  Only
+// the memory backend objects can be created with object-add, and the device
+// using a MemoryBackendFile object has to be added separately.
+func (object Object) QMPArgs() (map[string]interface{}, error) {
+	switch object.Type {
+	case MemoryBackendFile, MemoryBackendEPC:
+		return objectArgs(object.Type, object.ID, object.properties()), nil
+	}
 
-// SecurityModelType is a qemu filesystem security model type.
-type SecurityModelType string
+	return nil, fmt.Errorf("%s objects cannot be created with object-add", object.Type)
+}
 
-const (
-	// Local is the local qemu filesystem driver.
-	Local FSDriver = "local"
+// MemoryBackend is a guest memory backend object. It can be passed to qemu
+// as a Device, or hotplugged with QMP through ExecuteMemoryBackendAdd, and
+// renders the same properties in both cases.
+type MemoryBackend struct {
+	// Type is the memory backend type. It can be MemoryBackendRAM,
+	// MemoryBackendFile or MemoryBackendMemfd.
+	Type ObjectType
 
-	// Handle is the handle qemu filesystem driver.
-	Handle FSDriver = "handle"
+	// ID is the user defined memory backend ID.
+	ID string
 
-	// Proxy is the proxy qemu filesystem driver.
-	Proxy FSDriver = "proxy"
-)
+	// Size is the memory backend size. It should be suffixed with K, M,
+	// G or T for sizes in kilobytes, megabytes, gigabytes or terabytes
+	// respectively, or it is a size in bytes.
+	Size string
 
-const (
-	// None is like passthrough without failure reports.
-	None SecurityModelType = "none"
+	// MemPath is the backing file path of a MemoryBackendFile backend.
+	MemPath string
 
-	// PassThrough uses the same credentials on both the host and guest.
-	PassThrough SecurityModelType = "passthrough"
+	// ReadOnly opens MemPath read-only.
+	// This is only relevant for MemoryBackendFile backends.
+	ReadOnly bool
 
-	// MappedXattr stores some files attributes as extended attributes.
-	MappedXattr SecurityModelType = "mapped-xattr"
+	// Share sets the memory as shared.
+	Share bool
 
-	// MappedFile stores some files attributes in the .virtfs directory.
-	MappedFile SecurityModelType = "mapped-file"
-)
+	// Prealloc allocates all the memory upfront.
+	Prealloc bool
 
-// FSDevice represents a qemu filesystem configuration.
-type FSDevice struct {
-	// Driver is the qemu device driver
-	Driver DeviceDriver
+	// HugeTLB backs the memory with huge pages.
+	// This is only relevant for MemoryBackendMemfd backends.
+	HugeTLB bool
 
-	// FSDriver is the filesystem driver backend.
-	FSDriver FSDriver
+	// HugeTLBSize is the huge page size in bytes.
+	// This is only relevant for MemoryBackendMemfd backends.
+	HugeTLBSize uint64
 
-	// ID is the filesystem identifier.
-	ID string
+	// DiscardData discards the memory content when qemu exits.
+	// This is only relevant for MemoryBackendFile backends.
+	DiscardData bool
 
-	// Path is the host root path for this filesystem.
-	Path string
+	// Merge enables memory merge, also known as KSM. The qemu default is
+	// used when Merge is nil.
+	Merge *bool
 
-	// MountTag is the device filesystem mount point tag.
-	MountTag string
+	// Dump includes the memory in core dumps. The qemu default is used
+	// when Dump is nil.
+	Dump *bool
 
-	// SecurityModel is the security model for this filesystem device.
-	SecurityModel SecurityModelType
+	// Seal seals the memory file. The qemu default is used when Seal is nil.
+	// This is only relevant for MemoryBackendMemfd backends.
+	Seal *bool
 
-	// DisableModern prevents qemu from relying on fast MMIO.
-	DisableModern bool
+	// HostNodes is the list of host nodes the memory is bound to.
+	HostNodes []uint32
 
-	// ROMFile specifies the ROM file being used for this device.
-	ROMFile string
+	// Policy is the host NUMA policy applied to HostNodes.
+	Policy NUMAPolicy
+}
 
-	// DevNo identifies the ccw devices for s390x architecture
-	DevNo string
+// validate returns an error describing why the MemoryBackend structure is not
+// valid and complete, or nil if it is.
+func (backend MemoryBackend) validate() error {
+	if backend.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
 
-	// Transport is the virtio transport for this device.
-	Transport VirtioTransport
+	if backend.Size == "" {
+		return fmt.Errorf("Size is not set")
+	}
 
-	// Multidev is the filesystem behaviour to deal
-	// with multiple devices being shared with a 9p export
-	Multidev Virtio9PMultidev
+	if _, err := parseMemorySize(backend.Size); err != nil {
+		return err
+	}
+
+	if backend.Policy != "" && backend.Policy != NUMAPolicyDefault && len(backend.HostNodes) == 0 {
+		return fmt.Errorf("Policy %q requires HostNodes", backend.Policy)
+	}
+
+	isFile := backend.Type == MemoryBackendFile
+	isMemfd := backend.Type == MemoryBackendMemfd
+
+	switch {
+	case backend.Type != MemoryBackendRAM && !isFile && !isMemfd:
+		return fmt.Errorf("unsupported memory backend type %q", backend.Type)
+	case isFile && backend.MemPath == "":
+		return fmt.Errorf("MemPath is not set")
+	case !isFile && (backend.ReadOnly || backend.DiscardData):
+		return fmt.Errorf("ReadOnly and DiscardData are only supported by %s", MemoryBackendFile)
+	case !isMemfd && (backend.HugeTLB || backend.HugeTLBSize != 0 || backend.Seal != nil):
+		return fmt.Errorf("HugeTLB, HugeTLBSize and Seal are only supported by %s", MemoryBackendMemfd)
+	}
+
+	return nil
 }
 
-// Virtio9PTransport is a map of the virtio-9p device name that corresponds
-// to each transport.
-var Virtio9PTransport = map[VirtioTransport]string{
-	TransportPCI:  "virtio-9p-pci",
-	TransportCCW:  "virtio-9p-ccw",
-	TransportMMIO: "virtio-9p-device",
+// Valid returns true if the MemoryBackend structure is valid and complete.
+func (backend MemoryBackend) Valid() bool {
+	return backend.validate() == nil
 }
 
-// Valid returns true if the FSDevice structure is valid and complete.
-func (fsdev FSDevice) Valid() bool {
-	if fsdev.ID == "" || fsdev.Path == "" || fsdev.MountTag == "" {
-		return false
+// hostNodesRanges returns the list of host nodes as ranges of contiguous
+// nodes, e.g. "0-1".
+func hostNodesRanges(nodes []uint32) []string {
+	var ranges []string
+
+	for i := 0; i < len(nodes); {
+		j := i
+		for j+1 < len(nodes) && nodes[j+1] == nodes[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", nodes[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", nodes[i], nodes[j]))
+		}
+		i = j + 1
 	}
 
-	return true
+	return ranges
 }
 
-// QemuParams returns the qemu parameters built out of this filesystem device.
-func (fsdev FSDevice) QemuParams(config *Config) []string {
-	var fsParams []string
-	var deviceParams []string
-	var qemuParams []string
-
-	deviceParams = append(deviceParams, fsdev.deviceName(config))
-	if s := fsdev.Transport.disableModern(config, fsdev.DisableModern); s != "" {
-		deviceParams = append(deviceParams, s)
+// properties returns the -object properties of the memory backend.  The
+// host nodes are given as ranges of contiguous nodes, one property per
+// range.
+func (backend MemoryBackend) properties() []objectProperty {
+	props := []objectProperty{
+		{"size", backend.Size},
 	}
-	deviceParams = append(deviceParams, fmt.Sprintf("fsdev=%s", fsdev.ID))
-	deviceParams = append(deviceParams, fmt.Sprintf("mount_tag=%s", fsdev.MountTag))
-	if fsdev.Transport.isVirtioPCI(config) && fsdev.ROMFile != "" {
-		deviceParams = append(deviceParams, fmt.Sprintf("romfile=%s", fsdev.ROMFile))
+
+	if backend.MemPath != "" {
+		props = append(props, objectProperty{"mem-path", backend.MemPath})
 	}
-	if fsdev.Transport.isVirtioCCW(config) {
-		if config.Knobs.IOMMUPlatform {
-			deviceParams = append(deviceParams, ",iommu_platform=on")
+
+	for _, p := range []objectProperty{
+		{"readonly", backend.ReadOnly},
+		{"share", backend.Share},
+		{"prealloc", backend.Prealloc},
+		{"hugetlb", backend.HugeTLB},
+	} {
+		if p.value.(bool) {
+			props = append(props, p)
 		}
-		deviceParams = append(deviceParams, fmt.Sprintf("devno=%s", fsdev.DevNo))
+	}
+	if backend.HugeTLBSize != 0 {
+		props = append(props, objectProperty{"hugetlbsize", backend.HugeTLBSize})
+	}
+	if backend.DiscardData {
+		props = append(props, objectProperty{"discard-data", true})
 	}
 
-	fsParams = append(fsParams, string(fsdev.FSDriver))
-	fsParams = append(fsParams, fmt.Sprintf("id=%s", fsdev.ID))
-	fsParams = append(fsParams, fmt.Sprintf("path=%s", fsdev.Path))
-	fsParams = append(fsParams, fmt.Sprintf("security_model=%s", fsdev.SecurityModel))
+	for _, p := range []struct {
+		name  string
+		value *bool
+	}{
+		{"merge", backend.Merge},
+		{"dump", backend.Dump},
+		{"seal", backend.Seal},
+	} {
+		if p.value != nil {
+			props = append(props, objectProperty{p.name, *p.value})
+		}
+	}
 
-	if fsdev.Multidev != "" {
-		fsParams = append(fsParams, fmt.Sprintf("multidevs=%s", fsdev.Multidev))
+	for _, r := range hostNodesRanges(backend.HostNodes) {
+		props = append(props, objectProperty{"host-nodes", r})
+	}
+	if backend.Policy != "" {
+		props = append(props, objectProperty{"policy", string(backend.Policy)})
 	}
 
-	qemuParams = append(qemuParams, "-device")
-	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
+	return props
+}
 
-	qemuParams = append(qemuParams, "-fsdev")
-	qemuParams = append(qemuParams, strings.Join(fsParams, ","))
+// QemuParams returns the qemu parameters built out of this MemoryBackend object.
+func (backend MemoryBackend) QemuParams(config *Config) []string {
+	return objectQemuParams(backend.Type, backend.ID, backend.properties())
+}
 
-	return qemuParams
+// QemuParamsErr returns the qemu parameters built out of this MemoryBackend
+// object, or an error if they cannot be built.
+func (backend MemoryBackend) QemuParamsErr(config *Config) ([]string, error) {
+	return backend.QemuParams(config), nil
 }
 
-// deviceName returns the QEMU shared filesystem device name for the current
-// combination of driver and transport.
-func (fsdev FSDevice) deviceName(config *Config) string {
-	if fsdev.Transport == "" {
-		fsdev.Transport = fsdev.Transport.defaultTransport(config)
+// QMPArgs returns the object-add arguments built out of this MemoryBackend
+// object.
+func (backend MemoryBackend) QMPArgs() (map[string]interface{}, error) {
+	size, err := parseMemorySize(backend.Size)
+	if err != nil {
+		return nil, err
 	}
 
-	switch fsdev.Driver {
-	case Virtio9P:
-		return Virtio9PTransport[fsdev.Transport]
+	args := map[string]interface{}{
+		"qom-type": string(backend.Type),
+		"id":       backend.ID,
+		"size":     size,
 	}
 
-	return string(fsdev.Driver)
-}
+	if backend.MemPath != "" {
+		args["mem-path"] = backend.MemPath
+	}
 
-// CharDeviceBackend is the character device backend for qemu
-type CharDeviceBackend string
+	for name, value := range map[string]bool{
+		"readonly":     backend.ReadOnly,
+		"share":        backend.Share,
+		"prealloc":     backend.Prealloc,
+		"hugetlb":      backend.HugeTLB,
+		"discard-data": backend.DiscardData,
+	} {
+		if value {
+			args[name] = true
+		}
+	}
 
-const (
-	// Pipe creates a 2 way connection to the guest.
-	Pipe CharDeviceBackend = "pipe"
+	if backend.HugeTLBSize != 0 {
+		args["hugetlbsize"] = backend.HugeTLBSize
+	}
 
-	// Socket creates a 2 way stream socket (TCP or Unix).
-	Socket CharDeviceBackend = "socket"
+	for name, value := range map[string]*bool{
+		"merge": backend.Merge,
+		"dump":  backend.Dump,
+		"seal":  backend.Seal,
+	} {
+		if value != nil {
+			args[name] = *value
+		}
+	}
 
-	// CharConsole sends traffic from the guest to QEMU's standard output.
-	CharConsole CharDeviceBackend = "console"
+	if len(backend.HostNodes) > 0 {
+		args["host-nodes"] = backend.HostNodes
+	}
+	if backend.Policy != "" {
+		args["policy"] = string(backend.Policy)
+	}
 
-	// Serial sends traffic from the guest to a serial device on the host.
-	Serial CharDeviceBackend = "serial"
+	return args, nil
+}
 
-	// TTY is an alias for Serial.
-	TTY CharDeviceBackend = "tty"
+// parseMemorySize returns the size in bytes of a memory size suffixed with
+// K, M, G or T, or of a size in bytes.
+func parseMemorySize(size string) (uint64, error) {
+	shifts := map[byte]uint{'K': 10, 'M': 20, 'G': 30, 'T': 40}
 
-	// PTY creates a new pseudo-terminal on the host and connect to it.
-	PTY CharDeviceBackend = "pty"
+	s := strings.ToUpper(size)
+	var shift uint
+	if s != "" {
+		if sh, ok := shifts[s[len(s)-1]]; ok {
+			shift = sh
+			s = s[:len(s)-1]
+		}
+	}
 
-	// File sends traffic from the guest to a file on the host.
-	File CharDeviceBackend = "file"
-)
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q", size)
+	}
 
-// CharDevice represents a qemu character device.
-type CharDevice struct {
-	Backend CharDeviceBackend
+	if n > (^uint64(0))>>shift {
+		return 0, fmt.Errorf("memory size %q is too large", size)
+	}
 
-	// Driver is the qemu device driver
-	Driver DeviceDriver
+	return n << shift, nil
+}
 
-	// Bus is the serial bus associated to this device.
-	Bus string
+// ObjectSpec is a qemu object that can be created at boot time, as a Device
+// rendering an -object argument, or at runtime with ExecuteObjectAdd.  Both
+// forms set the same object properties.
+type ObjectSpec interface {
+	Device
 
-	// DeviceID is the user defined device ID.
-	DeviceID string
+	// QMPArgs returns the object-add arguments of the object.
+	QMPArgs() (map[string]interface{}, error)
+}
 
-	ID   string
-	Path string
-	Name string
+// objectProperty is a property of a qemu object.
+type objectProperty struct {
+	name  string
+	value interface{}
+}
 
-	// DisableModern prevents qemu from relying on fast MMIO.
-	DisableModern bool
+// objectPropertyParams returns the -object parameters of the object id of type
+// objectType, with the properties props.
+func objectPropertyParams(objectType ObjectType, id string, props []objectProperty) []string {
+	var params []string
 
-	// ROMFile specifies the ROM file being used for this device.
-	ROMFile string
+	params = append(params, string(objectType))
+	params = append(params, fmt.Sprintf("id=%s", id))
 
-	// DevNo identifies the ccw devices for s390x architecture
-	DevNo string
+	for _, p := range props {
+		switch v := p.value.(type) {
+		case bool:
+			if v {
+				params = append(params, fmt.Sprintf("%s=on", p.name))
+			} else {
+				params = append(params, fmt.Sprintf("%s=off", p.name))
+			}
+		case string:
+			params = append(params, fmt.Sprintf("%s=%s", p.name, strings.ReplaceAll(v, ",", ",,")))
+		default:
+			params = append(params, fmt.Sprintf("%s=%v", p.name, v))
+		}
+	}
+
+	return params
+}
+
+// objectQemuParams returns the -object qemu parameters of the object id of
+// type objectType, with the properties props.
+func objectQemuParams(objectType ObjectType, id string, props []objectProperty) []string {
+	var qemuParams []string
+
+	qemuParams = append(qemuParams, "-object")
+	qemuParams = append(qemuParams, strings.Join(objectPropertyParams(objectType, id, props), ","))
+
+	return qemuParams
+}
+
+// objectArgs returns the object-add arguments of the object id of type
+// objectType, with the properties props.
+func objectArgs(objectType ObjectType, id string, props []objectProperty) map[string]interface{} {
+	args := map[string]interface{}{
+		"qom-type": string(objectType),
+		"id":       id,
+	}
+
+	for _, p := range props {
+		args[p.name] = p.value
+	}
+
+	return args
+}
+
+func (t IOThread) properties() []objectProperty {
+	var props []objectProperty
+
+	if t.PollMaxNs != nil {
+		props = append(props, objectProperty{"poll-max-ns", *t.PollMaxNs})
+	}
+	if t.PollGrow != 0 {
+		props = append(props, objectProperty{"poll-grow", t.PollGrow})
+	}
+	if t.PollShrink != 0 {
+		props = append(props, objectProperty{"poll-shrink", t.PollShrink})
+	}
+
+	return props
+}
+
+// validate returns an error describing why the IOThread structure is not
+// valid and complete, or nil if it is.
+func (t IOThread) validate() error {
+	if t.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the IOThread structure is valid and complete.
+func (t IOThread) Valid() bool {
+	return t.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this IOThread object.
+func (t IOThread) QemuParams(config *Config) []string {
+	return objectQemuParams(IOThreadObject, t.ID, t.properties())
+}
+
+// QemuParamsErr returns the qemu parameters built out of this IOThread
+// object, or an error if they cannot be built.
+func (t IOThread) QemuParamsErr(config *Config) ([]string, error) {
+	return t.QemuParams(config), nil
+}
+
+// QMPArgs returns the object-add arguments built out of this IOThread object.
+func (t IOThread) QMPArgs() (map[string]interface{}, error) {
+	return objectArgs(IOThreadObject, t.ID, t.properties()), nil
+}
+
+// ThrottleGroup is a group of block devices sharing the same I/O limits.
+type ThrottleGroup struct {
+	// ID is the throttle group ID.
+	ID string
+
+	// IOPSTotal is the total number of I/O operations per second.
+	IOPSTotal uint64
+
+	// IOPSRead is the number of read operations per second.
+	IOPSRead uint64
+
+	// IOPSWrite is the number of write operations per second.
+	IOPSWrite uint64
+
+	// BPSTotal is the total number of bytes per second.
+	BPSTotal uint64
+
+	// BPSRead is the number of bytes read per second.
+	BPSRead uint64
+
+	// BPSWrite is the number of bytes written per second.
+	BPSWrite uint64
+}
+
+// limits returns the members of the limits property of the throttle group.
+func (g ThrottleGroup) limits() []objectProperty {
+	var limits []objectProperty
+
+	for _, l := range []objectProperty{
+		{"iops-total", g.IOPSTotal},
+		{"iops-read", g.IOPSRead},
+		{"iops-write", g.IOPSWrite},
+		{"bps-total", g.BPSTotal},
+		{"bps-read", g.BPSRead},
+		{"bps-write", g.BPSWrite},
+	} {
+		if l.value.(uint64) != 0 {
+			limits = append(limits, l)
+		}
+	}
+
+	return limits
+}
+
+// validate returns an error describing why the ThrottleGroup structure is not
+// valid and complete, or nil if it is.
+func (g ThrottleGroup) validate() error {
+	if g.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the ThrottleGroup structure is valid and complete.
+func (g ThrottleGroup) Valid() bool {
+	return g.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this ThrottleGroup
+// object.
+func (g ThrottleGroup) QemuParams(config *Config) []string {
+	var props []objectProperty
+
+	for _, l := range g.limits() {
+		props = append(props, objectProperty{"limits." + l.name, l.value})
+	}
+
+	return objectQemuParams(ThrottleGroupObject, g.ID, props)
+}
+
+// QemuParamsErr returns the qemu parameters built out of this ThrottleGroup
+// object, or an error if they cannot be built.
+func (g ThrottleGroup) QemuParamsErr(config *Config) ([]string, error) {
+	return g.QemuParams(config), nil
+}
+
+// QMPArgs returns the object-add arguments built out of this ThrottleGroup
+// object.
+func (g ThrottleGroup) QMPArgs() (map[string]interface{}, error) {
+	var props []objectProperty
+
+	if limits := g.limits(); len(limits) > 0 {
+		members := make(map[string]interface{})
+		for _, l := range limits {
+			members[l.name] = l.value
+		}
+		props = append(props, objectProperty{"limits", members})
+	}
+
+	return objectArgs(ThrottleGroupObject, g.ID, props), nil
+}
+
+// SecretFormat is the format of the data of a secret.
+type SecretFormat string
+
+const (
+	// SecretFormatRaw is raw secret data.
+	SecretFormatRaw SecretFormat = "raw"
+
+	// SecretFormatBase64 is base64 encoded secret data.
+	SecretFormatBase64 SecretFormat = "base64"
+)
+
+// Secret is a secret, such as a password or a key, used by other objects
+// or devices.
+type Secret struct {
+	// ID is the secret ID.
+	ID string
+
+	// Data is the secret data. Data and File are mutually exclusive.
+	Data string
+
+	// File is the path of the file containing the secret data.
+	File string
+
+	// Format is the format of the secret data.
+	Format SecretFormat
+
+	// KeyID is the ID of the secret used to decrypt the secret data.
+	KeyID string
+
+	// IV is the base64 encoded initialization vector used to decrypt the
+	// secret data.
+	IV string
+}
+
+func (s Secret) properties() []objectProperty {
+	var props []objectProperty
+
+	for _, p := range []objectProperty{
+		{"data", s.Data},
+		{"file", s.File},
+		{"format", string(s.Format)},
+		{"keyid", s.KeyID},
+		{"iv", s.IV},
+	} {
+		if p.value.(string) != "" {
+			props = append(props, p)
+		}
+	}
+
+	return props
+}
+
+// validate returns an error describing why the Secret structure is not
+// valid and complete, or nil if it is.
+func (s Secret) validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if s.Data == "" && s.File == "" {
+		return fmt.Errorf("one of Data or File must be set")
+	}
+
+	if s.Data != "" && s.File != "" {
+		return fmt.Errorf("Data and File are mutually exclusive")
+	}
+
+	return nil
+}
+
+// Valid returns true if the Secret structure is valid and complete.
+func (s Secret) Valid() bool {
+	return s.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this Secret object.
+func (s Secret) QemuParams(config *Config) []string {
+	return objectQemuParams(SecretObject, s.ID, s.properties())
+}
+
+// QemuParamsErr returns the qemu parameters built out of this Secret
+// object, or an error if they cannot be built.
+func (s Secret) QemuParamsErr(config *Config) ([]string, error) {
+	return s.QemuParams(config), nil
+}
+
+// QMPArgs returns the object-add arguments built out of this Secret object.
+func (s Secret) QMPArgs() (map[string]interface{}, error) {
+	return objectArgs(SecretObject, s.ID, s.properties()), nil
+}
+
+// TLSEndpoint is the endpoint of a TLS connection.
+type TLSEndpoint string
+
+const (
+	// TLSEndpointClient is the client endpoint of a TLS connection.
+	TLSEndpointClient TLSEndpoint = "client"
+
+	// TLSEndpointServer is the server endpoint of a TLS connection.
+	TLSEndpointServer TLSEndpoint = "server"
+)
+
+// TLSCreds are the credentials used by a TLS connection.
+type TLSCreds struct {
+	// Type is the credentials type. It can be TLSCredsX509, TLSCredsPSK
+	// or TLSCredsAnon.
+	Type ObjectType
+
+	// ID is the credentials ID.
+	ID string
+
+	// Dir is the directory containing the credentials files.
+	Dir string
+
+	// Endpoint is the endpoint of the connection using the credentials.
+	Endpoint TLSEndpoint
+
+	// VerifyPeer requires the peer to present valid credentials. The qemu
+	// default is used when VerifyPeer is nil.
+	VerifyPeer *bool
+
+	// Username is the username of the pre-shared key.
+	// This is only relevant for TLSCredsPSK credentials.
+	Username string
+
+	// PasswordID is the ID of the secret decrypting the private key.
+	// This is only relevant for TLSCredsX509 credentials.
+	PasswordID string
+}
+
+func (c TLSCreds) properties() []objectProperty {
+	var props []objectProperty
+
+	if c.Dir != "" {
+		props = append(props, objectProperty{"dir", c.Dir})
+	}
+	if c.Endpoint != "" {
+		props = append(props, objectProperty{"endpoint", string(c.Endpoint)})
+	}
+	if c.VerifyPeer != nil {
+		props = append(props, objectProperty{"verify-peer", *c.VerifyPeer})
+	}
+	if c.Username != "" {
+		props = append(props, objectProperty{"username", c.Username})
+	}
+	if c.PasswordID != "" {
+		props = append(props, objectProperty{"passwordid", c.PasswordID})
+	}
+
+	return props
+}
+
+// validate returns an error describing why the TLSCreds structure is not
+// valid and complete, or nil if it is.
+func (c TLSCreds) validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if c.Endpoint != "" && c.Endpoint != TLSEndpointClient && c.Endpoint != TLSEndpointServer {
+		return fmt.Errorf("unsupported endpoint %q", c.Endpoint)
+	}
+
+	switch c.Type {
+	case TLSCredsX509:
+		if c.Dir == "" {
+			return fmt.Errorf("Dir is not set")
+		}
+		if c.Username != "" {
+			return fmt.Errorf("Username is only supported by %s", TLSCredsPSK)
+		}
+	case TLSCredsPSK:
+		if c.Dir == "" {
+			return fmt.Errorf("Dir is not set")
+		}
+		if c.PasswordID != "" {
+			return fmt.Errorf("PasswordID is only supported by %s", TLSCredsX509)
+		}
+	case TLSCredsAnon:
+		if c.Username != "" || c.PasswordID != "" {
+			return fmt.Errorf("Username and PasswordID are not supported by %s", TLSCredsAnon)
+		}
+	default:
+		return fmt.Errorf("unsupported TLS credentials type %q", c.Type)
+	}
+
+	return nil
+}
+
+// Valid returns true if the TLSCreds structure is valid and complete.
+func (c TLSCreds) Valid() bool {
+	return c.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this TLSCreds object.
+func (c TLSCreds) QemuParams(config *Config) []string {
+	return objectQemuParams(c.Type, c.ID, c.properties())
+}
+
+// QemuParamsErr returns the qemu parameters built out of this TLSCreds
+// object, or an error if they cannot be built.
+func (c TLSCreds) QemuParamsErr(config *Config) ([]string, error) {
+	return c.QemuParams(config), nil
+}
+
+// QMPArgs returns the object-add arguments built out of this TLSCreds object.
+func (c TLSCreds) QMPArgs() (map[string]interface{}, error) {
+	return objectArgs(c.Type, c.ID, c.properties()), nil
+}
+
+// RngBackend is an entropy source backing a virtio-rng device.
+type RngBackend struct {
+	// Type is the backend type. It can be RngRandom, RngEgd or RngBuiltin.
+	Type ObjectType
+
+	// ID is the backend ID.
+	ID string
+
+	// Filename is the host entropy source.
+	// This is only relevant for RngRandom backends.
+	Filename string
+
+	// Chardev is the ID of the character device connected to the entropy
+	// gathering daemon.
+	// This is only relevant for RngEgd backends.
+	Chardev string
+}
+
+func (r RngBackend) properties() []objectProperty {
+	var props []objectProperty
+
+	if r.Filename != "" {
+		props = append(props, objectProperty{"filename", r.Filename})
+	}
+	if r.Chardev != "" {
+		props = append(props, objectProperty{"chardev", r.Chardev})
+	}
+
+	return props
+}
+
+// validate returns an error describing why the RngBackend structure is not
+// valid and complete, or nil if it is.
+func (r RngBackend) validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	switch r.Type {
+	case RngRandom:
+		if r.Chardev != "" {
+			return fmt.Errorf("Chardev is only supported by %s", RngEgd)
+		}
+	case RngEgd:
+		if r.Chardev == "" {
+			return fmt.Errorf("Chardev is not set")
+		}
+		if r.Filename != "" {
+			return fmt.Errorf("Filename is only supported by %s", RngRandom)
+		}
+	case RngBuiltin:
+		if r.Chardev != "" || r.Filename != "" {
+			return fmt.Errorf("Chardev and Filename are not supported by %s", RngBuiltin)
+		}
+	default:
+		return fmt.Errorf("unsupported rng backend type %q", r.Type)
+	}
+
+	return nil
+}
+
+// Valid returns true if the RngBackend structure is valid and complete.
+func (r RngBackend) Valid() bool {
+	return r.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this RngBackend object.
+func (r RngBackend) QemuParams(config *Config) []string {
+	return objectQemuParams(r.Type, r.ID, r.properties())
+}
+
+// QemuParamsErr returns the qemu parameters built out of this RngBackend
+// object, or an error if they cannot be built.
+func (r RngBackend) QemuParamsErr(config *Config) ([]string, error) {
+	return r.QemuParams(config), nil
+}
+
+// QMPArgs returns the object-add arguments built out of this RngBackend
+// object.
+func (r RngBackend) QMPArgs() (map[string]interface{}, error) {
+	return objectArgs(r.Type, r.ID, r.properties()), nil
+}
+
+// Virtio9PMultidev filesystem behaviour to deal
+// with multiple devices being shared with a 9p export.
+type Virtio9PMultidev string
+
+const (
+	// Remap shares multiple devices with only one export.
+	Remap Virtio9PMultidev = "remap"
+
+	// Warn assumes that only one device is shared by the same export.
+	// Only a warning message is logged (once) by qemu on host side.
+	// This is the default behaviour.
+	Warn Virtio9PMultidev = "warn"
+
+	// Forbid like "warn" but also deny access to additional devices on guest.
+	Forbid Virtio9PMultidev = "forbid"
+)
+
+// FSDriver represents a qemu filesystem driver.
+type FSDriver string
+
+// SecurityModelType is a qemu filesystem security model type.
+type SecurityModelType string
+
+const (
+	// Local is the local qemu filesystem driver.
+	Local FSDriver = "local"
+
+	// Handle is the handle qemu filesystem driver.
+	Handle FSDriver = "handle"
+
+	// Proxy is the proxy qemu filesystem driver.
+	Proxy FSDriver = "proxy"
+)
+
+const (
+	// None is like passthrough without failure reports.
+	None SecurityModelType = "none"
+
+	// PassThrough uses the same credentials on both the host and guest.
+	PassThrough SecurityModelType = "passthrough"
+
+	// MappedXattr stores some files attributes as extended attributes.
+	MappedXattr SecurityModelType = "mapped-xattr"
+
+	// MappedFile stores some files attributes in the .virtfs directory.
+	MappedFile SecurityModelType = "mapped-file"
+)
+
+// FSDevice represents a qemu filesystem configuration.
+type FSDevice struct {
+	// Driver is the qemu device driver
+	Driver DeviceDriver
+
+	// FSDriver is the filesystem driver backend.
+	FSDriver FSDriver
+
+	// ID is the filesystem identifier.
+	ID string
+
+	// Path is the host root path for this filesystem.
+	Path string
+
+	// MountTag is the device filesystem mount point tag.
+	MountTag string
+
+	// SecurityModel is the security model for this filesystem device.
+	SecurityModel SecurityModelType
+
+	// DisableModern prevents qemu from relying on fast MMIO.
+	DisableModern bool
+
+	// ROMFile specifies the ROM file being used for this device.
+	ROMFile string
+
+	// DevNo identifies the ccw devices for s390x architecture
+	DevNo string
+
+	// Transport is the virtio transport for this device.
+	Transport VirtioTransport
+
+	// Multidev is the filesystem behaviour to deal
+	// with multiple devices being shared with a 9p export
+	Multidev Virtio9PMultidev
+}
+
+// Virtio9PTransport is a map of the virtio-9p device name that corresponds
+// to each transport.
+var Virtio9PTransport = map[VirtioTransport]string{
+	TransportPCI:  "virtio-9p-pci",
+	TransportCCW:  "virtio-9p-ccw",
+	TransportMMIO: "virtio-9p-device",
+}
+
+// validate returns an error describing why the FSDevice structure is not
+// valid and complete, or nil if it is.
+func (fsdev FSDevice) validate() error {
+	if fsdev.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if fsdev.Path == "" {
+		return fmt.Errorf("Path is not set")
+	}
+
+	if fsdev.MountTag == "" {
+		return fmt.Errorf("MountTag is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the FSDevice structure is valid and complete.
+func (fsdev FSDevice) Valid() bool {
+	return fsdev.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this filesystem device.
+func (fsdev FSDevice) QemuParams(config *Config) []string {
+	var fsParams []string
+	var deviceParams []string
+	var qemuParams []string
+
+	deviceParams = append(deviceParams, fsdev.deviceName(config))
+	if s := fsdev.Transport.disableModern(config, fsdev.DisableModern); s != "" {
+		deviceParams = append(deviceParams, s)
+	}
+	deviceParams = append(deviceParams, fmt.Sprintf("fsdev=%s", fsdev.ID))
+	deviceParams = append(deviceParams, fmt.Sprintf("mount_tag=%s", fsdev.MountTag))
+	if fsdev.Transport.isVirtioPCI(config) && fsdev.ROMFile != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("romfile=%s", fsdev.ROMFile))
+	}
+	if fsdev.Transport.isVirtioCCW(config) {
+		if config.Knobs.IOMMUPlatform {
+			deviceParams = append(deviceParams, ",iommu_platform=on")
+		}
+		deviceParams = append(deviceParams, fmt.Sprintf("devno=%s", fsdev.DevNo))
+	}
+
+	fsParams = append(fsParams, string(fsdev.FSDriver))
+	fsParams = append(fsParams, fmt.Sprintf("id=%s", fsdev.ID))
+	fsParams = append(fsParams, fmt.Sprintf("path=%s", fsdev.Path))
+	fsParams = append(fsParams, fmt.Sprintf("security_model=%s", fsdev.SecurityModel))
+
+	if fsdev.Multidev != "" {
+		fsParams = append(fsParams, fmt.Sprintf("multidevs=%s", fsdev.Multidev))
+	}
+
+	qemuParams = append(qemuParams, "-device")
+	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
+
+	qemuParams = append(qemuParams, "-fsdev")
+	qemuParams = append(qemuParams, strings.Join(fsParams, ","))
+
+	return qemuParams
+}
+
+// QemuParamsErr returns the qemu parameters built out of this filesystem
+// device, or an error if they cannot be built.
+func (fsdev FSDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := fsdev.Transport.checkDeviceName(fsdev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return fsdev.QemuParams(config), nil
+}
+
+// deviceName returns the QEMU shared filesystem device name for the current
+// combination of driver and transport.
+func (fsdev FSDevice) deviceName(config *Config) string {
+	if fsdev.Transport == "" {
+		fsdev.Transport = fsdev.Transport.defaultTransport(config)
+	}
+
+	switch fsdev.Driver {
+	case Virtio9P:
+		return Virtio9PTransport[fsdev.Transport]
+	}
+
+	return string(fsdev.Driver)
+}
+
+// CharDeviceBackend is the character device backend for qemu
+type CharDeviceBackend string
+
+const (
+	// Pipe creates a 2 way connection to the guest.
+	Pipe CharDeviceBackend = "pipe"
+
+	// Socket creates a 2 way stream socket (TCP or Unix).
+	Socket CharDeviceBackend = "socket"
+
+	// CharConsole sends traffic from the guest to QEMU's standard output.
+	CharConsole CharDeviceBackend = "console"
+
+	// Serial sends traffic from the guest to a serial device on the host.
+	Serial CharDeviceBackend = "serial"
+
+	// TTY is an alias for Serial.
+	TTY CharDeviceBackend = "tty"
+
+	// PTY creates a new pseudo-terminal on the host and connect to it.
+	PTY CharDeviceBackend = "pty"
+
+	// File sends traffic from the guest to a file on the host.
+	File CharDeviceBackend = "file"
+)
+
+// CharDevice represents a qemu character device.
+type CharDevice struct {
+	Backend CharDeviceBackend
+
+	// Driver is the qemu device driver
+	Driver DeviceDriver
+
+	// Bus is the serial bus associated to this device.
+	Bus string
+
+	// DeviceID is the user defined device ID.
+	DeviceID string
+
+	ID   string
+	Path string
+	Name string
+
+	// DisableModern prevents qemu from relying on fast MMIO.
+	DisableModern bool
+
+	// ROMFile specifies the ROM file being used for this device.
+	ROMFile string
+
+	// DevNo identifies the ccw devices for s390x architecture
+	DevNo string
 
 	// Transport is the virtio transport for this device.
 	Transport VirtioTransport
@@ -611,13 +1534,23 @@ var VirtioSerialTransport = map[VirtioTransport]string{
 	TransportMMIO: "virtio-serial-device",
 }
 
-// Valid returns true if the CharDevice structure is valid and complete.
-func (cdev CharDevice) Valid() bool {
-	if cdev.ID == "" || cdev.Path == "" {
-		return false
+// validate returns an error describing why the CharDevice structure is not
+// valid and complete, or nil if it is.
+func (cdev CharDevice) validate() error {
+	if cdev.ID == "" {
+		return fmt.Errorf("ID is not set")
 	}
 
-	return true
+	if cdev.Path == "" {
+		return fmt.Errorf("Path is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the CharDevice structure is valid and complete.
+func (cdev CharDevice) Valid() bool {
+	return cdev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this character device.
@@ -671,6 +1604,16 @@ func (cdev CharDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this character
+// device, or an error if they cannot be built.
+func (cdev CharDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := cdev.Transport.checkDeviceName(cdev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return cdev.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (cdev CharDevice) deviceName(config *Config) string {
@@ -709,43 +1652,78 @@ const (
 	VHOSTUSER NetDeviceType = "vhostuser"
 )
 
-// QemuNetdevParam converts to the QEMU -netdev parameter notation
+// checkTransport returns an error if the network device type cannot be used
+// with the transport.
+func (n NetDeviceType) checkTransport(transport VirtioTransport) error {
+	switch {
+	case n == VFIO && transport == TransportMMIO:
+		return fmt.Errorf("vfio devices are not supported with the MMIO transport")
+	case n == VHOSTUSER && transport == TransportCCW:
+		return fmt.Errorf("vhost-user devices are not supported on IBM Z")
+	}
+
+	return nil
+}
+
+// QemuNetdevParam converts to the QEMU -netdev parameter notation.  An empty
+// string is returned if the device type cannot be used with the transport
+// of netdev.
 func (n NetDeviceType) QemuNetdevParam(netdev *NetDevice, config *Config) string {
+	param, _ := n.QemuNetdevParamErr(netdev, config)
+	return param
+}
+
+// QemuNetdevParamErr converts to the QEMU -netdev parameter notation, or
+// returns an error if the device type cannot be used with the transport of
+// netdev.
+func (n NetDeviceType) QemuNetdevParamErr(netdev *NetDevice, config *Config) (string, error) {
 	if netdev.Transport == "" {
 		netdev.Transport = netdev.Transport.defaultTransport(config)
 	}
 
+	if err := n.checkTransport(netdev.Transport); err != nil {
+		return "", err
+	}
+
 	switch n {
 	case TAP:
-		return "tap"
+		return "tap", nil
 	case MACVTAP:
-		return "tap"
+		return "tap", nil
 	case IPVTAP:
-		return "tap"
+		return "tap", nil
 	case VETHTAP:
-		return "tap" // -netdev type=tap -device virtio-net-pci
+		return "tap", nil // -netdev type=tap -device virtio-net-pci
 	case VFIO:
-		if netdev.Transport == TransportMMIO {
-			log.Fatal("vfio devices are not support with the MMIO transport")
-		}
-		return "" // -device vfio-pci (no netdev)
+		return "", nil // -device vfio-pci (no netdev)
 	case VHOSTUSER:
-		if netdev.Transport == TransportCCW {
-			log.Fatal("vhost-user devices are not supported on IBM Z")
-		}
-		return "vhost-user" // -netdev type=vhost-user (no device)
+		return "vhost-user", nil // -netdev type=vhost-user (no device)
 	default:
-		return ""
+		return "", nil
 
 	}
 }
 
-// QemuDeviceParam converts to the QEMU -device parameter notation
+// QemuDeviceParam converts to the QEMU -device parameter notation.  An empty
+// string is returned if the device type cannot be used with the transport
+// of netdev.
 func (n NetDeviceType) QemuDeviceParam(netdev *NetDevice, config *Config) DeviceDriver {
+	driver, _ := n.QemuDeviceParamErr(netdev, config)
+	return driver
+}
+
+// QemuDeviceParamErr converts to the QEMU -device parameter notation, or
+// returns an error if the device type cannot be used with the transport of
+// netdev.
+func (n NetDeviceType) QemuDeviceParamErr(netdev *NetDevice, config *Config) (DeviceDriver, error) {
 	if netdev.Transport == "" {
 		netdev.Transport = netdev.Transport.defaultTransport(config)
 	}
 
+	if err := n.checkTransport(netdev.Transport); err != nil {
+		return "", err
+	}
+
 	var device string
 
 	switch n {
@@ -758,28 +1736,22 @@ func (n NetDeviceType) QemuDeviceParam(netdev *NetDevice, config *Config) Device
 	case VETHTAP:
 		device = "virtio-net" // -netdev type=tap -device virtio-net-pci
 	case VFIO:
-		if netdev.Transport == TransportMMIO {
-			log.Fatal("vfio devices are not support with the MMIO transport")
-		}
 		device = "vfio" // -device vfio-pci (no netdev)
 	case VHOSTUSER:
-		if netdev.Transport == TransportCCW {
-			log.Fatal("vhost-user devices are not supported on IBM Z")
-		}
-		return "" // -netdev type=vhost-user (no device)
+		return "", nil // -netdev type=vhost-user (no device)
 	default:
-		return ""
+		return "", nil
 	}
 
 	switch netdev.Transport {
 	case TransportPCI:
-		return DeviceDriver(device + "-pci")
+		return DeviceDriver(device + "-pci"), nil
 	case TransportCCW:
-		return DeviceDriver(device + "-ccw")
+		return DeviceDriver(device + "-ccw"), nil
 	case TransportMMIO:
-		return DeviceDriver(device + "-device")
+		return DeviceDriver(device + "-device"), nil
 	default:
-		return ""
+		return "", fmt.Errorf("unsupported transport %s", netdev.Transport)
 	}
 }
 
@@ -841,20 +1813,30 @@ var VirtioNetTransport = map[VirtioTransport]string{
 	TransportMMIO: "virtio-net-device",
 }
 
-// Valid returns true if the NetDevice structure is valid and complete.
-func (netdev NetDevice) Valid() bool {
-	if netdev.ID == "" || netdev.IFName == "" {
-		return false
+// validate returns an error describing why the NetDevice structure is not
+// valid and complete, or nil if it is.
+func (netdev NetDevice) validate() error {
+	if netdev.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if netdev.IFName == "" {
+		return fmt.Errorf("IFName is not set")
 	}
 
 	switch netdev.Type {
 	case TAP:
-		return true
 	case MACVTAP:
-		return true
 	default:
-		return false
+		return fmt.Errorf("unsupported network device type %q", netdev.Type)
 	}
+
+	return nil
+}
+
+// Valid returns true if the NetDevice structure is valid and complete.
+func (netdev NetDevice) Valid() bool {
+	return netdev.validate() == nil
 }
 
 // mqParameter returns the parameters for multi-queue driver. If the driver is a PCI device then the
@@ -975,16 +1957,33 @@ func (netdev NetDevice) QemuNetdevParams(config *Config) []string {
 
 // QemuParams returns the qemu parameters built out of this network device.
 func (netdev NetDevice) QemuParams(config *Config) []string {
+	qemuParams, _ := netdev.QemuParamsErr(config)
+	return qemuParams
+}
+
+// QemuParamsErr returns the qemu parameters built out of this network
+// device, or an error if they cannot be built.
+func (netdev NetDevice) QemuParamsErr(config *Config) ([]string, error) {
 	var netdevParams []string
 	var deviceParams []string
 	var qemuParams []string
 
 	// Macvtap can only be connected via fds
 	if (netdev.Type == MACVTAP) && (len(netdev.FDs) == 0) {
-		return nil // implicit error
+		return nil, fmt.Errorf("macvtap device %s requires FDs", netdev.ID)
+	}
+
+	netdevType, err := netdev.Type.QemuNetdevParamErr(&netdev, config)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := netdev.Type.QemuDeviceParamErr(&netdev, config)
+	if err != nil {
+		return nil, err
 	}
 
-	if netdev.Type.QemuNetdevParam(&netdev, config) != "" {
+	if netdevType != "" {
 		netdevParams = netdev.QemuNetdevParams(config)
 		if netdevParams != nil {
 			qemuParams = append(qemuParams, "-netdev")
@@ -992,7 +1991,7 @@ func (netdev NetDevice) QemuParams(config *Config) []string {
 		}
 	}
 
-	if netdev.Type.QemuDeviceParam(&netdev, config) != "" {
+	if driver != "" {
 		deviceParams = netdev.QemuDeviceParams(config)
 		if deviceParams != nil {
 			qemuParams = append(qemuParams, "-device")
@@ -1000,7 +1999,7 @@ func (netdev NetDevice) QemuParams(config *Config) []string {
 		}
 	}
 
-	return qemuParams
+	return qemuParams, nil
 }
 
 // LegacySerialDevice represents a qemu legacy serial device.
@@ -1014,9 +2013,19 @@ type LegacySerialDevice struct {
 	Chardev string
 }
 
+// validate returns an error describing why the LegacySerialDevice structure is not
+// valid and complete, or nil if it is.
+func (dev LegacySerialDevice) validate() error {
+	if dev.Chardev == "" {
+		return fmt.Errorf("Chardev is not set")
+	}
+
+	return nil
+}
+
 // Valid returns true if the LegacySerialDevice structure is valid and complete.
 func (dev LegacySerialDevice) Valid() bool {
-	return dev.Chardev != ""
+	return dev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this serial device.
@@ -1032,6 +2041,12 @@ func (dev LegacySerialDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this serial
+// device, or an error if they cannot be built.
+func (dev LegacySerialDevice) QemuParamsErr(config *Config) ([]string, error) {
+	return dev.QemuParams(config), nil
+}
+
 /* Not used currently
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
@@ -1064,13 +2079,23 @@ type SerialDevice struct {
 	MaxPorts uint
 }
 
-// Valid returns true if the SerialDevice structure is valid and complete.
-func (dev SerialDevice) Valid() bool {
-	if dev.Driver == "" || dev.ID == "" {
-		return false
+// validate returns an error describing why the SerialDevice structure is not
+// valid and complete, or nil if it is.
+func (dev SerialDevice) validate() error {
+	if dev.Driver == "" {
+		return fmt.Errorf("Driver is not set")
 	}
 
-	return true
+	if dev.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the SerialDevice structure is valid and complete.
+func (dev SerialDevice) Valid() bool {
+	return dev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this serial device.
@@ -1103,6 +2128,16 @@ func (dev SerialDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this serial
+// device, or an error if they cannot be built.
+func (dev SerialDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := dev.Transport.checkDeviceName(dev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return dev.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (dev SerialDevice) deviceName(config *Config) string {
@@ -1174,6 +2209,15 @@ type BlockDevice struct {
 	// ReadOnly sets the block device in readonly mode
 	ReadOnly bool
 
+	// NodeName is the name of the top level block node of the drive.
+	// It is optional, but setting it allows the node to be referred to
+	// by QMP commands such as snapshot-save.
+	NodeName string
+
+	// IOThread is the IO thread on which IO will be handled.
+	// It is only supported by virtio-blk devices.
+	IOThread string
+
 	// Transport is the virtio transport for this device.
 	Transport VirtioTransport
 }
@@ -1186,13 +2230,27 @@ var VirtioBlockTransport = map[VirtioTransport]string{
 	TransportMMIO: "virtio-blk-device",
 }
 
-// Valid returns true if the BlockDevice structure is valid and complete.
-func (blkdev BlockDevice) Valid() bool {
-	if blkdev.Driver == "" || blkdev.ID == "" || blkdev.File == "" {
-		return false
+// validate returns an error describing why the BlockDevice structure is not
+// valid and complete, or nil if it is.
+func (blkdev BlockDevice) validate() error {
+	if blkdev.Driver == "" {
+		return fmt.Errorf("Driver is not set")
 	}
 
-	return true
+	if blkdev.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if blkdev.File == "" {
+		return fmt.Errorf("File is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the BlockDevice structure is valid and complete.
+func (blkdev BlockDevice) Valid() bool {
+	return blkdev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this block device.
@@ -1226,6 +2284,10 @@ func (blkdev BlockDevice) QemuParams(config *Config) []string {
 		deviceParams = append(deviceParams, "share-rw=on")
 	}
 
+	if blkdev.IOThread != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("iothread=%s", blkdev.IOThread))
+	}
+
 	deviceParams = append(deviceParams, fmt.Sprintf("serial=%s", blkdev.ID))
 
 	blkParams = append(blkParams, fmt.Sprintf("id=%s", blkdev.ID))
@@ -1238,6 +2300,10 @@ func (blkdev BlockDevice) QemuParams(config *Config) []string {
 		blkParams = append(blkParams, "readonly=on")
 	}
 
+	if blkdev.NodeName != "" {
+		blkParams = append(blkParams, fmt.Sprintf("node-name=%s", blkdev.NodeName))
+	}
+
 	qemuParams = append(qemuParams, "-device")
 	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
 
@@ -1247,6 +2313,20 @@ func (blkdev BlockDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this block device,
+// or an error if they cannot be built.
+func (blkdev BlockDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := blkdev.Transport.checkDeviceName(blkdev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	if blkdev.IOThread != "" && blkdev.Driver != VirtioBlock {
+		return nil, fmt.Errorf("IOThread is not supported by the %s driver of block device %s", blkdev.Driver, blkdev.ID)
+	}
+
+	return blkdev.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (blkdev BlockDevice) deviceName(config *Config) string {
@@ -1280,23 +2360,103 @@ func (dev PVPanicDevice) QemuParams(config *Config) []string {
 	return []string{"-device", "pvpanic"}
 }
 
+// QemuParamsErr returns the qemu parameters built out of this pvpanic
+// device, or an error if they cannot be built.
+func (dev PVPanicDevice) QemuParamsErr(config *Config) ([]string, error) {
+	return dev.QemuParams(config), nil
+}
+
+// WatchdogModel is a qemu watchdog device model.
+type WatchdogModel string
+
+const (
+	// WatchdogI6300ESB is the Intel 6300ESB PCI watchdog.
+	WatchdogI6300ESB WatchdogModel = "i6300esb"
+
+	// WatchdogIB700 is the iBASE 700 ISA watchdog.
+	WatchdogIB700 WatchdogModel = "ib700"
+
+	// WatchdogDiag288 is the diag 288 watchdog of s390x machines.
+	WatchdogDiag288 WatchdogModel = "diag288"
+)
+
+// WatchdogDevice represents a qemu watchdog device.  The action taken when
+// the watchdog expires is set by Actions.Watchdog.
+type WatchdogDevice struct {
+	// ID is the device identifier, optional.
+	ID string
+
+	// Model is the watchdog model.
+	Model WatchdogModel
+}
+
+// validate returns an error describing why the WatchdogDevice structure is not
+// valid and complete, or nil if it is.
+func (dev WatchdogDevice) validate() error {
+	switch dev.Model {
+	case WatchdogI6300ESB, WatchdogIB700, WatchdogDiag288:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported watchdog model %q", dev.Model)
+}
+
+// Valid returns true if the WatchdogDevice structure is valid and complete.
+func (dev WatchdogDevice) Valid() bool {
+	return dev.validate() == nil
+}
+
+// QemuParams returns the qemu parameters built out of this watchdog device.
+func (dev WatchdogDevice) QemuParams(config *Config) []string {
+	deviceParams := []string{string(dev.Model)}
+	if dev.ID != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("id=%s", dev.ID))
+	}
+
+	return []string{"-device", strings.Join(deviceParams, ",")}
+}
+
+// QemuParamsErr returns the qemu parameters built out of this watchdog
+// device, or an error if the model is not supported by the machine.
+func (dev WatchdogDevice) QemuParamsErr(config *Config) ([]string, error) {
+	machine := ""
+	if config != nil {
+		machine = config.Machine.Type
+	}
+
+	if machine != "" {
+		s390 := strings.HasPrefix(machine, "s390-ccw-virtio")
+		if s390 != (dev.Model == WatchdogDiag288) {
+			return nil, fmt.Errorf("the %s watchdog is not supported by the %s machine", dev.Model, machine)
+		}
+	}
+
+	return dev.QemuParams(config), nil
+}
+
 // LoaderDevice represents a qemu loader device.
 type LoaderDevice struct {
 	File string
 	ID   string
 }
 
-// Valid returns true if there is a valid structure defined for LoaderDevice
-func (dev LoaderDevice) Valid() bool {
+// validate returns an error describing why the LoaderDevice structure is not
+// valid and complete, or nil if it is.
+func (dev LoaderDevice) validate() error {
 	if dev.File == "" {
-		return false
+		return fmt.Errorf("File is not set")
 	}
 
 	if dev.ID == "" {
-		return false
+		return fmt.Errorf("ID is not set")
 	}
 
-	return true
+	return nil
+}
+
+// Valid returns true if there is a valid structure defined for LoaderDevice
+func (dev LoaderDevice) Valid() bool {
+	return dev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this loader device.
@@ -1314,6 +2474,12 @@ func (dev LoaderDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this loader
+// device, or an error if they cannot be built.
+func (dev LoaderDevice) QemuParamsErr(config *Config) ([]string, error) {
+	return dev.QemuParams(config), nil
+}
+
 // VhostUserDevice represents a qemu vhost-user device meant to be passed
 // in to the guest
 type VhostUserDevice struct {
@@ -1368,32 +2534,44 @@ var VhostUserFSTransport = map[VirtioTransport]string{
 	TransportMMIO: "vhost-user-fs-device",
 }
 
-// Valid returns true if there is a valid structure defined for VhostUserDevice
-func (vhostuserDev VhostUserDevice) Valid() bool {
+// validate returns an error describing why the VhostUserDevice structure is not
+// valid and complete, or nil if it is.
+func (vhostuserDev VhostUserDevice) validate() error {
+	if vhostuserDev.SocketPath == "" {
+		return fmt.Errorf("SocketPath is not set")
+	}
 
-	if vhostuserDev.SocketPath == "" || vhostuserDev.CharDevID == "" {
-		return false
+	if vhostuserDev.CharDevID == "" {
+		return fmt.Errorf("CharDevID is not set")
 	}
 
 	switch vhostuserDev.VhostUserType {
 	case VhostUserNet:
-		if vhostuserDev.TypeDevID == "" || vhostuserDev.Address == "" {
-			return false
+		if vhostuserDev.TypeDevID == "" {
+			return fmt.Errorf("TypeDevID is not set")
+		}
+		if vhostuserDev.Address == "" {
+			return fmt.Errorf("Address is not set")
 		}
 	case VhostUserSCSI:
 		if vhostuserDev.TypeDevID == "" {
-			return false
+			return fmt.Errorf("TypeDevID is not set")
 		}
 	case VhostUserBlk:
 	case VhostUserFS:
 		if vhostuserDev.Tag == "" {
-			return false
+			return fmt.Errorf("Tag is not set")
 		}
 	default:
-		return false
+		return fmt.Errorf("unsupported vhost-user device type %q", vhostuserDev.VhostUserType)
 	}
 
-	return true
+	return nil
+}
+
+// Valid returns true if there is a valid structure defined for VhostUserDevice
+func (vhostuserDev VhostUserDevice) Valid() bool {
+	return vhostuserDev.validate() == nil
 }
 
 // QemuNetParams builds QEMU netdev and device parameters for a VhostUserNet device
@@ -1512,6 +2690,22 @@ func (vhostuserDev VhostUserDevice) QemuFSParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this vhostuser
+// device, or an error if they cannot be built.
+func (vhostuserDev VhostUserDevice) QemuParamsErr(config *Config) ([]string, error) {
+	switch vhostuserDev.VhostUserType {
+	case VhostUserNet, VhostUserSCSI, VhostUserBlk, VhostUserFS:
+	default:
+		return nil, fmt.Errorf("unsupported vhost-user device type %s", vhostuserDev.VhostUserType)
+	}
+
+	if err := vhostuserDev.Transport.checkDeviceName(vhostuserDev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return vhostuserDev.QemuParams(config), nil
+}
+
 // QemuParams returns the qemu parameters built out of this vhostuser device.
 func (vhostuserDev VhostUserDevice) QemuParams(config *Config) []string {
 	var qemuParams []string
@@ -1653,16 +2847,30 @@ func (b PCIeRootPortDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
-// Valid returns true if the PCIeRootPortDevice structure is valid and complete.
-func (b PCIeRootPortDevice) Valid() bool {
+// QemuParamsErr returns the qemu parameters built out of the
+// PCIeRootPortDevice, or an error if they cannot be built.
+func (b PCIeRootPortDevice) QemuParamsErr(config *Config) ([]string, error) {
+	return b.QemuParams(config), nil
+}
+
+// validate returns an error describing why the PCIeRootPortDevice structure is not
+// valid and complete, or nil if it is.
+func (b PCIeRootPortDevice) validate() error {
 	// the "pref32-reserve" and "pref64-reserve" hints are mutually exclusive.
 	if b.Pref64Reserve != "" && b.Pref32Reserve != "" {
-		return false
+		return fmt.Errorf("Pref32Reserve and Pref64Reserve are mutually exclusive")
 	}
+
 	if b.ID == "" {
-		return false
+		return fmt.Errorf("ID is not set")
 	}
-	return true
+
+	return nil
+}
+
+// Valid returns true if the PCIeRootPortDevice structure is valid and complete.
+func (b PCIeRootPortDevice) Valid() bool {
+	return b.validate() == nil
 }
 
 // VFIODevice represents a qemu vfio device meant for direct access by guest OS.
@@ -1697,9 +2905,19 @@ var VFIODeviceTransport = map[VirtioTransport]string{
 	TransportMMIO: "vfio-device",
 }
 
+// validate returns an error describing why the VFIODevice structure is not
+// valid and complete, or nil if it is.
+func (vfioDev VFIODevice) validate() error {
+	if vfioDev.BDF == "" {
+		return fmt.Errorf("BDF is not set")
+	}
+
+	return nil
+}
+
 // Valid returns true if the VFIODevice structure is valid and complete.
 func (vfioDev VFIODevice) Valid() bool {
-	return vfioDev.BDF != ""
+	return vfioDev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this vfio device.
@@ -1736,6 +2954,16 @@ func (vfioDev VFIODevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this vfio device,
+// or an error if they cannot be built.
+func (vfioDev VFIODevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := vfioDev.Transport.checkDeviceName(vfioDev.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return vfioDev.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (vfioDev VFIODevice) deviceName(config *Config) string {
@@ -1780,9 +3008,19 @@ var SCSIControllerTransport = map[VirtioTransport]string{
 	TransportMMIO: "virtio-scsi-device",
 }
 
+// validate returns an error describing why the SCSIController structure is not
+// valid and complete, or nil if it is.
+func (scsiCon SCSIController) validate() error {
+	if scsiCon.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
 // Valid returns true if the SCSIController structure is valid and complete.
 func (scsiCon SCSIController) Valid() bool {
-	return scsiCon.ID != ""
+	return scsiCon.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this SCSIController device.
@@ -1821,6 +3059,16 @@ func (scsiCon SCSIController) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this
+// SCSIController device, or an error if they cannot be built.
+func (scsiCon SCSIController) QemuParamsErr(config *Config) ([]string, error) {
+	if err := scsiCon.Transport.checkDeviceName(scsiCon.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return scsiCon.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (scsiCon SCSIController) deviceName(config *Config) string {
@@ -1875,21 +3123,27 @@ type BridgeDevice struct {
 	Pref64Reserve string
 }
 
-// Valid returns true if the BridgeDevice structure is valid and complete.
-func (bridgeDev BridgeDevice) Valid() bool {
+// validate returns an error describing why the BridgeDevice structure is not
+// valid and complete, or nil if it is.
+func (bridgeDev BridgeDevice) validate() error {
 	if bridgeDev.Type != PCIBridge && bridgeDev.Type != PCIEBridge {
-		return false
+		return fmt.Errorf("unsupported bridge type %d", bridgeDev.Type)
 	}
 
 	if bridgeDev.Bus == "" {
-		return false
+		return fmt.Errorf("Bus is not set")
 	}
 
 	if bridgeDev.ID == "" {
-		return false
+		return fmt.Errorf("ID is not set")
 	}
 
-	return true
+	return nil
+}
+
+// Valid returns true if the BridgeDevice structure is valid and complete.
+func (bridgeDev BridgeDevice) Valid() bool {
+	return bridgeDev.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of this bridge device.
@@ -1939,6 +3193,12 @@ func (bridgeDev BridgeDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of this bridge
+// device, or an error if they cannot be built.
+func (bridgeDev BridgeDevice) QemuParamsErr(config *Config) ([]string, error) {
+	return bridgeDev.QemuParams(config), nil
+}
+
 // VSOCKDevice represents a AF_VSOCK socket.
 type VSOCKDevice struct {
 	ID string
@@ -1982,13 +3242,23 @@ const (
 	VSOCKGuestCID = "guest-cid"
 )
 
-// Valid returns true if the VSOCKDevice structure is valid and complete.
-func (vsock VSOCKDevice) Valid() bool {
-	if vsock.ID == "" || vsock.ContextID < MinimalGuestCID || vsock.ContextID > MaxGuestCID {
-		return false
+// validate returns an error describing why the VSOCKDevice structure is not
+// valid and complete, or nil if it is.
+func (vsock VSOCKDevice) validate() error {
+	if vsock.ID == "" {
+		return fmt.Errorf("ID is not set")
 	}
 
-	return true
+	if vsock.ContextID < MinimalGuestCID || vsock.ContextID > MaxGuestCID {
+		return fmt.Errorf("ContextID %d is outside [%d, %d]", vsock.ContextID, MinimalGuestCID, MaxGuestCID)
+	}
+
+	return nil
+}
+
+// Valid returns true if the VSOCKDevice structure is valid and complete.
+func (vsock VSOCKDevice) Valid() bool {
+	return vsock.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of the VSOCK device.
@@ -2025,6 +3295,16 @@ func (vsock VSOCKDevice) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of the VSOCK device,
+// or an error if they cannot be built.
+func (vsock VSOCKDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := vsock.Transport.checkDeviceName(vsock.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return vsock.QemuParams(config), nil
+}
+
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
 func (vsock VSOCKDevice) deviceName(config *Config) string {
@@ -2061,9 +3341,19 @@ var RngDeviceTransport = map[VirtioTransport]string{
 	TransportMMIO: "virtio-rng-device",
 }
 
+// validate returns an error describing why the RngDevice structure is not
+// valid and complete, or nil if it is.
+func (v RngDevice) validate() error {
+	if v.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
 // Valid returns true if the RngDevice structure is valid and complete.
 func (v RngDevice) Valid() bool {
-	return v.ID != ""
+	return v.validate() == nil
 }
 
 // QemuParams returns the qemu parameters built out of the RngDevice.
@@ -2075,8 +3365,12 @@ func (v RngDevice) QemuParams(config *Config) []string {
 	//-device virtio-rng-pci,rng=rng0,max-bytes=1024,period=1000
 	var deviceParams []string
 
-	objectParams = append(objectParams, "rng-random")
-	objectParams = append(objectParams, "id="+v.ID)
+	backend := RngBackend{
+		Type:     RngRandom,
+		ID:       v.ID,
+		Filename: v.Filename,
+	}
+	objectParams = objectPropertyParams(backend.Type, backend.ID, backend.properties())
 
 	deviceParams = append(deviceParams, v.deviceName(config))
 	deviceParams = append(deviceParams, "rng="+v.ID)
@@ -2092,10 +3386,6 @@ func (v RngDevice) QemuParams(config *Config) []string {
 		deviceParams = append(deviceParams, fmt.Sprintf("devno=%s", v.DevNo))
 	}
 
-	if v.Filename != "" {
-		objectParams = append(objectParams, "filename="+v.Filename)
-	}
-
 	if v.MaxBytes > 0 {
 		deviceParams = append(deviceParams, fmt.Sprintf("max-bytes=%d", v.MaxBytes))
 	}
@@ -2107,92 +3397,267 @@ func (v RngDevice) QemuParams(config *Config) []string {
 	qemuParams = append(qemuParams, "-object")
 	qemuParams = append(qemuParams, strings.Join(objectParams, ","))
 
-	qemuParams = append(qemuParams, "-device")
-	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
+	qemuParams = append(qemuParams, "-device")
+	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
+
+	return qemuParams
+}
+
+// QemuParamsErr returns the qemu parameters built out of the RngDevice, or
+// an error if they cannot be built.
+func (v RngDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := v.Transport.checkDeviceName(v.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return v.QemuParams(config), nil
+}
+
+// deviceName returns the QEMU device name for the current combination of
+// driver and transport.
+func (v RngDevice) deviceName(config *Config) string {
+	if v.Transport == "" {
+		v.Transport = v.Transport.defaultTransport(config)
+	}
+
+	return RngDeviceTransport[v.Transport]
+}
+
+// BalloonDevice represents a memory balloon device.
+type BalloonDevice struct {
+	DeflateOnOOM  bool
+	DisableModern bool
+	ID            string
+
+	// FreePageReporting enables the guest to report its free pages to
+	// the host, which then reclaims them.
+	FreePageReporting bool
+
+	// FreePageHint enables the guest to hint its free pages to the host
+	// during migration.
+	FreePageHint bool
+
+	// StatsPollingInterval is the interval in seconds at which the guest
+	// memory statistics are updated. The statistics are disabled when it
+	// is zero.
+	StatsPollingInterval uint32
+
+	// ROMFile specifies the ROM file being used for this device.
+	ROMFile string
+
+	// DevNo identifies the ccw devices for s390x architecture
+	DevNo string
+
+	// Transport is the virtio transport for this device.
+	Transport VirtioTransport
+}
+
+// BalloonDeviceTransport is a map of the virtio-balloon device name that
+// corresponds to each transport.
+var BalloonDeviceTransport = map[VirtioTransport]string{
+	TransportPCI:  "virtio-balloon-pci",
+	TransportCCW:  "virtio-balloon-ccw",
+	TransportMMIO: "virtio-balloon-device",
+}
+
+// QemuParams returns the qemu parameters built out of the BalloonDevice.
+func (b BalloonDevice) QemuParams(config *Config) []string {
+	var qemuParams []string
+	var deviceParams []string
+
+	deviceParams = append(deviceParams, b.deviceName(config))
+
+	if b.ID != "" {
+		deviceParams = append(deviceParams, "id="+b.ID)
+	}
+
+	if b.Transport.isVirtioPCI(config) && b.ROMFile != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("romfile=%s", b.ROMFile))
+	}
+
+	if b.Transport.isVirtioCCW(config) {
+		deviceParams = append(deviceParams, fmt.Sprintf("devno=%s", b.DevNo))
+	}
+
+	if b.DeflateOnOOM {
+		deviceParams = append(deviceParams, "deflate-on-oom=on")
+	} else {
+		deviceParams = append(deviceParams, "deflate-on-oom=off")
+	}
+	if b.FreePageReporting {
+		deviceParams = append(deviceParams, "free-page-reporting=on")
+	}
+	if b.FreePageHint {
+		deviceParams = append(deviceParams, "free-page-hint=on")
+	}
+	if b.StatsPollingInterval > 0 {
+		deviceParams = append(deviceParams, fmt.Sprintf("guest-stats-polling-interval=%d", b.StatsPollingInterval))
+	}
+	if s := b.Transport.disableModern(config, b.DisableModern); s != "" {
+		deviceParams = append(deviceParams, s)
+	}
+	qemuParams = append(qemuParams, "-device")
+	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
+
+	return qemuParams
+}
+
+// QemuParamsErr returns the qemu parameters built out of the BalloonDevice,
+// or an error if they cannot be built.
+func (b BalloonDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := b.Transport.checkDeviceName(b.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return b.QemuParams(config), nil
+}
+
+// validate returns an error describing why the BalloonDevice structure is not
+// valid and complete, or nil if it is.
+func (b BalloonDevice) validate() error {
+	if b.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	return nil
+}
+
+// Valid returns true if the balloonDevice structure is valid and complete.
+func (b BalloonDevice) Valid() bool {
+	return b.validate() == nil
+}
+
+// deviceName returns the QEMU device name for the current combination of
+// driver and transport.
+func (b BalloonDevice) deviceName(config *Config) string {
+	if b.Transport == "" {
+		b.Transport = b.Transport.defaultTransport(config)
+	}
+
+	return BalloonDeviceTransport[b.Transport]
+}
+
+// VirtioMemDevice represents a virtio-mem device, which provides memory
+// to the guest at a memory block granularity.
+type VirtioMemDevice struct {
+	// ID is the user defined device ID.
+	ID string
+
+	// MemDev is the ID of the memory backend providing the device memory.
+	// Its size is the maximum size of the device.
+	MemDev string
 
-	return qemuParams
-}
+	// Node is the guest NUMA node the device memory is assigned to.  It is
+	// left to qemu if Node is nil.
+	Node *uint32
 
-// deviceName returns the QEMU device name for the current combination of
-// driver and transport.
-func (v RngDevice) deviceName(config *Config) string {
-	if v.Transport == "" {
-		v.Transport = v.Transport.defaultTransport(config)
-	}
+	// BlockSize is the size of the memory blocks plugged and unplugged by
+	// the guest. It should be suffixed with K, M or G.
+	BlockSize string
 
-	return RngDeviceTransport[v.Transport]
-}
+	// RequestedSize is the amount of memory the guest is requested to
+	// plug at boot time. It should be suffixed with K, M or G.
+	RequestedSize string
 
-// BalloonDevice represents a memory balloon device.
-type BalloonDevice struct {
-	DeflateOnOOM  bool
-	DisableModern bool
-	ID            string
+	// Bus is the bus path name of the device.
+	Bus string
+
+	// Addr is the address of the device on Bus.
+	Addr string
 
 	// ROMFile specifies the ROM file being used for this device.
 	ROMFile string
 
-	// DevNo identifies the ccw devices for s390x architecture
-	DevNo string
-
 	// Transport is the virtio transport for this device.
 	Transport VirtioTransport
 }
 
-// BalloonDeviceTransport is a map of the virtio-balloon device name that
+// VirtioMemDeviceTransport is a map of the virtio-mem device name that
 // corresponds to each transport.
-var BalloonDeviceTransport = map[VirtioTransport]string{
-	TransportPCI:  "virtio-balloon-pci",
-	TransportCCW:  "virtio-balloon-ccw",
-	TransportMMIO: "virtio-balloon-device",
+var VirtioMemDeviceTransport = map[VirtioTransport]string{
+	TransportPCI: "virtio-mem-pci",
 }
 
-// QemuParams returns the qemu parameters built out of the BalloonDevice.
-func (b BalloonDevice) QemuParams(config *Config) []string {
+// QemuParams returns the qemu parameters built out of the VirtioMemDevice.
+func (v VirtioMemDevice) QemuParams(config *Config) []string {
 	var qemuParams []string
 	var deviceParams []string
 
-	deviceParams = append(deviceParams, b.deviceName(config))
-
-	if b.ID != "" {
-		deviceParams = append(deviceParams, "id="+b.ID)
+	driver := v.deviceName(config)
+	if driver == "" {
+		return nil
 	}
 
-	if b.Transport.isVirtioPCI(config) && b.ROMFile != "" {
-		deviceParams = append(deviceParams, fmt.Sprintf("romfile=%s", b.ROMFile))
-	}
+	deviceParams = append(deviceParams, driver)
+	deviceParams = append(deviceParams, fmt.Sprintf("id=%s", v.ID))
+	deviceParams = append(deviceParams, fmt.Sprintf("memdev=%s", v.MemDev))
 
-	if b.Transport.isVirtioCCW(config) {
-		deviceParams = append(deviceParams, fmt.Sprintf("devno=%s", b.DevNo))
+	if v.Node != nil {
+		deviceParams = append(deviceParams, fmt.Sprintf("node=%d", *v.Node))
 	}
-
-	if b.DeflateOnOOM {
-		deviceParams = append(deviceParams, "deflate-on-oom=on")
-	} else {
-		deviceParams = append(deviceParams, "deflate-on-oom=off")
+	if v.BlockSize != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("block-size=%s", v.BlockSize))
 	}
-	if s := b.Transport.disableModern(config, b.DisableModern); s != "" {
-		deviceParams = append(deviceParams, s)
+	if v.RequestedSize != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("requested-size=%s", v.RequestedSize))
+	}
+	if v.Bus != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("bus=%s", v.Bus))
+	}
+	if v.Addr != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("addr=%s", v.Addr))
+	}
+	if v.Transport.isVirtioPCI(config) && v.ROMFile != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("romfile=%s", v.ROMFile))
 	}
+
 	qemuParams = append(qemuParams, "-device")
 	qemuParams = append(qemuParams, strings.Join(deviceParams, ","))
 
 	return qemuParams
 }
 
-// Valid returns true if the balloonDevice structure is valid and complete.
-func (b BalloonDevice) Valid() bool {
-	return b.ID != ""
+// QemuParamsErr returns the qemu parameters built out of the
+// VirtioMemDevice, or an error if they cannot be built.
+func (v VirtioMemDevice) QemuParamsErr(config *Config) ([]string, error) {
+	if err := v.Transport.checkDeviceName(v.deviceName(config), config); err != nil {
+		return nil, err
+	}
+
+	return v.QemuParams(config), nil
+}
+
+// validate returns an error describing why the VirtioMemDevice structure is not
+// valid and complete, or nil if it is.
+func (v VirtioMemDevice) validate() error {
+	if v.ID == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	if v.MemDev == "" {
+		return fmt.Errorf("MemDev is not set")
+	}
+
+	if v.Transport != "" && VirtioMemDeviceTransport[v.Transport] == "" {
+		return fmt.Errorf("unsupported transport %q", v.Transport)
+	}
+
+	return nil
+}
+
+// Valid returns true if the VirtioMemDevice structure is valid and complete.
+func (v VirtioMemDevice) Valid() bool {
+	return v.validate() == nil
 }
 
 // deviceName returns the QEMU device name for the current combination of
 // driver and transport.
-func (b BalloonDevice) deviceName(config *Config) string {
-	if b.Transport == "" {
-		b.Transport = b.Transport.defaultTransport(config)
+func (v VirtioMemDevice) deviceName(config *Config) string {
+	if v.Transport == "" {
+		v.Transport = v.Transport.defaultTransport(config)
 	}
 
-	return BalloonDeviceTransport[b.Transport]
+	return VirtioMemDeviceTransport[v.Transport]
 }
 
 // IommuDev represents a Intel IOMMU Device
@@ -2241,6 +3706,12 @@ func (dev IommuDev) QemuParams(_ *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of the IommuDev, or
+// an error if they cannot be built.
+func (dev IommuDev) QemuParamsErr(config *Config) ([]string, error) {
+	return dev.QemuParams(config), nil
+}
+
 // RTCBaseType is the qemu RTC base time type.
 type RTCBaseType string
 
@@ -2376,6 +3847,84 @@ type Memory struct {
 	Path string
 }
 
+// NUMAPolicy is the host NUMA policy applied to a guest memory backend.
+type NUMAPolicy string
+
+const (
+	// NUMAPolicyDefault uses the default host NUMA policy.
+	NUMAPolicyDefault NUMAPolicy = "default"
+
+	// NUMAPolicyPreferred allocates memory from the host nodes first.
+	NUMAPolicyPreferred NUMAPolicy = "preferred"
+
+	// NUMAPolicyBind restricts memory allocation to the host nodes.
+	NUMAPolicyBind NUMAPolicy = "bind"
+
+	// NUMAPolicyInterleave interleaves memory allocation across the host nodes.
+	NUMAPolicyInterleave NUMAPolicy = "interleave"
+)
+
+// NUMANode is a guest NUMA node.
+type NUMANode struct {
+	// ID is the guest node ID.
+	ID uint32
+
+	// CPUs is the list of vCPU ranges assigned to the node, e.g. "0-3".
+	CPUs []string
+
+	// MemorySize is the amount of memory assigned to the node.
+	// It should be suffixed with M or G for sizes in megabytes or
+	// gigabytes respectively.
+	MemorySize string
+
+	// Backend is the memory backend type of the node. It can be
+	// MemoryBackendRAM, MemoryBackendFile or MemoryBackendMemfd and
+	// defaults to MemoryBackendRAM.
+	Backend ObjectType
+
+	// MemPath is the backing file path of a MemoryBackendFile backend.
+	// It defaults to /dev/hugepages when HugePages is set.
+	MemPath string
+
+	// HugePages backs the node memory with huge pages.
+	HugePages bool
+
+	// Share sets the node memory as shared.
+	Share bool
+
+	// Prealloc allocates all the node memory upfront.
+	Prealloc bool
+
+	// HostNodes is the list of host nodes the node memory is bound to.
+	HostNodes []uint32
+
+	// Policy is the host NUMA policy applied to HostNodes.
+	Policy NUMAPolicy
+}
+
+// NUMADistance is the distance between two guest NUMA nodes.
+type NUMADistance struct {
+	// Src is the source node ID.
+	Src uint32
+
+	// Dst is the destination node ID.
+	Dst uint32
+
+	// Value is the distance from Src to Dst.
+	Value uint8
+}
+
+// NUMA is the guest NUMA topology configuration structure.
+type NUMA struct {
+	// Nodes is the list of guest NUMA nodes. When set, each node gets
+	// its own memory backend, and the sum of the nodes memory should be
+	// equal to Memory.Size.
+	Nodes []NUMANode
+
+	// Distances is the list of distances between guest NUMA nodes.
+	Distances []NUMADistance
+}
+
 // Kernel is the guest kernel configuration structure.
 type Kernel struct {
 	// Path is the guest kernel path on the host filesystem.
@@ -2438,6 +3987,12 @@ func (fwcfg FwCfg) QemuParams(config *Config) []string {
 	return qemuParams
 }
 
+// QemuParamsErr returns the qemu parameters built out of the FwCfg object,
+// or an error if they cannot be built.
+func (fwcfg FwCfg) QemuParamsErr(config *Config) ([]string, error) {
+	return fwcfg.QemuParams(config), nil
+}
+
 // Knobs regroups a set of qemu boolean settings
 type Knobs struct {
 	// NoUserConfig prevents qemu from loading user config files.
@@ -2492,6 +4047,19 @@ type Knobs struct {
 // IOThread allows IO to be performed on a separate thread.
 type IOThread struct {
 	ID string
+
+	// PollMaxNs is the maximum time in nanoseconds the thread polls for
+	// events before sleeping. Polling is disabled when it is zero, and
+	// the qemu default is used when PollMaxNs is nil.
+	PollMaxNs *uint64
+
+	// PollGrow is the multiplier used to grow the polling time. The qemu
+	// default is used when it is zero.
+	PollGrow uint64
+
+	// PollShrink is the divisor used to shrink the polling time. The qemu
+	// default is used when it is zero.
+	PollShrink uint64
 }
 
 const (
@@ -2514,6 +4082,115 @@ type Incoming struct {
 	Exec string
 }
 
+// PanicAction is the action taken by qemu when the guest panics.
+type PanicAction string
+
+const (
+	// PanicActionPause pauses the guest, in the guest-panicked run state.
+	PanicActionPause PanicAction = "pause"
+
+	// PanicActionShutdown shuts the guest down, following the shutdown
+	// action.
+	PanicActionShutdown PanicAction = "shutdown"
+
+	// PanicActionExitFailure makes qemu exit with a non zero status.
+	PanicActionExitFailure PanicAction = "exit-failure"
+
+	// PanicActionNone only reports the panic, and lets the guest run.
+	PanicActionNone PanicAction = "none"
+)
+
+// RebootAction is the action taken by qemu when the guest reboots.
+type RebootAction string
+
+const (
+	// RebootActionReset resets the guest.
+	RebootActionReset RebootAction = "reset"
+
+	// RebootActionShutdown shuts the guest down, following the shutdown
+	// action, as Knobs.NoReboot does.
+	RebootActionShutdown RebootAction = "shutdown"
+)
+
+// ShutdownAction is the action taken by qemu when the guest shuts down.
+type ShutdownAction string
+
+const (
+	// ShutdownActionPoweroff makes qemu exit.
+	ShutdownActionPoweroff ShutdownAction = "poweroff"
+
+	// ShutdownActionPause pauses the guest, in the shutdown run state, as
+	// Knobs.NoShutdown does.
+	ShutdownActionPause ShutdownAction = "pause"
+)
+
+// WatchdogAction is the action taken by qemu when the watchdog of the guest
+// expires.
+type WatchdogAction string
+
+const (
+	// WatchdogActionReset resets the guest.
+	WatchdogActionReset WatchdogAction = "reset"
+
+	// WatchdogActionShutdown asks the guest to shut down.
+	WatchdogActionShutdown WatchdogAction = "shutdown"
+
+	// WatchdogActionPoweroff makes qemu exit.
+	WatchdogActionPoweroff WatchdogAction = "poweroff"
+
+	// WatchdogActionPause pauses the guest, in the watchdog run state.
+	WatchdogActionPause WatchdogAction = "pause"
+
+	// WatchdogActionDebug prints a debug message and lets the guest run.
+	WatchdogActionDebug WatchdogAction = "debug"
+
+	// WatchdogActionNone only reports the expiration.
+	WatchdogActionNone WatchdogAction = "none"
+
+	// WatchdogActionInjectNMI injects a non maskable interrupt in the
+	// guest.
+	WatchdogActionInjectNMI WatchdogAction = "inject-nmi"
+)
+
+// Actions are the actions taken by qemu on guest lifecycle events.  Empty
+// actions keep the qemu defaults.  The actions can be changed while qemu
+// runs with QMP.ExecuteSetAction.
+type Actions struct {
+	// Reboot is the action taken when the guest reboots.
+	Reboot RebootAction
+
+	// Shutdown is the action taken when the guest shuts down.
+	Shutdown ShutdownAction
+
+	// Panic is the action taken when the guest panics.  qemu only knows
+	// about the guest panics through a panic device, e.g. PVPanicDevice.
+	Panic PanicAction
+
+	// Watchdog is the action taken when the watchdog of the guest, e.g.
+	// a WatchdogDevice, expires.
+	Watchdog WatchdogAction
+}
+
+// params returns the option=action parameters of the actions which are set.
+func (actions Actions) params() []string {
+	var params []string
+
+	if actions.Reboot != "" {
+		params = append(params, fmt.Sprintf("reboot=%s", actions.Reboot))
+	}
+	if actions.Shutdown != "" {
+		params = append(params, fmt.Sprintf("shutdown=%s", actions.Shutdown))
+	}
+	if actions.Panic != "" {
+		params = append(params, fmt.Sprintf("panic=%s", actions.Panic))
+	}
+	if actions.Watchdog != "" {
+		params = append(params, fmt.Sprintf("watchdog=%s", actions.Watchdog))
+	}
+
+	return params
+}
+
 // Config is the qemu configuration structure.
 // It allows for passing custom settings and parameters to the qemu API.
 type Config struct {
@@ -2566,12 +4243,18 @@ type Config struct {
 	// SMP is the quest multi processors configuration.
 	SMP SMP
 
+	// NUMA is the guest NUMA topology configuration.
+	NUMA NUMA
+
 	// GlobalParam is the -global parameter.
 	GlobalParam string
 
 	// Knobs is a set of qemu boolean settings.
 	Knobs Knobs
 
+	// Actions are the actions taken on guest lifecycle events.
+	Actions Actions
+
 	// Bios is the -bios parameter
 	Bios string
 
@@ -2595,6 +4278,29 @@ type Config struct {
 	// LogFile is the -D parameter
 	LogFile string
 
+	// MsgTimestamp prefixes the messages of qemu with a timestamp.
+	MsgTimestamp bool
+
+	// Stderr receives the standard error of qemu line by line, while qemu
+	// runs.
+	Stderr io.Writer
+
+	// StderrFunc is called with each parsed line of the standard error of
+	// qemu, while qemu runs.
+	StderrFunc func(StderrLine)
+
+	// LogStderr writes each line of the standard error of qemu, while qemu
+	// runs, to the logger passed to LaunchQemu or StartQemu.
+	LogStderr bool
+
+	// Strict makes LaunchQemu refuse the configuration if Validate
+	// reports it as invalid, rather than skipping the invalid entries.
+	Strict bool
+
+	// SkipDeviceErrors makes LaunchQemu log and skip the devices whose
+	// parameters cannot be built, rather than failing.
+	SkipDeviceErrors bool
+
 	qemuParams []string
 }
 
@@ -2677,14 +4383,125 @@ func (config *Config) appendQMPSockets() {
 	}
 }
 
-func (config *Config) appendDevices() {
+// appendDevices appends the parameters of the valid devices.  An error is
+// returned if the parameters of a device cannot be built, unless
+// config.SkipDeviceErrors is set, in which case the device is logged and
+// skipped.
+func (config *Config) appendDevices(logger QMPLog) error {
+	if logger == nil {
+		logger = qmpNullLogger{}
+	}
+
 	for _, d := range config.Devices {
 		if !d.Valid() {
 			continue
 		}
 
-		config.qemuParams = append(config.qemuParams, d.QemuParams(config)...)
+		params, err := deviceQemuParams(d, config)
+		if err != nil {
+			if !config.SkipDeviceErrors {
+				return fmt.Errorf("invalid device %T: %v", d, err)
+			}
+			logger.Errorf("Skipping device %T: %v", d, err)
+			continue
+		}
+
+		config.qemuParams = append(config.qemuParams, params...)
+	}
+
+	return nil
+}
+
+// DeviceDatabase maps the qemu device drivers to their properties, and the
+// properties to their types.  It can be captured from a qemu instance with
+// CaptureDeviceDatabase.
+type DeviceDatabase map[string]map[string]string
+
+// deviceOptions are the -device options that are not properties of the
+// device driver.
+var deviceOptions = map[string]bool{
+	"driver": true,
+	"id":     true,
+	"bus":    true,
+}
+
+// splitOptions splits a comma separated list of options, where ",," is an
+// escaped comma.
+func splitOptions(s string) []string {
+	var options []string
+	var option strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != ',' {
+			option.WriteByte(s[i])
+		} else if i+1 < len(s) && s[i+1] == ',' {
+			option.WriteByte(',')
+			i++
+		} else {
+			options = append(options, option.String())
+			option.Reset()
+		}
+	}
+
+	return append(options, option.String())
+}
+
+// validateDeviceParam checks the -device parameter param against db.
+func (db DeviceDatabase) validateDeviceParam(param string) []string {
+	var errs []string
+
+	// The driver is either the first option, or set with driver=.
+	options := splitOptions(param)
+	driver := strings.TrimPrefix(options[0], "driver=")
+
+	props, ok := db[driver]
+	if !ok {
+		return append(errs, fmt.Sprintf("unknown device driver %s", driver))
+	}
+
+	for _, o := range options[1:] {
+		name := strings.SplitN(o, "=", 2)[0]
+		if deviceOptions[name] {
+			continue
+		}
+		if _, ok := props[name]; !ok {
+			errs = append(errs, fmt.Sprintf("unknown property %s of device driver %s", name, driver))
+		}
+	}
+
+	return errs
+}
+
+// ValidateDevices checks that the drivers and properties of the -device
+// parameters generated for config.Devices exist in db.  The invalid
+// devices are skipped, as they are not passed to qemu.  The returned error
+// lists all the unknown drivers and properties.
+func (db DeviceDatabase) ValidateDevices(config *Config) error {
+	var errs []string
+
+	// Generating the device parameters may alter the configuration.
+	c := *config
+	c.fds = nil
+	c.qemuParams = nil
+
+	for _, d := range c.Devices {
+		if !d.Valid() {
+			continue
+		}
+
+		params := d.QemuParams(&c)
+		for i := 0; i+1 < len(params); i++ {
+			if params[i] == "-device" {
+				errs = append(errs, db.validateDeviceParam(params[i+1])...)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid devices: %s", strings.Join(errs, "; "))
 	}
+
+	return nil
 }
 
 func (config *Config) appendUUID() {
@@ -2767,6 +4584,13 @@ func (config *Config) appendRTC() {
 	config.qemuParams = append(config.qemuParams, strings.Join(RTCParams, ","))
 }
 
+func (config *Config) appendActions() {
+	if params := config.Actions.params(); len(params) > 0 {
+		config.qemuParams = append(config.qemuParams, "-action")
+		config.qemuParams = append(config.qemuParams, strings.Join(params, ","))
+	}
+}
+
 func (config *Config) appendGlobalParam() {
 	if config.GlobalParam != "" {
 		config.qemuParams = append(config.qemuParams, "-global")
@@ -2786,58 +4610,180 @@ func (config *Config) appendVGA() {
 		config.qemuParams = append(config.qemuParams, "-vga")
 		config.qemuParams = append(config.qemuParams, config.VGA)
 	}
-}
+}
+
+func (config *Config) appendKernel() {
+	if config.Kernel.Path != "" {
+		config.qemuParams = append(config.qemuParams, "-kernel")
+		config.qemuParams = append(config.qemuParams, config.Kernel.Path)
+
+		if config.Kernel.InitrdPath != "" {
+			config.qemuParams = append(config.qemuParams, "-initrd")
+			config.qemuParams = append(config.qemuParams, config.Kernel.InitrdPath)
+		}
+
+		if config.Kernel.Params != "" {
+			config.qemuParams = append(config.qemuParams, "-append")
+			config.qemuParams = append(config.qemuParams, config.Kernel.Params)
+		}
+	}
+}
+
+func (config *Config) appendMemoryKnobs() {
+	if config.Memory.Size == "" || len(config.NUMA.Nodes) > 0 {
+		return
+	}
+	dimmName := "dimm1"
+	backend := MemoryBackend{
+		Type:     MemoryBackendRAM,
+		ID:       dimmName,
+		Size:     config.Memory.Size,
+		Share:    config.Knobs.MemShared,
+		Prealloc: config.Knobs.MemPrealloc,
+	}
+	if config.Knobs.HugePages {
+		backend.Type = MemoryBackendFile
+		backend.MemPath = "/dev/hugepages"
+	} else if config.Knobs.FileBackedMem && config.Memory.Path != "" {
+		backend.Type = MemoryBackendFile
+		backend.MemPath = config.Memory.Path
+	}
+
+	config.qemuParams = append(config.qemuParams, backend.QemuParams(config)...)
+
+	if isDimmSupported(config) {
+		config.qemuParams = append(config.qemuParams, "-numa")
+		config.qemuParams = append(config.qemuParams, "node,memdev="+dimmName)
+	} else {
+		config.qemuParams = append(config.qemuParams, "-machine")
+		config.qemuParams = append(config.qemuParams, "memory-backend="+dimmName)
+	}
+}
+
+func (node NUMANode) backendType() (ObjectType, error) {
+	switch node.Backend {
+	case "", MemoryBackendRAM:
+		if node.HugePages {
+			return "", fmt.Errorf("NUMA node %d: huge pages require a file or memfd backend", node.ID)
+		}
+		return MemoryBackendRAM, nil
+	case MemoryBackendFile:
+		if node.MemPath == "" && !node.HugePages {
+			return "", fmt.Errorf("NUMA node %d: file backend requires a memory path", node.ID)
+		}
+		return MemoryBackendFile, nil
+	case MemoryBackendMemfd:
+		return MemoryBackendMemfd, nil
+	default:
+		return "", fmt.Errorf("NUMA node %d: unsupported memory backend %s", node.ID, node.Backend)
+	}
+}
+
+// memoryBackend returns the memory backend of the node. The memory knobs
+// apply to every node.
+func (node NUMANode) memoryBackend(knobs Knobs) (MemoryBackend, error) {
+	if node.MemorySize == "" {
+		return MemoryBackend{}, fmt.Errorf("NUMA node %d: memory size is required", node.ID)
+	}
+
+	if node.Policy != "" && node.Policy != NUMAPolicyDefault && len(node.HostNodes) == 0 {
+		return MemoryBackend{}, fmt.Errorf("NUMA node %d: policy %s requires host nodes", node.ID, node.Policy)
+	}
+
+	// Memory.Path is a single file, so it cannot back several nodes.
+	if knobs.FileBackedMem {
+		return MemoryBackend{}, fmt.Errorf("NUMA node %d: FileBackedMem is not supported with NUMA nodes, set MemPath instead", node.ID)
+	}
+	if knobs.HugePages {
+		node.HugePages = true
+		if node.Backend == "" {
+			node.Backend = MemoryBackendFile
+		}
+	}
 
-func (config *Config) appendKernel() {
-	if config.Kernel.Path != "" {
-		config.qemuParams = append(config.qemuParams, "-kernel")
-		config.qemuParams = append(config.qemuParams, config.Kernel.Path)
+	backendType, err := node.backendType()
+	if err != nil {
+		return MemoryBackend{}, err
+	}
 
-		if config.Kernel.InitrdPath != "" {
-			config.qemuParams = append(config.qemuParams, "-initrd")
-			config.qemuParams = append(config.qemuParams, config.Kernel.InitrdPath)
-		}
+	backend := MemoryBackend{
+		Type:      backendType,
+		ID:        fmt.Sprintf("ram-node%d", node.ID),
+		Size:      node.MemorySize,
+		MemPath:   node.MemPath,
+		Share:     node.Share || knobs.MemShared,
+		Prealloc:  node.Prealloc || knobs.MemPrealloc,
+		HostNodes: node.HostNodes,
+		Policy:    node.Policy,
+	}
 
-		if config.Kernel.Params != "" {
-			config.qemuParams = append(config.qemuParams, "-append")
-			config.qemuParams = append(config.qemuParams, config.Kernel.Params)
+	if node.HugePages {
+		if backendType == MemoryBackendMemfd {
+			backend.HugeTLB = true
+		} else if backend.MemPath == "" {
+			backend.MemPath = "/dev/hugepages"
 		}
 	}
+
+	if !backend.Valid() {
+		return MemoryBackend{}, fmt.Errorf("NUMA node %d: invalid memory backend %+v", node.ID, backend)
+	}
+
+	return backend, nil
 }
 
-func (config *Config) appendMemoryKnobs() {
-	if config.Memory.Size == "" {
-		return
+func (config *Config) appendNUMANode(node NUMANode) error {
+	backend, err := node.memoryBackend(config.Knobs)
+	if err != nil {
+		return err
 	}
-	var objMemParam, numaMemParam string
-	dimmName := "dimm1"
-	if config.Knobs.HugePages {
-		objMemParam = "memory-backend-file,id=" + dimmName + ",size=" + config.Memory.Size + ",mem-path=/dev/hugepages"
-		numaMemParam = "node,memdev=" + dimmName
-	} else if config.Knobs.FileBackedMem && config.Memory.Path != "" {
-		objMemParam = "memory-backend-file,id=" + dimmName + ",size=" + config.Memory.Size + ",mem-path=" + config.Memory.Path
-		numaMemParam = "node,memdev=" + dimmName
-	} else {
-		objMemParam = "memory-backend-ram,id=" + dimmName + ",size=" + config.Memory.Size
-		numaMemParam = "node,memdev=" + dimmName
+
+	var numaParams []string
+	numaParams = append(numaParams, "node")
+	numaParams = append(numaParams, fmt.Sprintf("nodeid=%d", node.ID))
+	for _, cpus := range node.CPUs {
+		numaParams = append(numaParams, fmt.Sprintf("cpus=%s", cpus))
+	}
+	numaParams = append(numaParams, fmt.Sprintf("memdev=%s", backend.ID))
+
+	config.qemuParams = append(config.qemuParams, backend.QemuParams(config)...)
+	config.qemuParams = append(config.qemuParams, "-numa")
+	config.qemuParams = append(config.qemuParams, strings.Join(numaParams, ","))
+
+	return nil
+}
+
+func (config *Config) appendNUMA() error {
+	if len(config.NUMA.Nodes) == 0 {
+		return nil
 	}
 
-	if config.Knobs.MemShared {
-		objMemParam += ",share=on"
+	if !isDimmSupported(config) {
+		return fmt.Errorf("NUMA is not supported on this machine")
 	}
-	if config.Knobs.MemPrealloc {
-		objMemParam += ",prealloc=on"
+
+	nodes := make(map[uint32]bool)
+	for _, node := range config.NUMA.Nodes {
+		if nodes[node.ID] {
+			return fmt.Errorf("duplicate NUMA node %d", node.ID)
+		}
+		nodes[node.ID] = true
+
+		if err := config.appendNUMANode(node); err != nil {
+			return err
+		}
 	}
-	config.qemuParams = append(config.qemuParams, "-object")
-	config.qemuParams = append(config.qemuParams, objMemParam)
 
-	if isDimmSupported(config) {
+	for _, d := range config.NUMA.Distances {
+		if !nodes[d.Src] || !nodes[d.Dst] {
+			return fmt.Errorf("NUMA distance between unknown nodes %d and %d", d.Src, d.Dst)
+		}
+
 		config.qemuParams = append(config.qemuParams, "-numa")
-		config.qemuParams = append(config.qemuParams, numaMemParam)
-	} else {
-		config.qemuParams = append(config.qemuParams, "-machine")
-		config.qemuParams = append(config.qemuParams, "memory-backend="+dimmName)
+		config.qemuParams = append(config.qemuParams, fmt.Sprintf("dist,src=%d,dst=%d,val=%d", d.Src, d.Dst, d.Value))
 	}
+
+	return nil
 }
 
 func (config *Config) appendKnobs() {
@@ -2886,9 +4832,8 @@ func (config *Config) appendBios() {
 
 func (config *Config) appendIOThreads() {
 	for _, t := range config.IOThreads {
-		if t.ID != "" {
-			config.qemuParams = append(config.qemuParams, "-object")
-			config.qemuParams = append(config.qemuParams, fmt.Sprintf("iothread,id=%s", t.ID))
+		if t.Valid() {
+			config.qemuParams = append(config.qemuParams, t.QemuParams(config)...)
 		}
 	}
 }
@@ -2923,6 +4868,13 @@ func (config *Config) appendLogFile() {
 	}
 }
 
+func (config *Config) appendMsg() {
+	if config.MsgTimestamp {
+		config.qemuParams = append(config.qemuParams, "-msg")
+		config.qemuParams = append(config.qemuParams, "timestamp=on")
+	}
+}
+
 func (config *Config) appendFwCfg(logger QMPLog) {
 	if logger == nil {
 		logger = qmpNullLogger{}
@@ -2938,55 +4890,494 @@ func (config *Config) appendFwCfg(logger QMPLog) {
 	}
 }
 
+// ConfigError describes an invalid field of a Config.
+type ConfigError struct {
+	// Field is the name of the invalid field, e.g. Devices[2].
+	Field string
+
+	// Reason explains why the field is invalid.
+	Reason string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// ConfigErrors is the error returned by Config.Validate.  It lists all the
+// invalid fields of the configuration.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+func (e *ConfigErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// idOptions are the qemu options taking an id= property.  Each option has
+// its own ID namespace.
+var idOptions = map[string]bool{
+	"-device":  true,
+	"-object":  true,
+	"-netdev":  true,
+	"-chardev": true,
+	"-fsdev":   true,
+}
+
+// parseGuestMemorySize parses a -m memory size, which is in megabytes when
+// it has no suffix.
+func parseGuestMemorySize(size string) (uint64, error) {
+	if size != "" && size[len(size)-1] >= '0' && size[len(size)-1] <= '9' {
+		size += "M"
+	}
+
+	return parseMemorySize(size)
+}
+
+// Validate checks the configuration, and returns a ConfigErrors listing
+// all its invalid fields, or nil if the configuration is valid.  The
+// invalid devices, QMP sockets and fw_cfg entries are skipped when the qemu
+// parameters are generated, and most inconsistencies between fields are
+// only reported by qemu, if at all.
+func (config *Config) Validate() error {
+	var errs ConfigErrors
+
+	config.validateSMP(&errs)
+	config.validateMemory(&errs)
+	config.validateKnobs(&errs)
+	config.validateActions(&errs)
+	config.validateQMPSockets(&errs)
+	config.validateFwCfg(&errs)
+	config.validateDevices(&errs)
+	config.validateNUMA(&errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (config *Config) validateSMP(errs *ConfigErrors) {
+	smp := config.SMP
+
+	if smp.CPUs == 0 {
+		if smp.Cores > 0 || smp.Threads > 0 || smp.Sockets > 0 || smp.MaxCPUs > 0 {
+			errs.add("SMP.CPUs", "must be set along with the CPU topology")
+		}
+		return
+	}
+
+	maxCPUs := smp.CPUs
+	if smp.MaxCPUs > 0 {
+		if smp.MaxCPUs < smp.CPUs {
+			errs.add("SMP.MaxCPUs", "%d is lower than CPUs %d", smp.MaxCPUs, smp.CPUs)
+		}
+		maxCPUs = smp.MaxCPUs
+	}
+
+	if smp.Sockets > 0 && smp.Cores > 0 && smp.Threads > 0 {
+		if total := smp.Sockets * smp.Cores * smp.Threads; total != maxCPUs {
+			errs.add("SMP", "%d sockets, %d cores and %d threads make %d CPUs, not %d",
+				smp.Sockets, smp.Cores, smp.Threads, total, maxCPUs)
+		}
+	}
+}
+
+func (config *Config) validateMemory(errs *ConfigErrors) {
+	mem := config.Memory
+
+	if mem.Size == "" {
+		if mem.Slots > 0 || mem.MaxMem != "" {
+			errs.add("Memory.Size", "must be set along with Slots and MaxMem")
+		}
+		return
+	}
+
+	size, err := parseGuestMemorySize(mem.Size)
+	if err != nil {
+		errs.add("Memory.Size", "%v", err)
+	}
+
+	if mem.Slots > 0 && !isDimmSupported(config) {
+		errs.add("Memory.Slots", "memory hotplug is not supported on this machine")
+	}
+
+	if mem.MaxMem == "" {
+		if mem.Slots > 0 {
+			errs.add("Memory.MaxMem", "must be set for memory hotplug")
+		}
+		return
+	}
+
+	if mem.Slots == 0 {
+		errs.add("Memory.Slots", "must be set for memory hotplug")
+	}
+
+	maxMem, maxErr := parseGuestMemorySize(mem.MaxMem)
+	if maxErr != nil {
+		errs.add("Memory.MaxMem", "%v", maxErr)
+	} else if err == nil && maxMem < size {
+		errs.add("Memory.MaxMem", "%s is lower than Size %s", mem.MaxMem, mem.Size)
+	}
+}
+
+func (config *Config) validateKnobs(errs *ConfigErrors) {
+	if config.Memory.Size == "" {
+		knobs := []struct {
+			name string
+			set  bool
+		}{
+			{"HugePages", config.Knobs.HugePages},
+			{"MemPrealloc", config.Knobs.MemPrealloc},
+			{"FileBackedMem", config.Knobs.FileBackedMem},
+			{"MemShared", config.Knobs.MemShared},
+		}
+
+		for _, k := range knobs {
+			if k.set {
+				errs.add("Knobs."+k.name, "requires Memory.Size")
+			}
+		}
+	}
+
+	if config.Knobs.FileBackedMem && config.Memory.Path == "" {
+		errs.add("Knobs.FileBackedMem", "requires Memory.Path")
+	}
+}
+
+func (config *Config) validateActions(errs *ConfigErrors) {
+	actions := config.Actions
+
+	switch actions.Reboot {
+	case "", RebootActionShutdown:
+	case RebootActionReset:
+		if config.Knobs.NoReboot {
+			errs.add("Actions.Reboot", "conflicts with Knobs.NoReboot")
+		}
+	default:
+		errs.add("Actions.Reboot", "unknown action %s", actions.Reboot)
+	}
+
+	switch actions.Shutdown {
+	case "", ShutdownActionPause:
+	case ShutdownActionPoweroff:
+		if config.Knobs.NoShutdown {
+			errs.add("Actions.Shutdown", "conflicts with Knobs.NoShutdown")
+		}
+	default:
+		errs.add("Actions.Shutdown", "unknown action %s", actions.Shutdown)
+	}
+
+	switch actions.Panic {
+	case "", PanicActionPause, PanicActionShutdown, PanicActionExitFailure, PanicActionNone:
+	default:
+		errs.add("Actions.Panic", "unknown action %s", actions.Panic)
+	}
+
+	switch actions.Watchdog {
+	case "", WatchdogActionReset, WatchdogActionShutdown, WatchdogActionPoweroff, WatchdogActionPause,
+		WatchdogActionDebug, WatchdogActionNone, WatchdogActionInjectNMI:
+	default:
+		errs.add("Actions.Watchdog", "unknown action %s", actions.Watchdog)
+	}
+}
+
+func (config *Config) validateQMPSockets(errs *ConfigErrors) {
+	for i, q := range config.QMPSockets {
+		field := fmt.Sprintf("QMPSockets[%d]", i)
+
+		switch {
+		case q.Type == "":
+			errs.add(field, "Type is not set")
+		case q.Type != Unix:
+			errs.add(field, "unsupported socket type %s", q.Type)
+		case q.Name == "":
+			errs.add(field, "Name is not set")
+		}
+	}
+}
+
+func (config *Config) validateFwCfg(errs *ConfigErrors) {
+	names := make(map[string]bool)
+
+	for i, f := range config.FwCfg {
+		field := fmt.Sprintf("FwCfg[%d]", i)
+
+		switch {
+		case f.Name == "":
+			errs.add(field, "Name is not set")
+		case f.File != "" && f.Str != "":
+			errs.add(field, "File and Str are mutually exclusive")
+		case f.File == "" && f.Str == "":
+			errs.add(field, "one of File or Str must be set")
+		case names[f.Name]:
+			errs.add(field, "duplicate name %s", f.Name)
+		}
+
+		names[f.Name] = true
+	}
+}
+
+// validatingDevice is implemented by the devices able to explain why they
+// are not valid.
+type validatingDevice interface {
+	validate() error
+}
+
+// validateDevice returns an error describing why the device d is not valid,
+// or nil if it is valid.
+func validateDevice(d Device) error {
+	if v, ok := d.(validatingDevice); ok {
+		return v.validate()
+	}
+
+	if !d.Valid() {
+		return fmt.Errorf("not valid and complete")
+	}
+
+	return nil
+}
+
+func (config *Config) validateDevices(errs *ConfigErrors) {
+	// Generating the device parameters may alter the configuration.
+	c := *config
+	c.fds = nil
+	c.qemuParams = nil
+
+	ids := make(map[string]string)
+
+	for i, d := range c.Devices {
+		field := fmt.Sprintf("Devices[%d]", i)
+
+		// NetDevice.Valid rejects the VFIO and vhost-user types, so
+		// their transport is checked first to report why it is not
+		// supported.
+		if err := checkNetTransport(d, &c); err != nil {
+			errs.add(field, "%v", err)
+			continue
+		}
+
+		if err := validateDevice(d); err != nil {
+			errs.add(field, "invalid %T: %v", d, err)
+			continue
+		}
+
+		params, err := deviceQemuParams(d, &c)
+		if err != nil {
+			errs.add(field, "%v", err)
+			continue
+		}
+
+		c.validateParams(field, params, ids, errs)
+	}
+
+	for i, t := range c.IOThreads {
+		field := fmt.Sprintf("IOThreads[%d]", i)
+		if err := t.validate(); err != nil {
+			errs.add(field, "%v", err)
+			continue
+		}
+
+		c.validateParams(field, t.QemuParams(&c), ids, errs)
+	}
+}
+
+// checkNetTransport returns an error if d is a NetDevice whose type cannot
+// be used with its transport.
+func checkNetTransport(d Device, config *Config) error {
+	var netdev NetDevice
+	switch n := d.(type) {
+	case NetDevice:
+		netdev = n
+	case *NetDevice:
+		netdev = *n
+	default:
+		return nil
+	}
+
+	transport := netdev.Transport
+	if transport == "" {
+		transport = transport.defaultTransport(config)
+	}
+
+	return netdev.Type.checkTransport(transport)
+}
+
+// validateParams checks that the IDs set in the qemu parameters params
+// generated for field are not already used, and that the transport of the
+// devices is supported by the machine.
+func (config *Config) validateParams(field string, params []string, ids map[string]string, errs *ConfigErrors) {
+	for i := 0; i+1 < len(params); i++ {
+		option := params[i]
+		if !idOptions[option] {
+			continue
+		}
+
+		values := splitOptions(params[i+1])
+		for _, v := range values {
+			id := strings.TrimPrefix(v, "id=")
+			if id == v {
+				continue
+			}
+
+			key := option + " " + id
+			if other, ok := ids[key]; ok {
+				errs.add(field, "%s id %s is already used by %s", option, id, other)
+			} else {
+				ids[key] = field
+			}
+		}
+
+		if option == "-device" {
+			driver := strings.TrimPrefix(values[0], "driver=")
+			if reason := config.transportMismatch(driver); reason != "" {
+				errs.add(field, "%s", reason)
+			}
+		}
+	}
+}
+
+// transportMismatch returns why the device driver cannot be used with the
+// machine type, or an empty string if it can.
+func (config *Config) transportMismatch(driver string) string {
+	machine := config.Machine.Type
+	if machine == "" {
+		return ""
+	}
+
+	virtio := strings.HasPrefix(driver, "virtio-") || strings.HasPrefix(driver, "vhost-")
+
+	switch {
+	case virtio && strings.HasSuffix(driver, "-ccw") && !strings.HasPrefix(machine, "s390-ccw-virtio"):
+		return fmt.Sprintf("CCW device %s is not supported by machine %s", driver, machine)
+	case virtio && strings.HasSuffix(driver, "-device") && machine != MachineTypeMicrovm && !strings.HasPrefix(machine, "virt"):
+		return fmt.Sprintf("MMIO device %s is not supported by machine %s", driver, machine)
+	case strings.HasSuffix(driver, "-pci") && machine == MachineTypeMicrovm && !strings.Contains(config.Machine.Options, "pcie=on"):
+		return fmt.Sprintf("PCI device %s requires pcie=on on machine %s", driver, machine)
+	}
+
+	return ""
+}
+
+func (config *Config) validateNUMA(errs *ConfigErrors) {
+	c := *config
+	c.qemuParams = nil
+
+	if err := c.appendNUMA(); err != nil {
+		errs.add("NUMA", "%v", err)
+	}
+}
+
+// Build returns the qemu parameters built out of the configuration, without
+// the qemu binary path, along with the files to pass to qemu.  The files are
+// referenced in the parameters as file descriptors 3 and above, in the order
+// they are returned.  If config.Strict is set, the configuration is checked
+// with Validate and an invalid configuration is refused.
+//
+// The configuration is not modified, so Build can be called several times,
+// e.g. to log the qemu command line before launching qemu.
+func (config *Config) Build() (args []string, fds []*os.File, err error) {
+	return config.build(nil)
+}
+
+func (config *Config) build(logger QMPLog) ([]string, []*os.File, error) {
+	if config.Strict {
+		if err := config.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	c := *config
+	c.qemuParams = nil
+	c.fds = nil
+
+	c.appendName()
+	c.appendUUID()
+	c.appendMachine()
+	c.appendCPUModel()
+	c.appendQMPSockets()
+	c.appendMemory()
+	if err := c.appendDevices(logger); err != nil {
+		return nil, nil, err
+	}
+	c.appendRTC()
+	c.appendGlobalParam()
+	c.appendPFlashParam()
+	c.appendVGA()
+	c.appendKnobs()
+	c.appendActions()
+	c.appendKernel()
+	c.appendBios()
+	c.appendIOThreads()
+	c.appendIncoming()
+	c.appendPidFile()
+	c.appendLogFile()
+	c.appendMsg()
+	c.appendFwCfg(logger)
+	c.appendSeccompSandbox()
+
+	if err := c.appendCPUs(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.appendNUMA(); err != nil {
+		return nil, nil, err
+	}
+
+	return c.qemuParams, c.fds, nil
+}
+
 // LaunchQemu can be used to launch a new qemu instance.
 //
-// The Config parameter contains a set of qemu parameters and settings.
+// The Config parameter contains a set of qemu parameters and settings,
+// which are turned into the qemu command line by Config.Build.
 //
-// This function writes its log output via logger parameter.
+// This function writes its log output via logger parameter.  The standard
+// error of qemu is streamed to config.Stderr, config.StderrFunc and, with
+// config.LogStderr, to logger while qemu runs.
 //
 // The function will block until the launched qemu process exits.  "", nil
 // will be returned if the launch succeeds.  Otherwise a string containing
 // the contents of stderr + a Go error object will be returned.
 func LaunchQemu(config Config, logger QMPLog) (string, error) {
-	config.appendName()
-	config.appendUUID()
-	config.appendMachine()
-	config.appendCPUModel()
-	config.appendQMPSockets()
-	config.appendMemory()
-	config.appendDevices()
-	config.appendRTC()
-	config.appendGlobalParam()
-	config.appendPFlashParam()
-	config.appendVGA()
-	config.appendKnobs()
-	config.appendKernel()
-	config.appendBios()
-	config.appendIOThreads()
-	config.appendIncoming()
-	config.appendPidFile()
-	config.appendLogFile()
-	config.appendFwCfg(logger)
-	config.appendSeccompSandbox()
-
-	if err := config.appendCPUs(); err != nil {
+	args, fds, err := config.build(logger)
+	if err != nil {
 		return "", err
 	}
 
-	ctx := config.Ctx
-	if ctx == nil {
-		ctx = context.Background()
+	if logger == nil {
+		logger = qmpNullLogger{}
 	}
 
-	attr := syscall.SysProcAttr{}
-	attr.Credential = &syscall.Credential{
-		Uid:    config.Uid,
-		Gid:    config.Gid,
-		Groups: config.Groups,
+	return launchQemu(config.context(), config.Path, args, fds, config.sysProcAttr(), logger,
+		config.stderrWriter(logger))
+}
+
+// context returns the context of the qemu process.
+func (config *Config) context() context.Context {
+	if config.Ctx == nil {
+		return context.Background()
 	}
 
-	return LaunchCustomQemu(ctx, config.Path, config.qemuParams,
-		config.fds, &attr, logger)
+	return config.Ctx
+}
+
+// sysProcAttr returns the attributes of the qemu process.
+func (config *Config) sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    config.Uid,
+			Gid:    config.Gid,
+			Groups: config.Groups,
+		},
+	}
 }
 
 // LaunchCustomQemu can be used to launch a new qemu instance.
@@ -3010,8 +5401,41 @@ func LaunchCustomQemu(ctx context.Context, path string, params []string, fds []*
 		logger = qmpNullLogger{}
 	}
 
+	return launchQemu(ctx, path, params, fds, attr, logger, nil)
+}
+
+// launchQemu launches qemu like LaunchCustomQemu, and writes its standard
+// error to out while it runs, if out is not nil.
+func launchQemu(ctx context.Context, path string, params []string, fds []*os.File,
+	attr *syscall.SysProcAttr, logger QMPLog, out *stderrWriter) (string, error) {
 	errStr := ""
 
+	cmd := qemuCommand(ctx, path, params, fds, attr, logger)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if out != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, out)
+	}
+	logger.Infof("launching %s with: %v", cmd.Args[0], params)
+
+	err := cmd.Run()
+	if out != nil {
+		out.Flush()
+	}
+	if err != nil {
+		logger.Errorf("Unable to launch %s: %v", cmd.Args[0], err)
+		errStr = stderr.String()
+		logger.Errorf("%s", errStr)
+	}
+	return errStr, err
+}
+
+// qemuCommand returns the command running the qemu binary path with the
+// parameters params, the files fds and the attributes attr.  The default
+// qemu binary is used if path is empty.
+func qemuCommand(ctx context.Context, path string, params []string, fds []*os.File,
+	attr *syscall.SysProcAttr, logger QMPLog) *exec.Cmd {
 	if path == "" {
 		path = "qemu-system-x86_64"
 	}
@@ -3025,15 +5449,5 @@ func LaunchCustomQemu(ctx context.Context, path string, params []string, fds []*
 
 	cmd.SysProcAttr = attr
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	logger.Infof("launching %s with: %v", path, params)
-
-	err := cmd.Run()
-	if err != nil {
-		logger.Errorf("Unable to launch %s: %v", path, err)
-		errStr = stderr.String()
-		logger.Errorf("%s", errStr)
-	}
-	return errStr, err
+	return cmd
 }
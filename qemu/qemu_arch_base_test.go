@@ -100,6 +100,11 @@ func TestAppendVirtioBalloon(t *testing.T) {
 	balloonDevice.DisableModern = true
 	testAppend(balloonDevice, deviceString+OnDeflateOnOMM+OnDisableModern, t)
 
+	balloonDevice.FreePageReporting = true
+	balloonDevice.FreePageHint = true
+	balloonDevice.StatsPollingInterval = 2
+	var freePageOptions = ",free-page-reporting=on,free-page-hint=on,guest-stats-polling-interval=2"
+	testAppend(balloonDevice, deviceString+OnDeflateOnOMM+freePageOptions+OnDisableModern, t)
 }
 
 func TestAppendDevicePCIeRootPort(t *testing.T) {
@@ -51,7 +51,7 @@ func testConfigAppend(config *Config, structure interface{}, expected string, t
 
 	case Device:
 		config.Devices = []Device{s}
-		config.appendDevices()
+		config.appendDevices(nil)
 
 	case Knobs:
 		config.Knobs = s
@@ -71,6 +71,12 @@ func testConfigAppend(config *Config, structure interface{}, expected string, t
 			t.Fatalf("Unexpected error: %v", err)
 		}
 
+	case NUMA:
+		config.NUMA = s
+		if err := config.appendNUMA(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
 	case QMPSocket:
 		config.QMPSockets = []QMPSocket{s}
 		config.appendQMPSockets()
@@ -89,6 +95,10 @@ func testConfigAppend(config *Config, structure interface{}, expected string, t
 	case Incoming:
 		config.Incoming = s
 		config.appendIncoming()
+
+	case Actions:
+		config.Actions = s
+		config.appendActions()
 	}
 
 	result := strings.Join(config.qemuParams, " ")
@@ -157,6 +167,268 @@ func TestAppendEPCObject(t *testing.T) {
 	testAppend(object, objectEPCString, t)
 }
 
+var memoryBackendString = "-object memory-backend-memfd,id=mem0,size=1G,share=on,prealloc=on,hugetlb=on,hugetlbsize=2097152,merge=off,dump=off,seal=on,host-nodes=0-1,host-nodes=3,policy=interleave"
+
+func testMemoryBackend() MemoryBackend {
+	off := false
+	on := true
+
+	return MemoryBackend{
+		Type:        MemoryBackendMemfd,
+		ID:          "mem0",
+		Size:        "1G",
+		Share:       true,
+		Prealloc:    true,
+		HugeTLB:     true,
+		HugeTLBSize: 2 << 20,
+		Merge:       &off,
+		Dump:        &off,
+		Seal:        &on,
+		HostNodes:   []uint32{0, 1, 3},
+		Policy:      NUMAPolicyInterleave,
+	}
+}
+
+func TestAppendMemoryBackend(t *testing.T) {
+	testAppend(testMemoryBackend(), memoryBackendString, t)
+
+	backend := MemoryBackend{
+		Type:        MemoryBackendFile,
+		ID:          "mem1",
+		Size:        "512M",
+		MemPath:     "/dev/shm/mem1",
+		ReadOnly:    true,
+		DiscardData: true,
+	}
+	testAppend(backend, "-object memory-backend-file,id=mem1,size=512M,mem-path=/dev/shm/mem1,readonly=on,discard-data=on", t)
+
+	backend = MemoryBackend{
+		Type:    MemoryBackendFile,
+		ID:      "mem2",
+		Size:    "1G",
+		MemPath: "/var/lib/vm,1/mem",
+	}
+	testAppend(backend, "-object memory-backend-file,id=mem2,size=1G,mem-path=/var/lib/vm,,1/mem", t)
+}
+
+func TestMemoryBackendQMPArgs(t *testing.T) {
+	expected := map[string]interface{}{
+		"qom-type":    "memory-backend-memfd",
+		"id":          "mem0",
+		"size":        uint64(1 << 30),
+		"share":       true,
+		"prealloc":    true,
+		"hugetlb":     true,
+		"hugetlbsize": uint64(2 << 20),
+		"merge":       false,
+		"dump":        false,
+		"seal":        true,
+		"host-nodes":  []uint32{0, 1, 3},
+		"policy":      "interleave",
+	}
+
+	args, err := testMemoryBackend().QMPArgs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v equals to %v", args, expected)
+	}
+}
+
+func TestMemoryBackendValid(t *testing.T) {
+	backends := []MemoryBackend{
+		{Type: MemoryBackendRAM, ID: "mem0"},
+		{Type: MemoryBackendRAM, Size: "1G"},
+		{Type: MemoryBackendRAM, ID: "mem0", Size: "1X"},
+		{Type: MemoryBackendEPC, ID: "mem0", Size: "1G"},
+		{Type: MemoryBackendFile, ID: "mem0", Size: "1G"},
+		{Type: MemoryBackendRAM, ID: "mem0", Size: "1G", ReadOnly: true},
+		{Type: MemoryBackendFile, ID: "mem0", Size: "1G", MemPath: "/dev/shm/mem0", HugeTLB: true},
+		{Type: MemoryBackendRAM, ID: "mem0", Size: "1G", Policy: NUMAPolicyBind},
+	}
+
+	for _, b := range backends {
+		if b.Valid() {
+			t.Fatalf("Expected %+v to be invalid", b)
+		}
+	}
+
+	if !testMemoryBackend().Valid() {
+		t.Fatalf("Expected %+v to be valid", testMemoryBackend())
+	}
+}
+
+func TestAppendObjectSpecs(t *testing.T) {
+	verifyPeer := false
+	specs := []struct {
+		spec   ObjectSpec
+		params string
+		args   map[string]interface{}
+	}{
+		{
+			spec:   IOThread{ID: "iothread0"},
+			params: "-object iothread,id=iothread0",
+			args: map[string]interface{}{
+				"qom-type": "iothread",
+				"id":       "iothread0",
+			},
+		},
+		{
+			spec:   ThrottleGroup{ID: "limits0", IOPSTotal: 1000, BPSWrite: 1 << 20},
+			params: "-object throttle-group,id=limits0,limits.iops-total=1000,limits.bps-write=1048576",
+			args: map[string]interface{}{
+				"qom-type": "throttle-group",
+				"id":       "limits0",
+				"limits": map[string]interface{}{
+					"iops-total": uint64(1000),
+					"bps-write":  uint64(1 << 20),
+				},
+			},
+		},
+		{
+			spec:   Object{Type: MemoryBackendEPC, ID: "epc0", Size: 1 << 20, Prealloc: true},
+			params: "-object memory-backend-epc,id=epc0,size=1048576,prealloc=on",
+			args: map[string]interface{}{
+				"qom-type": "memory-backend-epc",
+				"id":       "epc0",
+				"size":     uint64(1 << 20),
+				"prealloc": true,
+			},
+		},
+		{
+			spec:   Secret{ID: "sec0", Data: "pass,word", Format: SecretFormatRaw},
+			params: "-object secret,id=sec0,data=pass,,word,format=raw",
+			args: map[string]interface{}{
+				"qom-type": "secret",
+				"id":       "sec0",
+				"data":     "pass,word",
+				"format":   "raw",
+			},
+		},
+		{
+			spec: TLSCreds{
+				Type:       TLSCredsX509,
+				ID:         "tls0",
+				Dir:        "/etc/pki/qemu",
+				Endpoint:   TLSEndpointClient,
+				VerifyPeer: &verifyPeer,
+				PasswordID: "sec0",
+			},
+			params: "-object tls-creds-x509,id=tls0,dir=/etc/pki/qemu,endpoint=client,verify-peer=off,passwordid=sec0",
+			args: map[string]interface{}{
+				"qom-type":    "tls-creds-x509",
+				"id":          "tls0",
+				"dir":         "/etc/pki/qemu",
+				"endpoint":    "client",
+				"verify-peer": false,
+				"passwordid":  "sec0",
+			},
+		},
+		{
+			spec:   RngBackend{Type: RngEgd, ID: "rng0", Chardev: "egd0"},
+			params: "-object rng-egd,id=rng0,chardev=egd0",
+			args: map[string]interface{}{
+				"qom-type": "rng-egd",
+				"id":       "rng0",
+				"chardev":  "egd0",
+			},
+		},
+	}
+
+	for _, s := range specs {
+		if !s.spec.Valid() {
+			t.Fatalf("Expected %+v to be valid", s.spec)
+		}
+
+		testAppend(s.spec, s.params, t)
+
+		args, err := s.spec.QMPArgs()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(args, s.args) {
+			t.Fatalf("Expected %v equals to %v", args, s.args)
+		}
+	}
+}
+
+func TestObjectSpecsValid(t *testing.T) {
+	specs := []ObjectSpec{
+		IOThread{},
+		ThrottleGroup{},
+		Secret{ID: "sec0"},
+		Secret{ID: "sec0", Data: "password", File: "/etc/password"},
+		TLSCreds{Type: TLSCredsX509, ID: "tls0"},
+		TLSCreds{Type: TLSCredsPSK, ID: "tls0", Dir: "/etc/pki/qemu", Endpoint: "peer"},
+		TLSCreds{Type: SecretObject, ID: "tls0"},
+		RngBackend{Type: RngEgd, ID: "rng0"},
+		RngBackend{Type: RngBuiltin, ID: "rng0", Filename: "/dev/urandom"},
+	}
+
+	for _, s := range specs {
+		if s.Valid() {
+			t.Fatalf("Expected %+v to be invalid", s)
+		}
+	}
+}
+
+func TestObjectQMPArgs(t *testing.T) {
+	object := Object{
+		Driver:   NVDIMM,
+		Type:     MemoryBackendFile,
+		DeviceID: "nv0",
+		ID:       "mem0",
+		MemPath:  "/root",
+		Size:     1 << 30,
+	}
+	expected := map[string]interface{}{
+		"qom-type": "memory-backend-file",
+		"id":       "mem0",
+		"mem-path": "/root",
+		"size":     uint64(1 << 30),
+	}
+
+	args, err := object.QMPArgs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v equals to %v", args, expected)
+	}
+
+	object = Object{Type: SEVGuest, ID: "sev0", File: "/dev/sev", CBitPos: 47, ReducedPhysBits: 1}
+	if _, err = object.QMPArgs(); err == nil {
+		t.Fatalf("Expected an error for %+v", object)
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	sizes := map[string]uint64{
+		"4096": 4096,
+		"64K":  64 << 10,
+		"128m": 128 << 20,
+		"2G":   2 << 30,
+		"1T":   1 << 40,
+	}
+
+	for s, expected := range sizes {
+		size, err := parseMemorySize(s)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", s, err)
+		}
+		if size != expected {
+			t.Fatalf("Expected %s to be %d bytes, got %d", s, expected, size)
+		}
+	}
+
+	for _, s := range []string{"", "G", "1.5G", "-1M", "99999999999T"} {
+		if _, err := parseMemorySize(s); err == nil {
+			t.Fatalf("Expected %q to be invalid", s)
+		}
+	}
+}
+
 func TestAppendDeviceFS(t *testing.T) {
 	fsdev := FSDevice{
 		Driver:        Virtio9P,
@@ -362,6 +634,46 @@ func TestAppendDeviceBlock(t *testing.T) {
 	testAppend(blkdev, deviceBlockString, t)
 }
 
+func TestAppendDeviceBlockNodeName(t *testing.T) {
+	blkdev := BlockDevice{
+		Driver:        VirtioBlock,
+		ID:            "hd0",
+		File:          "/var/lib/vm.img",
+		AIO:           Threads,
+		Format:        QCOW2,
+		Interface:     NoInterface,
+		DisableModern: true,
+		ROMFile:       romfile,
+		ShareRW:       true,
+		ReadOnly:      true,
+		NodeName:      "hd0-qcow2",
+	}
+	if blkdev.Transport.isVirtioCCW(nil) {
+		blkdev.DevNo = DevNo
+	}
+	testAppend(blkdev, deviceBlockString+",node-name=hd0-qcow2", t)
+}
+
+func TestAppendDeviceBlockIOThread(t *testing.T) {
+	blkdev := BlockDevice{
+		Driver:        VirtioBlock,
+		ID:            "hd0",
+		File:          "/var/lib/vm.img",
+		AIO:           Threads,
+		Format:        QCOW2,
+		Interface:     NoInterface,
+		DisableModern: true,
+		ROMFile:       romfile,
+		ShareRW:       true,
+		ReadOnly:      true,
+		IOThread:      "iothread0",
+	}
+	if blkdev.Transport.isVirtioCCW(nil) {
+		blkdev.DevNo = DevNo
+	}
+	testAppend(blkdev, strings.Replace(deviceBlockString, ",share-rw=on", ",share-rw=on,iothread=iothread0", 1), t)
+}
+
 func TestAppendDeviceVFIO(t *testing.T) {
 	vfioDevice := VFIODevice{
 		BDF:      "02:10.0",
@@ -472,6 +784,111 @@ func TestVirtioRngValid(t *testing.T) {
 
 }
 
+var deviceVirtioMemString = "-device virtio-mem-pci,id=vm0,memdev=vmem0,node=1,block-size=2M,requested-size=1G,bus=pcie.0,addr=0x5"
+
+func TestAppendVirtioMemDevice(t *testing.T) {
+	node := uint32(1)
+	dev := VirtioMemDevice{
+		ID:            "vm0",
+		MemDev:        "vmem0",
+		Node:          &node,
+		BlockSize:     "2M",
+		RequestedSize: "1G",
+		Bus:           "pcie.0",
+		Addr:          "0x5",
+	}
+
+	testAppend(dev, deviceVirtioMemString, t)
+
+	node = 0
+	testAppend(dev, strings.Replace(deviceVirtioMemString, "node=1", "node=0", 1), t)
+
+	dev.Node = nil
+	testAppend(dev, strings.Replace(deviceVirtioMemString, ",node=1", "", 1), t)
+}
+
+func TestVirtioMemDeviceValid(t *testing.T) {
+	dev := VirtioMemDevice{
+		ID: "vm0",
+	}
+	if dev.Valid() {
+		t.Fatalf("virtio-mem device should be not valid when MemDev is empty")
+	}
+
+	dev.MemDev = "vmem0"
+	dev.Transport = TransportMMIO
+	if dev.Valid() {
+		t.Fatalf("virtio-mem device should be not valid with the MMIO transport")
+	}
+
+	dev.Transport = TransportPCI
+	if !dev.Valid() {
+		t.Fatalf("virtio-mem device should be valid")
+	}
+}
+
+func TestSplitOptions(t *testing.T) {
+	options := splitOptions("secret,id=sec0,data=a,,b,,,format=raw")
+	expected := []string{"secret", "id=sec0", "data=a,b,", "format=raw"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("Expected %v equals to %v", options, expected)
+	}
+}
+
+func TestDeviceDatabaseValidateDevices(t *testing.T) {
+	config := &Config{
+		Devices: []Device{
+			VirtioMemDevice{
+				ID:            "vm0",
+				MemDev:        "vmem0",
+				RequestedSize: "1G",
+			},
+			MemoryBackend{
+				Type: MemoryBackendRAM,
+				ID:   "vmem0",
+				Size: "4G",
+			},
+			// Invalid devices are not passed to qemu.
+			VirtioMemDevice{
+				ID: "vm1",
+			},
+		},
+	}
+
+	db := DeviceDatabase{
+		"virtio-mem-pci": {
+			"memdev":         "link<memory-backend>",
+			"requested-size": "size",
+		},
+	}
+	if err := db.ValidateDevices(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	node := uint32(1)
+	config.Devices[0] = VirtioMemDevice{
+		ID:        "vm0",
+		MemDev:    "vmem0",
+		BlockSize: "2M",
+		Node:      &node,
+	}
+	err := db.ValidateDevices(config)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	for _, prop := range []string{"block-size", "node"} {
+		if !strings.Contains(err.Error(), "unknown property "+prop+" of device driver virtio-mem-pci") {
+			t.Fatalf("Expected error about property %s: %v", prop, err)
+		}
+	}
+
+	delete(db, "virtio-mem-pci")
+	err = db.ValidateDevices(config)
+	if err == nil || !strings.Contains(err.Error(), "unknown device driver virtio-mem-pci") {
+		t.Fatalf("Expected error about the device driver: %v", err)
+	}
+}
+
 func TestVirtioBalloonValid(t *testing.T) {
 	balloon := BalloonDevice{
 		ID: "",
@@ -812,6 +1229,124 @@ func TestFailToAppendCPUs(t *testing.T) {
 	}
 }
 
+var numaString = "-object memory-backend-file,id=ram-node0,size=2G,mem-path=/dev/hugepages,prealloc=on,host-nodes=0,policy=bind " +
+	"-numa node,nodeid=0,cpus=0-1,cpus=4-5,memdev=ram-node0 " +
+	"-object memory-backend-memfd,id=ram-node1,size=2G,share=on,hugetlb=on,host-nodes=1,policy=preferred " +
+	"-numa node,nodeid=1,cpus=2-3,cpus=6-7,memdev=ram-node1 " +
+	"-object memory-backend-ram,id=ram-node2,size=1G " +
+	"-numa node,nodeid=2,memdev=ram-node2 " +
+	"-numa dist,src=0,dst=1,val=21 -numa dist,src=1,dst=0,val=21"
+
+func TestAppendNUMA(t *testing.T) {
+	if !isDimmSupported(nil) {
+		t.Skip("NUMA is not supported on this architecture")
+	}
+
+	numa := NUMA{
+		Nodes: []NUMANode{
+			{
+				ID:         0,
+				CPUs:       []string{"0-1", "4-5"},
+				MemorySize: "2G",
+				Backend:    MemoryBackendFile,
+				HugePages:  true,
+				Prealloc:   true,
+				HostNodes:  []uint32{0},
+				Policy:     NUMAPolicyBind,
+			},
+			{
+				ID:         1,
+				CPUs:       []string{"2-3", "6-7"},
+				MemorySize: "2G",
+				Backend:    MemoryBackendMemfd,
+				HugePages:  true,
+				Share:      true,
+				HostNodes:  []uint32{1},
+				Policy:     NUMAPolicyPreferred,
+			},
+			{
+				ID:         2,
+				MemorySize: "1G",
+			},
+		},
+		Distances: []NUMADistance{
+			{Src: 0, Dst: 1, Value: 21},
+			{Src: 1, Dst: 0, Value: 21},
+		},
+	}
+
+	testAppend(numa, numaString, t)
+}
+
+func TestAppendNUMAMemoryKnobs(t *testing.T) {
+	if !isDimmSupported(nil) {
+		t.Skip("NUMA is not supported on this architecture")
+	}
+
+	conf := &Config{
+		Memory: Memory{
+			Size: "1G",
+		},
+		NUMA: NUMA{
+			Nodes: []NUMANode{
+				{
+					ID:         0,
+					CPUs:       []string{"0"},
+					MemorySize: "1G",
+				},
+			},
+		},
+	}
+	knobs := Knobs{
+		MemShared:   true,
+		MemPrealloc: true,
+	}
+
+	// The memory knobs apply to the NUMA nodes backends instead of
+	// creating a single memory backend.
+	testConfigAppend(conf, knobs, "", t)
+	testConfigAppend(conf, conf.NUMA,
+		"-object memory-backend-ram,id=ram-node0,size=1G,share=on,prealloc=on -numa node,nodeid=0,cpus=0,memdev=ram-node0", t)
+
+	conf = &Config{
+		NUMA:  conf.NUMA,
+		Knobs: Knobs{HugePages: true},
+	}
+	testConfigAppend(conf, conf.NUMA,
+		"-object memory-backend-file,id=ram-node0,size=1G,mem-path=/dev/hugepages -numa node,nodeid=0,cpus=0,memdev=ram-node0", t)
+
+	conf = &Config{
+		NUMA:   conf.NUMA,
+		Memory: Memory{Size: "1G", Path: "/dev/shm/vm"},
+		Knobs:  Knobs{FileBackedMem: true},
+	}
+	if err := conf.appendNUMA(); err == nil {
+		t.Fatalf("Expected appendNUMA to fail with FileBackedMem")
+	}
+}
+
+func TestFailToAppendNUMA(t *testing.T) {
+	numas := []NUMA{
+		{Nodes: []NUMANode{{ID: 0}}},
+		{Nodes: []NUMANode{{ID: 0, MemorySize: "1G", HugePages: true}}},
+		{Nodes: []NUMANode{{ID: 0, MemorySize: "1G", Backend: MemoryBackendFile}}},
+		{Nodes: []NUMANode{{ID: 0, MemorySize: "1G", Backend: MemoryBackendEPC}}},
+		{Nodes: []NUMANode{{ID: 0, MemorySize: "1G", Policy: NUMAPolicyBind}}},
+		{Nodes: []NUMANode{{ID: 0, MemorySize: "1G"}, {ID: 0, MemorySize: "1G"}}},
+		{
+			Nodes:     []NUMANode{{ID: 0, MemorySize: "1G"}},
+			Distances: []NUMADistance{{Src: 0, Dst: 1, Value: 20}},
+		},
+	}
+
+	for _, numa := range numas {
+		config := Config{NUMA: numa}
+		if err := config.appendNUMA(); err == nil {
+			t.Fatalf("Expected appendNUMA to fail for %+v", numa)
+		}
+	}
+}
+
 var qmpSingleSocketServerString = "-qmp unix:cc-qmp,server=on,wait=off"
 var qmpSingleSocketString = "-qmp unix:cc-qmp"
 
@@ -885,6 +1420,51 @@ func TestAppendStrings(t *testing.T) {
 
 var rtcString = "-rtc base=utc,driftfix=slew,clock=host"
 
+func TestAppendActions(t *testing.T) {
+	testAppend(Actions{}, "", t)
+	testAppend(Actions{Panic: PanicActionPause}, "-action panic=pause", t)
+	testAppend(Actions{Panic: PanicActionExitFailure}, "-action panic=exit-failure", t)
+
+	actions := Actions{
+		Reboot:   RebootActionShutdown,
+		Shutdown: ShutdownActionPause,
+		Panic:    PanicActionPause,
+		Watchdog: WatchdogActionInjectNMI,
+	}
+	testAppend(actions, "-action reboot=shutdown,shutdown=pause,panic=pause,watchdog=inject-nmi", t)
+}
+
+func TestAppendWatchdogDevice(t *testing.T) {
+	testAppend(WatchdogDevice{ID: "wdt0", Model: WatchdogI6300ESB}, "-device i6300esb,id=wdt0", t)
+	testAppend(WatchdogDevice{Model: WatchdogIB700}, "-device ib700", t)
+	testAppend(WatchdogDevice{Model: WatchdogDiag288}, "-device diag288", t)
+}
+
+func TestWatchdogDeviceMachine(t *testing.T) {
+	testCases := []struct {
+		model   WatchdogModel
+		machine string
+		valid   bool
+	}{
+		{WatchdogI6300ESB, "q35", true},
+		{WatchdogDiag288, "q35", false},
+		{WatchdogDiag288, "s390-ccw-virtio", true},
+		{WatchdogIB700, "s390-ccw-virtio", false},
+	}
+
+	for _, tc := range testCases {
+		config := &Config{Machine: Machine{Type: tc.machine}}
+		_, err := WatchdogDevice{Model: tc.model}.QemuParamsErr(config)
+		if (err == nil) != tc.valid {
+			t.Errorf("Unexpected result for %s on %s: %v", tc.model, tc.machine, err)
+		}
+	}
+
+	if (WatchdogDevice{Model: "wdt"}).Valid() {
+		t.Errorf("Expected an unknown model to be invalid")
+	}
+}
+
 func TestAppendRTC(t *testing.T) {
 	rtc := RTC{
 		Base:     UTC,
@@ -903,6 +1483,12 @@ func TestAppendIOThread(t *testing.T) {
 	}
 
 	testAppend(ioThread, ioThreadString, t)
+
+	pollMaxNs := uint64(0)
+	ioThread.PollMaxNs = &pollMaxNs
+	ioThread.PollGrow = 2
+	ioThread.PollShrink = 4
+	testAppend(ioThread, ioThreadString+",poll-max-ns=0,poll-grow=2,poll-shrink=4", t)
 }
 
 var incomingStringFD = "-S -incoming fd:3"
@@ -1003,7 +1589,7 @@ func TestBadQMPSockets(t *testing.T) {
 
 func TestBadDevices(t *testing.T) {
 	c := &Config{}
-	c.appendDevices()
+	c.appendDevices(nil)
 	if len(c.qemuParams) != 0 {
 		t.Errorf("Expected empty qemuParams, found %s", c.qemuParams)
 	}
@@ -1055,7 +1641,7 @@ func TestBadDevices(t *testing.T) {
 		},
 	}
 
-	c.appendDevices()
+	c.appendDevices(nil)
 	if len(c.qemuParams) != 0 {
 		t.Errorf("Expected empty qemuParams, found %s", c.qemuParams)
 	}
@@ -1335,3 +1921,378 @@ func TestLoaderDevice(t *testing.T) {
 		testAppend(tc.dev, tc.out, t)
 	}
 }
+
+func TestConfigValidate(t *testing.T) {
+	config := &Config{
+		Machine: Machine{Type: "q35"},
+		SMP: SMP{
+			CPUs:    2,
+			Sockets: 2,
+			Cores:   2,
+			Threads: 1,
+			MaxCPUs: 4,
+		},
+		Memory: Memory{
+			Size: "1024",
+		},
+		Knobs: Knobs{
+			HugePages: true,
+		},
+		QMPSockets: []QMPSocket{
+			{Type: Unix, Name: "qmp.sock"},
+		},
+		FwCfg: []FwCfg{
+			{Name: "opt/a", Str: "a"},
+		},
+		Devices: []Device{
+			MemoryBackend{Type: MemoryBackendRAM, ID: "vmem0", Size: "4G"},
+			VirtioMemDevice{ID: "vm0", MemDev: "vmem0"},
+		},
+		IOThreads: []IOThread{
+			{ID: "io0"},
+		},
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestConfigValidateErrors(t *testing.T) {
+	config := &Config{
+		SMP: SMP{
+			CPUs:    4,
+			Sockets: 1,
+			Cores:   1,
+			Threads: 1,
+			MaxCPUs: 2,
+		},
+		Memory: Memory{
+			Size:   "4G",
+			MaxMem: "2G",
+		},
+		QMPSockets: []QMPSocket{
+			{Type: Unix},
+		},
+		FwCfg: []FwCfg{
+			{Name: "opt/a", Str: "a"},
+			{Name: "opt/a", File: "a"},
+		},
+		Devices: []Device{
+			MemoryBackend{Type: MemoryBackendRAM, ID: "vmem0", Size: "4G"},
+			MemoryBackend{Type: MemoryBackendRAM, ID: "vmem0", Size: "1G"},
+			VirtioMemDevice{ID: "vm0"},
+		},
+		IOThreads: []IOThread{
+			{},
+		},
+		Knobs: Knobs{
+			NoReboot: true,
+		},
+		Actions: Actions{
+			Reboot:   RebootActionReset,
+			Panic:    "reboot",
+			Watchdog: "explode",
+		},
+	}
+
+	err := config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+
+	expected := map[string]bool{
+		"SMP.MaxCPUs":      true,
+		"SMP":              true,
+		"Memory.Slots":     true,
+		"Memory.MaxMem":    true,
+		"QMPSockets[0]":    true,
+		"FwCfg[1]":         true,
+		"Devices[1]":       true,
+		"Devices[2]":       true,
+		"IOThreads[0]":     true,
+		"Actions.Reboot":   true,
+		"Actions.Panic":    true,
+		"Actions.Watchdog": true,
+	}
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected errors on %v, got %v", expected, errs)
+	}
+
+	if !strings.Contains(err.Error(), "Devices[1]: -object id vmem0 is already used by Devices[0]") {
+		t.Fatalf("Expected duplicate ID error: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "Devices[2]: invalid qemu.VirtioMemDevice: MemDev is not set") {
+		t.Fatalf("Expected invalid device reason: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "IOThreads[0]: ID is not set") {
+		t.Fatalf("Expected invalid IO thread reason: %v", err)
+	}
+}
+
+func TestConfigValidateNetTransport(t *testing.T) {
+	config := &Config{
+		Devices: []Device{
+			NetDevice{Type: VFIO, ID: "net0", IFName: "eth0", Transport: TransportMMIO},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Devices[0]: vfio devices are not supported with the MMIO transport") {
+		t.Fatalf("Expected a transport error, got %v", err)
+	}
+}
+
+func TestConfigValidateMachine(t *testing.T) {
+	config := &Config{
+		Machine: Machine{Type: MachineTypeMicrovm},
+		Memory: Memory{
+			Size:   "1G",
+			Slots:  1,
+			MaxMem: "2G",
+		},
+		Knobs: Knobs{
+			FileBackedMem: true,
+		},
+		Devices: []Device{
+			VirtioMemDevice{ID: "vm0", MemDev: "vmem0", Transport: TransportPCI},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	for _, msg := range []string{
+		"Memory.Slots: memory hotplug is not supported on this machine",
+		"Knobs.FileBackedMem: requires Memory.Path",
+		"Devices[0]: PCI device virtio-mem-pci requires pcie=on on machine microvm",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error %q: %v", msg, err)
+		}
+	}
+
+	config = &Config{
+		Knobs: Knobs{
+			HugePages: true,
+		},
+	}
+	err = config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Knobs.HugePages: requires Memory.Size") {
+		t.Fatalf("Expected error about HugePages: %v", err)
+	}
+}
+
+func TestLaunchQemuStrict(t *testing.T) {
+	config := Config{
+		Path:   "/nonexistent/qemu",
+		Strict: true,
+		FwCfg: []FwCfg{
+			{Name: "opt/a"},
+		},
+	}
+
+	_, err := LaunchQemu(config, nil)
+	if _, ok := err.(ConfigErrors); !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+}
+
+func TestCheckedDevices(t *testing.T) {
+	devices := []Device{
+		Object{}, MemoryBackend{}, IOThread{}, ThrottleGroup{}, Secret{},
+		TLSCreds{}, RngBackend{}, FSDevice{}, CharDevice{}, NetDevice{},
+		LegacySerialDevice{}, SerialDevice{}, BlockDevice{}, PVPanicDevice{},
+		LoaderDevice{}, VhostUserDevice{}, PCIeRootPortDevice{}, VFIODevice{},
+		SCSIController{}, BridgeDevice{}, VSOCKDevice{}, RngDevice{},
+		BalloonDevice{}, VirtioMemDevice{}, IommuDev{}, FwCfg{},
+		WatchdogDevice{},
+	}
+
+	for _, d := range devices {
+		if _, ok := d.(CheckedDevice); !ok {
+			t.Errorf("%T does not implement CheckedDevice", d)
+		}
+	}
+}
+
+func TestNetDeviceQemuParamsErr(t *testing.T) {
+	testCases := []struct {
+		dev NetDevice
+		err string
+	}{
+		{
+			NetDevice{Type: VFIO, ID: "net0", Transport: TransportMMIO},
+			"vfio devices are not supported with the MMIO transport",
+		},
+		{
+			NetDevice{Type: VHOSTUSER, ID: "net0", Transport: TransportCCW},
+			"vhost-user devices are not supported on IBM Z",
+		},
+		{
+			NetDevice{Type: MACVTAP, ID: "net0", Transport: TransportPCI},
+			"macvtap device net0 requires FDs",
+		},
+	}
+
+	for _, tc := range testCases {
+		params, err := tc.dev.QemuParamsErr(&Config{})
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Expected error %q, got %v", tc.err, err)
+		}
+		if params != nil {
+			t.Errorf("Unexpected parameters %v", params)
+		}
+
+		// The compatibility shim does not build the parameters.
+		if params = tc.dev.QemuParams(&Config{}); params != nil {
+			t.Errorf("Unexpected parameters %v", params)
+		}
+	}
+}
+
+func TestDeviceQemuParamsErr(t *testing.T) {
+	testCases := []struct {
+		dev    Device
+		config Config
+		err    string
+	}{
+		{
+			BlockDevice{Driver: "ide-hd", ID: "hd0", File: "/var/lib/vm.img", IOThread: "iothread0"},
+			Config{},
+			"IOThread is not supported by the ide-hd driver of block device hd0",
+		},
+		{
+			VirtioMemDevice{ID: "vm0", MemDev: "vmem0"},
+			Config{Machine: Machine{Type: MachineTypeMicrovm}},
+			"the mmio transport is not supported by the device",
+		},
+	}
+
+	for _, tc := range testCases {
+		params, err := deviceQemuParams(tc.dev, &tc.config)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Expected error %q, got %v", tc.err, err)
+		}
+		if params != nil {
+			t.Errorf("Unexpected parameters %v", params)
+		}
+	}
+}
+
+type errorRecordingLogger struct {
+	qmpNullLogger
+	errors []string
+}
+
+func (l *errorRecordingLogger) Errorf(format string, v ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+}
+
+func TestAppendDevicesError(t *testing.T) {
+	config := &Config{
+		Devices: []Device{
+			NetDevice{Type: MACVTAP, ID: "net0", IFName: "macvtap0"},
+		},
+	}
+
+	if err := config.appendDevices(nil); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if len(config.qemuParams) != 0 {
+		t.Errorf("Expected empty qemuParams, found %s", config.qemuParams)
+	}
+
+	config.SkipDeviceErrors = true
+	logger := &errorRecordingLogger{}
+	if err := config.appendDevices(logger); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.qemuParams) != 0 {
+		t.Errorf("Expected empty qemuParams, found %s", config.qemuParams)
+	}
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], "macvtap device net0 requires FDs") {
+		t.Errorf("Expected the skipped device to be logged, got %v", logger.errors)
+	}
+
+	config.SkipDeviceErrors = false
+	config.Path = "/nonexistent/qemu"
+	if _, err := LaunchQemu(*config, nil); err == nil ||
+		!strings.Contains(err.Error(), "macvtap device net0 requires FDs") {
+		t.Fatalf("Expected transport error: %v", err)
+	}
+}
+
+func TestConfigBuild(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Unable to open %s: %v", os.DevNull, err)
+	}
+	defer f.Close()
+
+	config := &Config{
+		Name: "vm",
+		Memory: Memory{
+			Size: "1G",
+		},
+		SMP: SMP{
+			CPUs: 2,
+		},
+		Devices: []Device{
+			NetDevice{
+				Type:       TAP,
+				ID:         "tap0",
+				IFName:     "ceth0",
+				MACAddress: "01:02:de:ad:be:ef",
+				FDs:        []*os.File{f},
+			},
+		},
+		Knobs: Knobs{
+			NoDefaults: true,
+		},
+	}
+
+	args, fds, err := config.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"-name", "vm", "-m", "1G"}
+	if !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Errorf("Expected %v to start with %v", args, expected)
+	}
+	expected = []string{"-smp", "2"}
+	if !reflect.DeepEqual(args[len(args)-len(expected):], expected) {
+		t.Errorf("Expected %v to end with %v", args, expected)
+	}
+	if !strings.Contains(strings.Join(args, " "), "-netdev tap,id=tap0,fds=3") {
+		t.Errorf("Expected the tap fd in %v", args)
+	}
+	if !reflect.DeepEqual(fds, []*os.File{f}) {
+		t.Errorf("Unexpected fds %v", fds)
+	}
+
+	// The configuration is not modified by Build.
+	if config.qemuParams != nil || config.fds != nil {
+		t.Errorf("Unexpected configuration change %v %v", config.qemuParams, config.fds)
+	}
+
+	again, fds, err := config.Build()
+	if err != nil || !reflect.DeepEqual(again, args) || len(fds) != 1 {
+		t.Errorf("Expected the same parameters %v, got %v %v %v", args, again, fds, err)
+	}
+
+	config.SMP.MaxCPUs = 1
+	if _, _, err = config.Build(); err == nil {
+		t.Errorf("Expected error")
+	}
+}
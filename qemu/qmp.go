@@ -25,7 +25,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -93,6 +95,39 @@ type qmpEventFilter struct {
 	eventName string
 	dataKey   string
 	dataValue string
+
+	// errorEventNames are the names of the optional events reporting the
+	// failure of the command.  They are matched against dataKey and
+	// dataValue, and errorFn builds the command error out of the data of
+	// the event.
+	errorEventNames []string
+	errorFn         func(data map[string]interface{}) error
+}
+
+// matchesError returns true if the event name with data eventData reports
+// the failure of the command.
+func (filter *qmpEventFilter) matchesError(name string, eventData map[string]interface{}) bool {
+	for _, errorEventName := range filter.errorEventNames {
+		if filter.matches(errorEventName, name, eventData) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if the event name with data eventData matches the
+// filter for the event eventName.
+func (filter *qmpEventFilter) matches(eventName, name string, eventData map[string]interface{}) bool {
+	if eventName == "" || eventName != name {
+		return false
+	}
+
+	if filter.dataKey == "" {
+		return true
+	}
+
+	return eventData != nil && eventData[filter.dataKey] == filter.dataValue
 }
 
 // QMPEvent contains a single QMP event, sent on the QMPConfig.EventCh channel.
@@ -111,6 +146,10 @@ type QMPEvent struct {
 
 	// The event's timestamp converted to a time.Time object.
 	Timestamp time.Time
+
+	// rawData is the undecoded json data of the event, from which the
+	// numbers can be decoded without going through float64.
+	rawData json.RawMessage
 }
 
 type qmpResult struct {
@@ -126,6 +165,9 @@ type qmpCommand struct {
 	filter         *qmpEventFilter
 	resultReceived bool
 	oob            []byte
+
+	// eventErr is the error reported by the filter error event.
+	eventErr error
 }
 
 // QMP is a structure that contains the internal state used by startQMPLoop and
@@ -137,6 +179,61 @@ type QMP struct {
 	connectedCh    chan<- *QMPVersion
 	disconnectedCh chan struct{}
 	version        *QMPVersion
+
+	listenersLock sync.Mutex
+	listeners     []*qmpEventListener
+}
+
+// qmpEventListener receives the QMP events of a QMP instance, along with
+// the QMPConfig.EventCh channel.  It is used by the helpers of the package
+// which need to follow the events.
+type qmpEventListener struct {
+	ch   chan QMPEvent
+	done chan struct{}
+}
+
+// addEventListener returns a new listener receiving the QMP events of q,
+// until it is removed with removeEventListener.  The events must be
+// received promptly, as they are delivered by the QMP loop.
+func (q *QMP) addEventListener() *qmpEventListener {
+	l := &qmpEventListener{
+		ch:   make(chan QMPEvent, 16),
+		done: make(chan struct{}),
+	}
+
+	q.listenersLock.Lock()
+	q.listeners = append(q.listeners, l)
+	q.listenersLock.Unlock()
+
+	return l
+}
+
+// removeEventListener stops the delivery of the events to the listener l.
+func (q *QMP) removeEventListener(l *qmpEventListener) {
+	q.listenersLock.Lock()
+	defer q.listenersLock.Unlock()
+
+	for i, listener := range q.listeners {
+		if listener == l {
+			q.listeners = append(q.listeners[:i], q.listeners[i+1:]...)
+			close(l.done)
+			return
+		}
+	}
+}
+
+// notifyEventListeners delivers the event ev to the event listeners.
+func (q *QMP) notifyEventListeners(ev QMPEvent) {
+	q.listenersLock.Lock()
+	listeners := append([]*qmpEventListener{}, q.listeners...)
+	q.listenersLock.Unlock()
+
+	for _, l := range listeners {
+		select {
+		case l.ch <- ev:
+		case <-l.done:
+		}
+	}
 }
 
 // QMPVersion contains the version number and the capabailities of a QEMU
@@ -175,6 +272,69 @@ type MemoryDevicesData struct {
 	Hotpluggable bool   `json:"hotpluggable"`
 	Hotplugged   bool   `json:"hotplugged"`
 	Size         uint64 `json:"size"`
+
+	// The following fields are only relevant for virtio-mem devices.
+	Memaddr       uint64 `json:"memaddr"`
+	RequestedSize uint64 `json:"requested-size"`
+	MaxSize       uint64 `json:"max-size"`
+	BlockSize     uint64 `json:"block-size"`
+}
+
+// MemoryDeviceSizeChange is the data of a MEMORY_DEVICE_SIZE_CHANGE event,
+// emitted when the guest changes the amount of memory plugged in a
+// virtio-mem device.
+type MemoryDeviceSizeChange struct {
+	ID      string `json:"id"`
+	Size    uint64 `json:"size"`
+	QOMPath string `json:"qom-path"`
+}
+
+// DecodeMemoryDeviceSizeChange returns the data of a
+// MEMORY_DEVICE_SIZE_CHANGE event.
+func DecodeMemoryDeviceSizeChange(ev QMPEvent) (MemoryDeviceSizeChange, error) {
+	var change MemoryDeviceSizeChange
+
+	if ev.Name != "MEMORY_DEVICE_SIZE_CHANGE" {
+		return change, fmt.Errorf("unexpected event %s", ev.Name)
+	}
+
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return change, fmt.Errorf("unable to extract memory device size change information: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &change); err != nil {
+		return change, fmt.Errorf("unable to convert json to memory device size change: %v", err)
+	}
+
+	return change, nil
+}
+
+// WatchdogExpiration is the data of a WATCHDOG event, emitted when the
+// watchdog of the guest expires.
+type WatchdogExpiration struct {
+	// Action is the action taken by qemu.
+	Action WatchdogAction `json:"action"`
+}
+
+// DecodeWatchdogExpiration returns the data of a WATCHDOG event.
+func DecodeWatchdogExpiration(ev QMPEvent) (WatchdogExpiration, error) {
+	var expiration WatchdogExpiration
+
+	if ev.Name != "WATCHDOG" {
+		return expiration, fmt.Errorf("unexpected event %s", ev.Name)
+	}
+
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return expiration, fmt.Errorf("unable to extract watchdog expiration information: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &expiration); err != nil {
+		return expiration, fmt.Errorf("unable to convert json to watchdog expiration: %v", err)
+	}
+
+	return expiration, nil
 }
 
 // MemoryDevices represents memory devices of vm
@@ -205,6 +365,15 @@ type CPUInfoFast struct {
 	Props    CPUProperties `json:"props"`
 }
 
+// IOThreadInfo represents information about each IOThread
+type IOThreadInfo struct {
+	ID         string `json:"id"`
+	ThreadID   int    `json:"thread-id"`
+	PollMaxNs  int64  `json:"poll-max-ns"`
+	PollGrow   int64  `json:"poll-grow"`
+	PollShrink int64  `json:"poll-shrink"`
+}
+
 // MigrationRAM represents migration ram status
 type MigrationRAM struct {
 	Total            int64 `json:"total"`
@@ -245,6 +414,180 @@ type MigrationStatus struct {
 	XbzrleCache  MigrationXbzrleCache     `json:"xbzrle-cache,omitempty"`
 }
 
+// DirtyRateMeasureMode is the method used by QEMU to measure the rate at
+// which the guest dirties its memory.
+type DirtyRateMeasureMode string
+
+const (
+	// DirtyRatePageSampling estimates the dirty rate by hashing a sample
+	// of the guest pages.
+	DirtyRatePageSampling DirtyRateMeasureMode = "page-sampling"
+
+	// DirtyRateDirtyRing uses the KVM dirty ring to compute a dirty rate
+	// for each vCPU. QEMU must be started with the dirty-ring-size accel
+	// property for this mode to work.
+	DirtyRateDirtyRing DirtyRateMeasureMode = "dirty-ring"
+)
+
+const (
+	// DirtyRateUnstarted means that no dirty rate measurement has been
+	// requested yet.
+	DirtyRateUnstarted = "unstarted"
+
+	// DirtyRateMeasuring means that a dirty rate measurement is in progress.
+	DirtyRateMeasuring = "measuring"
+
+	// DirtyRateMeasured means that the last dirty rate measurement is
+	// complete and its results are available.
+	DirtyRateMeasured = "measured"
+)
+
+// DirtyRateVCPU represents the dirty rate of a single vCPU
+type DirtyRateVCPU struct {
+	ID        int   `json:"id"`
+	DirtyRate int64 `json:"dirty-rate"`
+}
+
+// DirtyRateInfo represents the result of a guest dirty rate measurement.
+// DirtyRate is expressed in MiB/s. VCPUDirtyRate is only filled in by QEMU
+// when the measurement was done in DirtyRateDirtyRing mode.
+type DirtyRateInfo struct {
+	DirtyRate     int64                `json:"dirty-rate"`
+	Status        string               `json:"status"`
+	StartTime     int64                `json:"start-time"`
+	CalcTime      int64                `json:"calc-time"`
+	SamplePages   uint64               `json:"sample-pages"`
+	Mode          DirtyRateMeasureMode `json:"mode"`
+	VCPUDirtyRate []DirtyRateVCPU      `json:"vcpu-dirty-rate,omitempty"`
+}
+
+// JobInfo represents the status of a background job
+type JobInfo struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Status          string `json:"status"`
+	CurrentProgress int64  `json:"current-progress"`
+	TotalProgress   int64  `json:"total-progress"`
+	Error           string `json:"error,omitempty"`
+}
+
+// DumpFormat is the format of a guest memory dump.
+type DumpFormat string
+
+const (
+	// DumpFormatELF is the ELF format.
+	DumpFormatELF DumpFormat = "elf"
+
+	// DumpFormatKdumpZlib is the kdump compressed format, with zlib
+	// compression.
+	DumpFormatKdumpZlib DumpFormat = "kdump-zlib"
+
+	// DumpFormatKdumpLZO is the kdump compressed format, with lzo
+	// compression.
+	DumpFormatKdumpLZO DumpFormat = "kdump-lzo"
+
+	// DumpFormatKdumpSnappy is the kdump compressed format, with snappy
+	// compression.
+	DumpFormatKdumpSnappy DumpFormat = "kdump-snappy"
+
+	// DumpFormatWinDmp is the Windows crash dump format.
+	DumpFormatWinDmp DumpFormat = "win-dmp"
+)
+
+// DumpGuestMemoryOptions are the options of a guest memory dump.
+type DumpGuestMemoryOptions struct {
+	// Format is the format of the dump, elf by default.
+	Format DumpFormat
+
+	// Paging dumps the guest memory as mapped by the guest, rather than
+	// its physical memory.
+	Paging bool
+
+	// Begin and Length restrict the dump to a range of the guest memory.
+	// The whole memory is dumped if Length is 0.
+	Begin  uint64
+	Length uint64
+}
+
+// DumpQueryResult represents the progress of a guest memory dump
+type DumpQueryResult struct {
+	Status    string `json:"status"`
+	Completed uint64 `json:"completed"`
+	Total     uint64 `json:"total"`
+}
+
+// DumpCompleted is the data of a DUMP_COMPLETED event, emitted when a guest
+// memory dump ends.
+type DumpCompleted struct {
+	Result DumpQueryResult `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// SnapshotInfo represents an internal snapshot stored in a block node
+type SnapshotInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  int64  `json:"vm-clock-sec"`
+	VMClockNsec int64  `json:"vm-clock-nsec"`
+}
+
+// BalloonInfo is the balloon information returned by query-balloon.
+type BalloonInfo struct {
+	// Actual is the current size of the guest memory in bytes.
+	Actual int64 `json:"actual"`
+}
+
+// BalloonGuestStats are the guest memory statistics reported through a
+// balloon device. A statistic is -1 when the guest does not report it.
+type BalloonGuestStats struct {
+	// SwapIn is the amount of memory swapped in, in bytes.
+	SwapIn int64 `json:"stat-swap-in"`
+
+	// SwapOut is the amount of memory swapped out, in bytes.
+	SwapOut int64 `json:"stat-swap-out"`
+
+	// MajorFaults is the number of major page faults.
+	MajorFaults int64 `json:"stat-major-faults"`
+
+	// MinorFaults is the number of minor page faults.
+	MinorFaults int64 `json:"stat-minor-faults"`
+
+	// FreeMemory is the amount of unused memory, in bytes.
+	FreeMemory int64 `json:"stat-free-memory"`
+
+	// TotalMemory is the amount of memory available to the guest,
+	// in bytes.
+	TotalMemory int64 `json:"stat-total-memory"`
+
+	// AvailableMemory is an estimation of the amount of memory
+	// available for starting new applications, in bytes.
+	AvailableMemory int64 `json:"stat-available-memory"`
+
+	// DiskCaches is the amount of memory used for the disk caches,
+	// that can be reclaimed, in bytes.
+	DiskCaches int64 `json:"stat-disk-caches"`
+
+	// HugetlbAllocations is the number of successful huge page
+	// allocations.
+	HugetlbAllocations int64 `json:"stat-htlb-pgalloc"`
+
+	// HugetlbFailures is the number of failed huge page allocations.
+	HugetlbFailures int64 `json:"stat-htlb-pgfail"`
+}
+
+// BalloonStats is the value of the guest-stats property of a balloon device.
+type BalloonStats struct {
+	// LastUpdate is the time of the last update, in seconds since the
+	// Epoch.
+	LastUpdate int64 `json:"last-update"`
+
+	// Stats are the guest memory statistics.
+	Stats BalloonGuestStats `json:"stats"`
+}
+
 // SchemaInfo represents all QMP wire ABI
 type SchemaInfo struct {
 	MetaType string `json:"meta-type"`
@@ -258,6 +601,71 @@ type StatusInfo struct {
 	Status     string `json:"status"`
 }
 
+// RunState returns the run state of the guest.
+func (s StatusInfo) RunState() RunState {
+	return RunState(s.Status)
+}
+
+// RunState is a run state of qemu, as reported by query-status.
+type RunState string
+
+const (
+	// RunStateDebug means that qemu is stopped by a debugger.
+	RunStateDebug RunState = "debug"
+
+	// RunStateInMigrate means that qemu is waiting for an incoming
+	// migration.
+	RunStateInMigrate RunState = "inmigrate"
+
+	// RunStateInternalError means that qemu hit an internal error.
+	RunStateInternalError RunState = "internal-error"
+
+	// RunStateIOError means that the guest is paused after an I/O error.
+	RunStateIOError RunState = "io-error"
+
+	// RunStatePaused means that the guest is paused.
+	RunStatePaused RunState = "paused"
+
+	// RunStatePostMigrate means that the guest is paused after a
+	// completed migration.
+	RunStatePostMigrate RunState = "postmigrate"
+
+	// RunStatePrelaunch means that qemu was started with -S and the
+	// guest has not started yet.
+	RunStatePrelaunch RunState = "prelaunch"
+
+	// RunStateFinishMigrate means that the guest is paused to finish a
+	// migration.
+	RunStateFinishMigrate RunState = "finish-migrate"
+
+	// RunStateRestoreVM means that the guest is paused to restore a
+	// snapshot.
+	RunStateRestoreVM RunState = "restore-vm"
+
+	// RunStateRunning means that the guest is running.
+	RunStateRunning RunState = "running"
+
+	// RunStateSaveVM means that the guest is paused to save a snapshot.
+	RunStateSaveVM RunState = "save-vm"
+
+	// RunStateShutdown means that the guest has shut down, and qemu was
+	// started with -no-shutdown.
+	RunStateShutdown RunState = "shutdown"
+
+	// RunStateSuspended means that the guest is suspended.
+	RunStateSuspended RunState = "suspended"
+
+	// RunStateWatchdog means that the guest is paused by its watchdog.
+	RunStateWatchdog RunState = "watchdog"
+
+	// RunStateGuestPanicked means that the guest is paused after a
+	// panic.
+	RunStateGuestPanicked RunState = "guest-panicked"
+
+	// RunStateColo means that the guest is in COLO mode.
+	RunStateColo RunState = "colo"
+)
+
 func (q *QMP) readLoop(fromVMCh chan<- []byte) {
 	scanner := bufio.NewScanner(q.conn)
 	if q.cfg.MaxCapacity > 0 {
@@ -282,7 +690,7 @@ func (q *QMP) readLoop(fromVMCh chan<- []byte) {
 }
 
 func (q *QMP) processQMPEvent(cmdQueue *list.List, name interface{}, data interface{},
-	timestamp interface{}) {
+	timestamp interface{}, rawData json.RawMessage) {
 
 	strname, ok := name.(string)
 	if !ok {
@@ -299,57 +707,69 @@ func (q *QMP) processQMPEvent(cmdQueue *list.List, name interface{}, data interf
 		cmd := cmdEl.Value.(*qmpCommand)
 		filter := cmd.filter
 		if filter != nil {
-			if filter.eventName == strname {
-				match := filter.dataKey == ""
-				if !match && eventData != nil {
-					match = eventData[filter.dataKey] == filter.dataValue
+			if filter.matches(filter.eventName, strname, eventData) {
+				if cmd.resultReceived {
+					q.finaliseCommand(cmdEl, cmdQueue, true)
+				} else {
+					cmd.filter = nil
 				}
-				if match {
-					if cmd.resultReceived {
-						q.finaliseCommand(cmdEl, cmdQueue, true)
-					} else {
-						cmd.filter = nil
-					}
+			} else if filter.matchesError(strname, eventData) {
+				if cmd.resultReceived {
+					q.finaliseCommandWithError(cmdEl, cmdQueue, filter.errorFn(eventData))
+				} else {
+					cmd.filter = nil
+					cmd.eventErr = filter.errorFn(eventData)
 				}
 			}
 		}
 	}
 
-	if q.cfg.EventCh != nil {
-		ev := QMPEvent{
-			Name: strname,
-			Data: eventData,
-		}
-		if timestamp != nil {
-			timestamp, ok := timestamp.(map[string]interface{})
-			if ok {
-				seconds, _ := timestamp["seconds"].(float64)
-				microseconds, _ := timestamp["microseconds"].(float64)
-				ev.Timestamp = time.Unix(int64(seconds), int64(microseconds))
-			}
+	ev := QMPEvent{
+		Name:    strname,
+		Data:    eventData,
+		rawData: rawData,
+	}
+	if timestamp != nil {
+		timestamp, ok := timestamp.(map[string]interface{})
+		if ok {
+			seconds, _ := timestamp["seconds"].(float64)
+			microseconds, _ := timestamp["microseconds"].(float64)
+			ev.Timestamp = time.Unix(int64(seconds), int64(microseconds))
 		}
+	}
+
+	q.notifyEventListeners(ev)
 
+	if q.cfg.EventCh != nil {
 		q.cfg.EventCh <- ev
 	}
 }
 
-func (q *QMP) finaliseCommandWithResponse(cmdEl *list.Element, cmdQueue *list.List, succeeded bool, response interface{}) {
+func (q *QMP) finaliseCommandWithResult(cmdEl *list.Element, cmdQueue *list.List, result qmpResult) {
 	cmd := cmdEl.Value.(*qmpCommand)
 	cmdQueue.Remove(cmdEl)
 	select {
 	case <-cmd.ctx.Done():
 	default:
-		if succeeded {
-			cmd.res <- qmpResult{response: response}
-		} else {
-			cmd.res <- qmpResult{err: fmt.Errorf("QMP command failed: %v", response)}
-		}
+		cmd.res <- result
 	}
 	if cmdQueue.Len() > 0 {
 		q.writeNextQMPCommand(cmdQueue)
 	}
 }
 
+func (q *QMP) finaliseCommandWithResponse(cmdEl *list.Element, cmdQueue *list.List, succeeded bool, response interface{}) {
+	if succeeded {
+		q.finaliseCommandWithResult(cmdEl, cmdQueue, qmpResult{response: response})
+	} else {
+		q.finaliseCommandWithResult(cmdEl, cmdQueue, qmpResult{err: fmt.Errorf("QMP command failed: %v", response)})
+	}
+}
+
+func (q *QMP) finaliseCommandWithError(cmdEl *list.Element, cmdQueue *list.List, err error) {
+	q.finaliseCommandWithResult(cmdEl, cmdQueue, qmpResult{err: err})
+}
+
 func (q *QMP) finaliseCommand(cmdEl *list.Element, cmdQueue *list.List, succeeded bool) {
 	q.finaliseCommandWithResponse(cmdEl, cmdQueue, succeeded, nil)
 }
@@ -380,7 +800,11 @@ func (q *QMP) processQMPInput(line []byte, cmdQueue *list.List) {
 		return
 	}
 	if evname, found := vmData["event"]; found {
-		q.processQMPEvent(cmdQueue, evname, vmData["data"], vmData["timestamp"])
+		var rawEvent struct {
+			Data json.RawMessage `json:"data"`
+		}
+		_ = json.Unmarshal(line, &rawEvent)
+		q.processQMPEvent(cmdQueue, evname, vmData["data"], vmData["timestamp"], rawEvent.Data)
 		return
 	}
 
@@ -398,7 +822,9 @@ func (q *QMP) processQMPInput(line []byte, cmdQueue *list.List) {
 		return
 	}
 	cmd := cmdEl.Value.(*qmpCommand)
-	if failed || cmd.filter == nil {
+	if succeeded && cmd.eventErr != nil {
+		q.finaliseCommandWithError(cmdEl, cmdQueue, cmd.eventErr)
+	} else if failed || cmd.filter == nil {
 		if errData != nil {
 			desc, err := q.errorDesc(errData)
 			if err != nil {
@@ -703,6 +1129,12 @@ func QMPStart(ctx context.Context, socket string, cfg QMPConfig, disconnectedCh
 		return nil, nil, err
 	}
 
+	return qmpConnect(ctx, conn, cfg, disconnectedCh)
+}
+
+// qmpConnect starts a QMP loop on the connection conn, and waits for the
+// QMP greeting of qemu.
+func qmpConnect(ctx context.Context, conn io.ReadWriteCloser, cfg QMPConfig, disconnectedCh chan struct{}) (*QMP, *QMPVersion, error) {
 	connectedCh := make(chan *QMPVersion)
 
 	q := startQMPLoop(conn, cfg, connectedCh, disconnectedCh)
@@ -772,6 +1204,27 @@ func (q *QMP) ExecuteQuit(ctx context.Context) error {
 	return q.executeCommand(ctx, "quit", nil, nil)
 }
 
+// ExecuteSetAction changes the actions taken on guest lifecycle events.
+// The actions which are not set in actions are left unchanged.
+func (q *QMP) ExecuteSetAction(ctx context.Context, actions Actions) error {
+	args := make(map[string]interface{})
+
+	if actions.Reboot != "" {
+		args["reboot"] = actions.Reboot
+	}
+	if actions.Shutdown != "" {
+		args["shutdown"] = actions.Shutdown
+	}
+	if actions.Panic != "" {
+		args["panic"] = actions.Panic
+	}
+	if actions.Watchdog != "" {
+		args["watchdog"] = actions.Watchdog
+	}
+
+	return q.executeCommand(ctx, "set-action", args, nil)
+}
+
 func (q *QMP) blockdevAddBaseArgs(driver, device, blockdevID string, ro bool) (map[string]interface{}, map[string]interface{}) {
 	var args map[string]interface{}
 
@@ -1330,6 +1783,55 @@ func (q *QMP) ExecQueryMemoryDevices(ctx context.Context) ([]MemoryDevices, erro
 	return memoryDevices, nil
 }
 
+// virtioMemPollInterval is the interval at which WaitVirtioMemResize polls
+// the size of a virtio-mem device.
+const virtioMemPollInterval = 100 * time.Millisecond
+
+// ExecuteQueryVirtioMem returns the state of the virtio-mem device id.
+func (q *QMP) ExecuteQueryVirtioMem(ctx context.Context, id string) (MemoryDevicesData, error) {
+	devices, err := q.ExecQueryMemoryDevices(ctx)
+	if err != nil {
+		return MemoryDevicesData{}, err
+	}
+
+	for _, d := range devices {
+		if d.Type == "virtio-mem" && d.Data.ID == id {
+			return d.Data, nil
+		}
+	}
+
+	return MemoryDevicesData{}, fmt.Errorf("virtio-mem device %s not found", id)
+}
+
+// ExecuteVirtioMemResize requests the guest to resize the memory plugged in
+// the virtio-mem device id to size bytes, by setting its requested-size
+// property.  The guest plugs or unplugs memory asynchronously, and reports
+// its progress with MEMORY_DEVICE_SIZE_CHANGE events.
+func (q *QMP) ExecuteVirtioMemResize(ctx context.Context, id string, size uint64) error {
+	return q.ExecQomSet(ctx, peripheralPath+id, "requested-size", size)
+}
+
+// WaitVirtioMemResize waits for the guest to plug or unplug the memory
+// requested from the virtio-mem device id, and returns the device state.
+func (q *QMP) WaitVirtioMemResize(ctx context.Context, id string) (MemoryDevicesData, error) {
+	for {
+		dev, err := q.ExecuteQueryVirtioMem(ctx, id)
+		if err != nil {
+			return dev, err
+		}
+
+		if dev.Size == dev.RequestedSize {
+			return dev, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return dev, ctx.Err()
+		case <-time.After(virtioMemPollInterval):
+		}
+	}
+}
+
 // ExecQueryCpus returns a slice with the list of `CpuInfo`
 // Since qemu 2.12, we have `query-cpus-fast` as a better choice in production
 // we can still choose `ExecQueryCpus` for compatibility though not recommended.
@@ -1378,95 +1880,313 @@ func (q *QMP) ExecQueryCpusFast(ctx context.Context) ([]CPUInfoFast, error) {
 	return cpuInfoFast, nil
 }
 
-// ExecMemdevAdd adds size of MiB memory device to the guest
-func (q *QMP) ExecMemdevAdd(ctx context.Context, qomtype, id, mempath string, size int, share bool, driver, driverID, addr, bus string) error {
-	args := map[string]interface{}{
-		"qom-type": qomtype,
-		"id":       id,
-		"size":     uint64(size) << 20,
-	}
-	if mempath != "" {
-		args["mem-path"] = mempath
-	}
-	if share {
-		args["share"] = true
-	}
-	err := q.executeCommand(ctx, "object-add", args, nil)
+// ExecuteQueryIOThreads returns a slice with the list of IOThreads and the
+// host threads that run them.
+func (q *QMP) ExecuteQueryIOThreads(ctx context.Context) ([]IOThreadInfo, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-iothreads", nil, nil, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			q.cfg.Logger.Errorf("Unable to add memory device %s: %v", id, err)
-			err = q.executeCommand(ctx, "object-del", map[string]interface{}{"id": id}, nil)
-			if err != nil {
-				q.cfg.Logger.Warningf("Unable to clean up memory object %s: %v", id, err)
-			}
-		}
-	}()
-
-	args = map[string]interface{}{
-		"driver": driver,
-		"id":     driverID,
-		"memdev": id,
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract IOThreads information: %v", err)
 	}
 
-	if bus != "" {
-		args["bus"] = bus
-	}
-	if addr != "" {
-		args["addr"] = addr
+	var ioThreads []IOThreadInfo
+	if err = json.Unmarshal(data, &ioThreads); err != nil {
+		return nil, fmt.Errorf("unable to convert json to IOThreadInfo: %v", err)
 	}
 
-	err = q.executeCommand(ctx, "device_add", args, nil)
-
-	return err
+	return ioThreads, nil
 }
 
-// ExecHotplugMemory adds size of MiB memory to the guest
-func (q *QMP) ExecHotplugMemory(ctx context.Context, qomtype, id, mempath string, size int, share bool) error {
-	return q.ExecMemdevAdd(ctx, qomtype, id, mempath, size, share, "pc-dimm", "dimm"+id, "", "")
+// ExecuteSetIOThreadPolling tunes the polling of the running IO thread t.ID
+// with the polling settings of t, through qom-set.  The settings left to
+// their qemu default in t are not changed.
+func (q *QMP) ExecuteSetIOThreadPolling(ctx context.Context, t IOThread) error {
+	for _, p := range t.properties() {
+		if err := q.ExecQomSet(ctx, "/objects/"+t.ID, p.name, p.value.(uint64)); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// ExecuteNVDIMMDeviceAdd adds a block device to a QEMU instance using
-// a NVDIMM driver with the device_add command.
-// id is the id of the device to add.  It must be a valid QMP identifier.
-// mempath is the path of the device to add, e.g., /dev/rdb0.  size is
-// the data size of the device. pmem is to guarantee the persistence of QEMU writes
-// to the vNVDIMM backend.
-func (q *QMP) ExecuteNVDIMMDeviceAdd(ctx context.Context, id, mempath string, size int64, pmem *bool) error {
-	args := map[string]interface{}{
-		"qom-type": "memory-backend-file",
-		"id":       "nvdimmbackmem" + id,
-		"mem-path": mempath,
-		"size":     size,
-		"share":    true,
+// peripheralPath is the QOM path under which QEMU places the devices that
+// have been created with an id, either on the command line or with
+// device_add.
+const peripheralPath = "/machine/peripheral/"
+
+// sortCPUsByTopology sorts a slice of hotpluggable CPUs by socket, die, core
+// and thread.
+func sortCPUsByTopology(cpus []HotpluggableCPU) {
+	sort.Slice(cpus, func(i, j int) bool {
+		a, b := cpus[i].Properties, cpus[j].Properties
+		if a.Socket != b.Socket {
+			return a.Socket < b.Socket
+		}
+		if a.Die != b.Die {
+			return a.Die < b.Die
+		}
+		if a.Core != b.Core {
+			return a.Core < b.Core
+		}
+		return a.Thread < b.Thread
+	})
+}
+
+// HotplugVCPUs hotplugs n vCPUs into the guest.  The vCPUs are plugged into
+// the first free slots reported by query-hotpluggable-cpus, in topology
+// order, and their presence is then confirmed with query-cpus-fast.  On
+// success the function returns the vCPUs of the guest, including the ones
+// that have just been added, so that their threads can be pinned.  vCPUs
+// that were plugged before an error occurred are not removed.
+func (q *QMP) HotplugVCPUs(ctx context.Context, n int) ([]CPUInfoFast, error) {
+	hotpluggableCPUs, err := q.ExecuteQueryHotpluggableCPUs(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if pmem != nil {
-		args["pmem"] = *pmem
+	var free []HotpluggableCPU
+	for _, c := range hotpluggableCPUs {
+		if c.QOMPath == "" {
+			free = append(free, c)
+		}
+	}
+	if len(free) < n {
+		return nil, fmt.Errorf("unable to hotplug %d vCPUs, only %d slots are available", n, len(free))
 	}
+	sortCPUsByTopology(free)
 
-	err := q.executeCommand(ctx, "object-add", args, nil)
+	added := make([]string, 0, n)
+	for _, c := range free[:n] {
+		p := c.Properties
+		cpuID := fmt.Sprintf("cpu-%d-%d-%d-%d", p.Socket, p.Die, p.Core, p.Thread)
+		err = q.ExecuteCPUDeviceAdd(ctx, c.Type, cpuID, strconv.Itoa(p.Socket), strconv.Itoa(p.Die),
+			strconv.Itoa(p.Core), strconv.Itoa(p.Thread), "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to hotplug vCPU %s: %v", cpuID, err)
+		}
+		added = append(added, peripheralPath+cpuID)
+	}
+
+	cpus, err := q.ExecQueryCpusFast(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	args = map[string]interface{}{
-		"driver": "nvdimm",
-		"id":     "nvdimm" + id,
-		"memdev": "nvdimmbackmem" + id,
+	present := make(map[string]bool)
+	for _, c := range cpus {
+		present[c.QomPath] = true
 	}
-	if err = q.executeCommand(ctx, "device_add", args, nil); err != nil {
-		q.cfg.Logger.Errorf("Unable to hotplug NVDIMM device: %v", err)
-		err2 := q.executeCommand(ctx, "object-del", map[string]interface{}{"id": "nvdimmbackmem" + id}, nil)
-		if err2 != nil {
-			q.cfg.Logger.Warningf("Unable to clean up memory object: %v", err2)
+	for _, path := range added {
+		if !present[path] {
+			return nil, fmt.Errorf("hotplugged vCPU %s not reported by the guest", path)
 		}
 	}
 
-	return err
+	return cpus, nil
+}
+
+// UnplugVCPUs removes n vCPUs from the guest.  Only the vCPUs that have been
+// created with an id can be removed, starting with the last one in topology
+// order.  Each removal blocks until the guest has acknowledged it with a
+// DEVICE_DELETED event.  On success the function returns the remaining vCPUs
+// of the guest.
+func (q *QMP) UnplugVCPUs(ctx context.Context, n int) ([]CPUInfoFast, error) {
+	hotpluggableCPUs, err := q.ExecuteQueryHotpluggableCPUs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugged []HotpluggableCPU
+	for _, c := range hotpluggableCPUs {
+		if strings.HasPrefix(c.QOMPath, peripheralPath) {
+			plugged = append(plugged, c)
+		}
+	}
+	if len(plugged) < n {
+		return nil, fmt.Errorf("unable to unplug %d vCPUs, only %d vCPUs can be unplugged", n, len(plugged))
+	}
+	sortCPUsByTopology(plugged)
+
+	for i := len(plugged) - 1; i >= len(plugged)-n; i-- {
+		cpuID := strings.TrimPrefix(plugged[i].QOMPath, peripheralPath)
+		if err = q.ExecuteDeviceDel(ctx, cpuID); err != nil {
+			return nil, fmt.Errorf("unable to unplug vCPU %s: %v", cpuID, err)
+		}
+	}
+
+	return q.ExecQueryCpusFast(ctx)
+}
+
+// ExecuteObjectAdd creates the object spec with the object-add command.
+func (q *QMP) ExecuteObjectAdd(ctx context.Context, spec ObjectSpec) error {
+	if !spec.Valid() {
+		return fmt.Errorf("invalid object %T", spec)
+	}
+
+	args, err := spec.QMPArgs()
+	if err != nil {
+		return err
+	}
+
+	return q.executeCommand(ctx, "object-add", args, nil)
+}
+
+// ExecuteObjectDel deletes the object id with the object-del command.
+func (q *QMP) ExecuteObjectDel(ctx context.Context, id string) error {
+	args := map[string]interface{}{
+		"id": id,
+	}
+
+	return q.executeCommand(ctx, "object-del", args, nil)
+}
+
+// ExecuteMemoryBackendAdd adds a memory backend object to the guest with
+// the object-add command.
+func (q *QMP) ExecuteMemoryBackendAdd(ctx context.Context, backend MemoryBackend) error {
+	if !backend.Valid() {
+		return fmt.Errorf("invalid memory backend %s", backend.ID)
+	}
+
+	return q.ExecuteObjectAdd(ctx, backend)
+}
+
+// ExecMemdevAdd adds size of MiB memory device to the guest
+func (q *QMP) ExecMemdevAdd(ctx context.Context, qomtype, id, mempath string, size int, share bool, driver, driverID, addr, bus string) error {
+	backend := MemoryBackend{
+		Type:    ObjectType(qomtype),
+		ID:      id,
+		Size:    fmt.Sprintf("%dM", size),
+		MemPath: mempath,
+		Share:   share,
+	}
+	err := q.ExecuteMemoryBackendAdd(ctx, backend)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			q.cfg.Logger.Errorf("Unable to add memory device %s: %v", id, err)
+			err = q.ExecuteObjectDel(ctx, id)
+			if err != nil {
+				q.cfg.Logger.Warningf("Unable to clean up memory object %s: %v", id, err)
+			}
+		}
+	}()
+
+	args := map[string]interface{}{
+		"driver": driver,
+		"id":     driverID,
+		"memdev": id,
+	}
+
+	if bus != "" {
+		args["bus"] = bus
+	}
+	if addr != "" {
+		args["addr"] = addr
+	}
+
+	err = q.executeCommand(ctx, "device_add", args, nil)
+
+	return err
+}
+
+// ExecHotplugMemory adds size of MiB memory to the guest
+func (q *QMP) ExecHotplugMemory(ctx context.Context, qomtype, id, mempath string, size int, share bool) error {
+	return q.ExecMemdevAdd(ctx, qomtype, id, mempath, size, share, "pc-dimm", "dimm"+id, "", "")
+}
+
+// MemoryUnplugError is returned when the guest refuses to unplug a memory
+// device.
+type MemoryUnplugError struct {
+	// Device is the ID of the memory device.
+	Device string
+
+	// Msg is the reason of the failure reported by qemu.
+	Msg string
+}
+
+func (e *MemoryUnplugError) Error() string {
+	return fmt.Sprintf("unable to unplug memory device %s: %s", e.Device, e.Msg)
+}
+
+// HotunplugMemory removes from the guest the memory added with
+// ExecHotplugMemory.  The memory device is deleted with device_del, and the
+// function waits for the guest to release it, which is reported by a
+// DEVICE_DELETED event.  A *MemoryUnplugError is returned if the guest
+// refuses to unplug the memory, which is reported by a
+// DEVICE_UNPLUG_GUEST_ERROR event, or by a MEMORY_DEVICE_UNPLUG_ERROR event
+// with qemu versions older than 7.2 on pseries machines.  The memory backend
+// is deleted once the device is gone.
+func (q *QMP) HotunplugMemory(ctx context.Context, id string) error {
+	devID := "dimm" + id
+	args := map[string]interface{}{
+		"id": devID,
+	}
+	filter := &qmpEventFilter{
+		eventName:       "DEVICE_DELETED",
+		dataKey:         "device",
+		dataValue:       devID,
+		errorEventNames: []string{"MEMORY_DEVICE_UNPLUG_ERROR", "DEVICE_UNPLUG_GUEST_ERROR"},
+		errorFn: func(data map[string]interface{}) error {
+			msg, _ := data["msg"].(string)
+			if msg == "" {
+				msg = "unplug rejected by the guest"
+			}
+			return &MemoryUnplugError{Device: devID, Msg: msg}
+		},
+	}
+	if err := q.executeCommand(ctx, "device_del", args, filter); err != nil {
+		return err
+	}
+
+	return q.ExecuteObjectDel(ctx, id)
+}
+
+// ExecuteNVDIMMDeviceAdd adds a block device to a QEMU instance using
+// a NVDIMM driver with the device_add command.
+// id is the id of the device to add.  It must be a valid QMP identifier.
+// mempath is the path of the device to add, e.g., /dev/rdb0.  size is
+// the data size of the device. pmem is to guarantee the persistence of QEMU writes
+// to the vNVDIMM backend.
+func (q *QMP) ExecuteNVDIMMDeviceAdd(ctx context.Context, id, mempath string, size int64, pmem *bool) error {
+	args := map[string]interface{}{
+		"qom-type": "memory-backend-file",
+		"id":       "nvdimmbackmem" + id,
+		"mem-path": mempath,
+		"size":     size,
+		"share":    true,
+	}
+
+	if pmem != nil {
+		args["pmem"] = *pmem
+	}
+
+	err := q.executeCommand(ctx, "object-add", args, nil)
+	if err != nil {
+		return err
+	}
+
+	args = map[string]interface{}{
+		"driver": "nvdimm",
+		"id":     "nvdimm" + id,
+		"memdev": "nvdimmbackmem" + id,
+	}
+	if err = q.executeCommand(ctx, "device_add", args, nil); err != nil {
+		q.cfg.Logger.Errorf("Unable to hotplug NVDIMM device: %v", err)
+		err2 := q.ExecuteObjectDel(ctx, "nvdimmbackmem"+id)
+		if err2 != nil {
+			q.cfg.Logger.Warningf("Unable to clean up memory object: %v", err2)
+		}
+	}
+
+	return err
 }
 
 // ExecuteBalloon sets the size of the balloon, hence updates the memory
@@ -1478,6 +2198,57 @@ func (q *QMP) ExecuteBalloon(ctx context.Context, bytes uint64) error {
 	return q.executeCommand(ctx, "balloon", args, nil)
 }
 
+// ExecuteQueryBalloon returns the current size of the guest memory.
+func (q *QMP) ExecuteQueryBalloon(ctx context.Context) (BalloonInfo, error) {
+	var info BalloonInfo
+
+	response, err := q.executeCommandWithResponse(ctx, "query-balloon", nil, nil, nil)
+	if err != nil {
+		return info, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return info, fmt.Errorf("unable to extract balloon information: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("unable to convert json to balloon information: %v", err)
+	}
+
+	return info, nil
+}
+
+// ExecuteSetBalloonStatsPollingInterval sets the interval in seconds at
+// which the guest memory statistics of the balloon device id are updated.
+// The statistics are disabled when seconds is zero.
+func (q *QMP) ExecuteSetBalloonStatsPollingInterval(ctx context.Context, id string, seconds uint64) error {
+	return q.ExecQomSet(ctx, peripheralPath+id, "guest-stats-polling-interval", seconds)
+}
+
+// ExecuteQueryBalloonStats returns the guest memory statistics reported
+// through the balloon device id. The statistics are only updated when a
+// polling interval is set on the device.
+func (q *QMP) ExecuteQueryBalloonStats(ctx context.Context, id string) (BalloonStats, error) {
+	var stats BalloonStats
+
+	response, err := q.ExecQomGet(ctx, peripheralPath+id, "guest-stats")
+	if err != nil {
+		return stats, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return stats, fmt.Errorf("unable to extract balloon statistics: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("unable to convert json to balloon statistics: %v", err)
+	}
+
+	return stats, nil
+}
+
 // ExecutePCIVSockAdd adds a vhost-vsock-pci bus
 // disableModern indicates if virtio version 1.0 should be replaced by the
 // former version 0.9, as there is a KVM bug that occurs when using virtio
@@ -1585,6 +2356,92 @@ func (q *QMP) ExecuteMigrationIncoming(ctx context.Context, uri string) error {
 	return q.executeCommand(ctx, "migrate-incoming", args, nil)
 }
 
+// ExecuteCalcDirtyRate starts a guest dirty rate measurement lasting
+// calcTime seconds.  samplePages is the number of pages sampled per GiB of
+// guest memory and is only used in DirtyRatePageSampling mode, a zero value
+// selects the QEMU default.  mode is optional.  The function returns as soon
+// as the measurement has started, ExecuteQueryDirtyRate can then be used to
+// retrieve its results.
+func (q *QMP) ExecuteCalcDirtyRate(ctx context.Context, calcTime int64, samplePages uint64, mode DirtyRateMeasureMode) error {
+	args := map[string]interface{}{
+		"calc-time": calcTime,
+	}
+
+	if samplePages > 0 && (mode == "" || mode == DirtyRatePageSampling) {
+		args["sample-pages"] = samplePages
+	}
+	if mode != "" {
+		args["mode"] = mode
+	}
+
+	return q.executeCommand(ctx, "calc-dirty-rate", args, nil)
+}
+
+// ExecuteQueryDirtyRate queries the status and the results of the last
+// guest dirty rate measurement.
+func (q *QMP) ExecuteQueryDirtyRate(ctx context.Context) (DirtyRateInfo, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-dirty-rate", nil, nil, nil)
+	if err != nil {
+		return DirtyRateInfo{}, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return DirtyRateInfo{}, fmt.Errorf("unable to extract dirty rate information: %v", err)
+	}
+
+	var info DirtyRateInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return DirtyRateInfo{}, fmt.Errorf("unable to convert dirty rate information: %v", err)
+	}
+
+	return info, nil
+}
+
+// dirtyRatePollInterval is the delay between two query-dirty-rate commands
+// issued while waiting for a measurement to complete.
+const dirtyRatePollInterval = 100 * time.Millisecond
+
+// MeasureDirtyRate measures the rate at which the guest dirties its memory
+// over duration, which is rounded up to the nearest second.  It is meant to
+// be called before starting a migration to decide between a pre-copy and a
+// post-copy migration.  The function blocks until the measurement completes
+// or ctx is cancelled.  When mode is DirtyRateDirtyRing the returned
+// DirtyRateInfo contains the dirty rate of each vCPU.
+func (q *QMP) MeasureDirtyRate(ctx context.Context, duration time.Duration, mode DirtyRateMeasureMode) (DirtyRateInfo, error) {
+	calcTime := int64((duration + time.Second - 1) / time.Second)
+	if calcTime < 1 {
+		calcTime = 1
+	}
+
+	if err := q.ExecuteCalcDirtyRate(ctx, calcTime, 0, mode); err != nil {
+		return DirtyRateInfo{}, err
+	}
+
+	wait := time.Duration(calcTime) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return DirtyRateInfo{}, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		info, err := q.ExecuteQueryDirtyRate(ctx)
+		if err != nil {
+			return DirtyRateInfo{}, err
+		}
+
+		switch info.Status {
+		case DirtyRateMeasured:
+			return info, nil
+		case DirtyRateMeasuring:
+			wait = dirtyRatePollInterval
+		default:
+			return DirtyRateInfo{}, fmt.Errorf("unexpected dirty rate measurement status %q", info.Status)
+		}
+	}
+}
+
 // ExecQueryQmpSchema query all QMP wire ABI and returns a slice
 func (q *QMP) ExecQueryQmpSchema(ctx context.Context) ([]SchemaInfo, error) {
 	response, err := q.executeCommandWithResponse(ctx, "query-qmp-schema", nil, nil, nil)
@@ -1628,6 +2485,13 @@ func (q *QMP) ExecuteQueryStatus(ctx context.Context) (StatusInfo, error) {
 
 // ExecQomSet qom-set path property value
 func (q *QMP) ExecQomSet(ctx context.Context, path, property string, value uint64) error {
+	return q.ExecQomSetValue(ctx, path, property, value)
+}
+
+// ExecQomSetValue qom-set path property value, where value can be of any
+// type that is encoded to the JSON value expected by the property, e.g. a
+// bool, a string, an integer or a structure.
+func (q *QMP) ExecQomSetValue(ctx context.Context, path, property string, value interface{}) error {
 	args := map[string]interface{}{
 		"path":     path,
 		"property": property,
@@ -1652,13 +2516,852 @@ func (q *QMP) ExecQomGet(ctx context.Context, path, property string) (interface{
 	return response, nil
 }
 
-// ExecuteDumpGuestMemory dump guest memory to host
-func (q *QMP) ExecuteDumpGuestMemory(ctx context.Context, protocol string, paging bool, format string) error {
+// ExecQomGetBool returns the value of the bool property of the object path.
+func (q *QMP) ExecQomGetBool(ctx context.Context, path, property string) (bool, error) {
+	var value bool
+	err := q.ExecQomGetObject(ctx, path, property, &value)
+	return value, err
+}
+
+// ExecQomGetString returns the value of the string property of the object
+// path.
+func (q *QMP) ExecQomGetString(ctx context.Context, path, property string) (string, error) {
+	var value string
+	err := q.ExecQomGetObject(ctx, path, property, &value)
+	return value, err
+}
+
+// ExecQomGetInt returns the value of the integer property of the object
+// path.
+func (q *QMP) ExecQomGetInt(ctx context.Context, path, property string) (int64, error) {
+	var value int64
+	err := q.ExecQomGetObject(ctx, path, property, &value)
+	return value, err
+}
+
+// ExecQomGetObject decodes the value of the property of the object path
+// into value, which must be a pointer.
+func (q *QMP) ExecQomGetObject(ctx context.Context, path, property string, value interface{}) error {
+	response, err := q.ExecQomGet(ctx, path, property)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("unable to extract property %s information: %v", property, err)
+	}
+
+	if err = json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("unable to convert json to property %s: %v", property, err)
+	}
+
+	return nil
+}
+
+// QOMProperty describes a property of a QOM object.
+type QOMProperty struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+
+	// DefaultValue is the default value of the property, if any.
+	DefaultValue interface{} `json:"default-value,omitempty"`
+}
+
+// QOMType describes a QOM type.
+type QOMType struct {
+	Name     string `json:"name"`
+	Abstract bool   `json:"abstract,omitempty"`
+	Parent   string `json:"parent,omitempty"`
+}
+
+// QOMNode is a node of the QOM composition tree.
+type QOMNode struct {
+	// Path is the QOM path of the object.
+	Path string
+
+	// Type is the QOM type of the object.
+	Type string
+
+	// Properties are the properties of the object, including the
+	// child properties.
+	Properties []QOMProperty
+
+	// Children are the child objects of the object.
+	Children []*QOMNode
+}
+
+// ExecQomList returns the properties of the object path.
+func (q *QMP) ExecQomList(ctx context.Context, path string) ([]QOMProperty, error) {
 	args := map[string]interface{}{
-		"protocol": protocol,
-		"paging":   paging,
-		"format":   format,
+		"path": path,
 	}
 
-	return q.executeCommand(ctx, "dump-guest-memory", args, nil)
+	response, err := q.executeCommandWithResponse(ctx, "qom-list", args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract QOM properties information: %v", err)
+	}
+
+	var props []QOMProperty
+	if err = json.Unmarshal(data, &props); err != nil {
+		return nil, fmt.Errorf("unable to convert json to QOM properties: %v", err)
+	}
+
+	return props, nil
+}
+
+// ExecQomListTypes returns the QOM types implementing the type implements,
+// or all the types if implements is empty.  The abstract types are only
+// returned if abstract is true.
+func (q *QMP) ExecQomListTypes(ctx context.Context, implements string, abstract bool) ([]QOMType, error) {
+	args := map[string]interface{}{
+		"abstract": abstract,
+	}
+	if implements != "" {
+		args["implements"] = implements
+	}
+
+	response, err := q.executeCommandWithResponse(ctx, "qom-list-types", args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract QOM types information: %v", err)
+	}
+
+	var types []QOMType
+	if err = json.Unmarshal(data, &types); err != nil {
+		return nil, fmt.Errorf("unable to convert json to QOM types: %v", err)
+	}
+
+	return types, nil
+}
+
+// ExecDeviceListProperties returns the properties of the device driver
+// typename.
+func (q *QMP) ExecDeviceListProperties(ctx context.Context, typename string) ([]QOMProperty, error) {
+	return q.execListProperties(ctx, "device-list-properties", typename)
+}
+
+// ExecQomListProperties returns the properties of the QOM type typename.
+func (q *QMP) ExecQomListProperties(ctx context.Context, typename string) ([]QOMProperty, error) {
+	return q.execListProperties(ctx, "qom-list-properties", typename)
+}
+
+func (q *QMP) execListProperties(ctx context.Context, command, typename string) ([]QOMProperty, error) {
+	args := map[string]interface{}{
+		"typename": typename,
+	}
+
+	response, err := q.executeCommandWithResponse(ctx, command, args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract %s properties information: %v", typename, err)
+	}
+
+	var props []QOMProperty
+	if err = json.Unmarshal(data, &props); err != nil {
+		return nil, fmt.Errorf("unable to convert json to %s properties: %v", typename, err)
+	}
+
+	return props, nil
+}
+
+// MachineInfo describes a machine type supported by qemu.
+type MachineInfo struct {
+	Name             string `json:"name"`
+	Alias            string `json:"alias,omitempty"`
+	IsDefault        bool   `json:"is-default,omitempty"`
+	CPUMax           int    `json:"cpu-max"`
+	HotpluggableCPUs bool   `json:"hotpluggable-cpus"`
+	NUMAMemSupported bool   `json:"numa-mem-supported"`
+	Deprecated       bool   `json:"deprecated"`
+	DefaultCPUType   string `json:"default-cpu-type,omitempty"`
+	DefaultRAMID     string `json:"default-ram-id,omitempty"`
+}
+
+// CPUDefinition describes a CPU model supported by qemu.
+type CPUDefinition struct {
+	Name                string   `json:"name"`
+	Typename            string   `json:"typename"`
+	Static              bool     `json:"static"`
+	MigrationSafe       bool     `json:"migration-safe,omitempty"`
+	UnavailableFeatures []string `json:"unavailable-features,omitempty"`
+	AliasOf             string   `json:"alias-of,omitempty"`
+	Deprecated          bool     `json:"deprecated"`
+}
+
+// ExecQueryMachines returns the machine types supported by qemu.
+func (q *QMP) ExecQueryMachines(ctx context.Context) ([]MachineInfo, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-machines", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract machines information: %v", err)
+	}
+
+	var machines []MachineInfo
+	if err = json.Unmarshal(data, &machines); err != nil {
+		return nil, fmt.Errorf("unable to convert json to machines information: %v", err)
+	}
+
+	return machines, nil
+}
+
+// ExecQueryCPUDefinitions returns the CPU models supported by qemu.
+func (q *QMP) ExecQueryCPUDefinitions(ctx context.Context) ([]CPUDefinition, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-cpu-definitions", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract CPU definitions information: %v", err)
+	}
+
+	var cpus []CPUDefinition
+	if err = json.Unmarshal(data, &cpus); err != nil {
+		return nil, fmt.Errorf("unable to convert json to CPU definitions: %v", err)
+	}
+
+	return cpus, nil
+}
+
+// CaptureDeviceDatabase returns the properties of the device drivers with
+// device-list-properties.  The properties of all the device drivers are
+// captured if drivers is empty.
+func (q *QMP) CaptureDeviceDatabase(ctx context.Context, drivers ...string) (DeviceDatabase, error) {
+	if len(drivers) == 0 {
+		types, err := q.ExecQomListTypes(ctx, "device", false)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range types {
+			drivers = append(drivers, t.Name)
+		}
+	}
+
+	db := make(DeviceDatabase)
+	for _, driver := range drivers {
+		props, err := q.ExecDeviceListProperties(ctx, driver)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the properties of %s: %v", driver, err)
+		}
+
+		db[driver] = make(map[string]string)
+		for _, p := range props {
+			db[driver][p.Name] = p.Type
+		}
+	}
+
+	return db, nil
+}
+
+// childType returns the type of the child objects of a child<type> property.
+func childType(propType string) (string, bool) {
+	if !strings.HasPrefix(propType, "child<") || !strings.HasSuffix(propType, ">") {
+		return "", false
+	}
+
+	return propType[len("child<") : len(propType)-1], true
+}
+
+func (q *QMP) walkQomTree(ctx context.Context, node *QOMNode) error {
+	props, err := q.ExecQomList(ctx, node.Path)
+	if err != nil {
+		return err
+	}
+	node.Properties = props
+
+	for _, p := range props {
+		t, ok := childType(p.Type)
+		if !ok {
+			continue
+		}
+
+		child := &QOMNode{
+			Path: strings.TrimSuffix(node.Path, "/") + "/" + p.Name,
+			Type: t,
+		}
+		if err = q.walkQomTree(ctx, child); err != nil {
+			return err
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	return nil
+}
+
+// WalkQomTree returns the QOM composition tree rooted at the object path,
+// e.g. /machine.  The tree is discovered by listing the child properties
+// of every object with qom-list.
+func (q *QMP) WalkQomTree(ctx context.Context, path string) (*QOMNode, error) {
+	rootType, err := q.ExecQomGetString(ctx, path, "type")
+	if err != nil {
+		return nil, err
+	}
+
+	root := &QOMNode{
+		Path: path,
+		Type: rootType,
+	}
+	if err = q.walkQomTree(ctx, root); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+// ExecuteDumpGuestMemory dump guest memory to host
+func (q *QMP) ExecuteDumpGuestMemory(ctx context.Context, protocol string, paging bool, format string) error {
+	args := map[string]interface{}{
+		"protocol": protocol,
+		"paging":   paging,
+		"format":   format,
+	}
+
+	return q.executeCommand(ctx, "dump-guest-memory", args, nil)
+}
+
+// dumpPollInterval is the delay between two query-dump commands issued while
+// waiting for a guest memory dump to end.
+const dumpPollInterval = 500 * time.Millisecond
+
+// ExecuteDumpGuestMemoryDetach starts dumping the guest memory to host, and
+// returns without waiting for the dump to end.  The progress of the dump is
+// reported by ExecuteQueryDump, and its end by the DUMP_COMPLETED event.
+func (q *QMP) ExecuteDumpGuestMemoryDetach(ctx context.Context, protocol string, opts DumpGuestMemoryOptions) error {
+	format := opts.Format
+	if format == "" {
+		format = DumpFormatELF
+	}
+
+	args := map[string]interface{}{
+		"protocol": protocol,
+		"paging":   opts.Paging,
+		"format":   format,
+		"detach":   true,
+	}
+	if opts.Length > 0 {
+		args["begin"] = opts.Begin
+		args["length"] = opts.Length
+	}
+
+	return q.executeCommand(ctx, "dump-guest-memory", args, nil)
+}
+
+// ExecuteQueryDump returns the progress of the current, or last, guest
+// memory dump.
+func (q *QMP) ExecuteQueryDump(ctx context.Context) (DumpQueryResult, error) {
+	var result DumpQueryResult
+
+	response, err := q.executeCommandWithResponse(ctx, "query-dump", nil, nil, nil)
+	if err != nil {
+		return result, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return result, fmt.Errorf("unable to extract dump information: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("unable to convert json to dump information: %v", err)
+	}
+
+	return result, nil
+}
+
+// ExecuteQueryDumpGuestMemoryCapability returns the dump formats supported
+// by qemu.
+func (q *QMP) ExecuteQueryDumpGuestMemoryCapability(ctx context.Context) ([]DumpFormat, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-dump-guest-memory-capability", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract dump capability information: %v", err)
+	}
+
+	var capability struct {
+		Formats []DumpFormat `json:"formats"`
+	}
+	if err = json.Unmarshal(data, &capability); err != nil {
+		return nil, fmt.Errorf("unable to convert json to dump capability information: %v", err)
+	}
+
+	return capability.Formats, nil
+}
+
+// DecodeDumpCompleted returns the data of a DUMP_COMPLETED event.
+func DecodeDumpCompleted(ev QMPEvent) (DumpCompleted, error) {
+	var completed DumpCompleted
+
+	if ev.Name != "DUMP_COMPLETED" {
+		return completed, fmt.Errorf("unexpected event %s", ev.Name)
+	}
+
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return completed, fmt.Errorf("unable to extract dump completion information: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &completed); err != nil {
+		return completed, fmt.Errorf("unable to convert json to dump completion: %v", err)
+	}
+
+	return completed, nil
+}
+
+// DumpGuestMemory dumps the guest memory to host in the background, and
+// waits for the dump to end.  Unlike ExecuteDumpGuestMemory, the QMP
+// commands issued do not last for the whole dump.  The dump is polled with
+// query-dump, and progress, if not nil, is called with each result, until
+// the DUMP_COMPLETED event is received.
+func (q *QMP) DumpGuestMemory(ctx context.Context, protocol string, opts DumpGuestMemoryOptions,
+	progress func(DumpQueryResult)) (DumpQueryResult, error) {
+	// The events are received by their own goroutine, so that the QMP
+	// loop is not blocked while query-dump runs.
+	completedCh := make(chan QMPEvent, 1)
+	l := q.addEventListener()
+	go func() {
+		for {
+			select {
+			case <-l.done:
+				return
+			case ev := <-l.ch:
+				if ev.Name == "DUMP_COMPLETED" {
+					select {
+					case completedCh <- ev:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	defer q.removeEventListener(l)
+
+	if err := q.ExecuteDumpGuestMemoryDetach(ctx, protocol, opts); err != nil {
+		return DumpQueryResult{}, err
+	}
+
+	return q.waitForDump(ctx, completedCh, progress)
+}
+
+func (q *QMP) waitForDump(ctx context.Context, completedCh <-chan QMPEvent,
+	progress func(DumpQueryResult)) (DumpQueryResult, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return DumpQueryResult{}, ctx.Err()
+		case <-q.disconnectedCh:
+			return DumpQueryResult{}, fmt.Errorf("lost connection to qemu")
+		case ev := <-completedCh:
+			return dumpCompletedResult(ev)
+		case <-time.After(dumpPollInterval):
+		}
+
+		result, err := q.ExecuteQueryDump(ctx)
+		if err != nil {
+			return result, err
+		}
+		if progress != nil {
+			progress(result)
+		}
+
+		switch result.Status {
+		case "completed":
+			return result, nil
+		case "failed":
+			// The DUMP_COMPLETED event, which holds the error, is
+			// emitted right after the status is set.
+			select {
+			case ev := <-completedCh:
+				return dumpCompletedResult(ev)
+			case <-time.After(dumpPollInterval):
+				return result, fmt.Errorf("dump failed")
+			}
+		}
+	}
+}
+
+func dumpCompletedResult(ev QMPEvent) (DumpQueryResult, error) {
+	completed, err := DecodeDumpCompleted(ev)
+	if err != nil {
+		return completed.Result, err
+	}
+	if completed.Error != "" {
+		return completed.Result, fmt.Errorf("dump failed: %s", completed.Error)
+	}
+
+	return completed.Result, nil
+}
+
+// jobPollInterval is the delay between two query-jobs commands issued while
+// waiting for a job to conclude.
+const jobPollInterval = 100 * time.Millisecond
+
+// ExecuteQueryJobs returns a slice with the list of the background jobs
+// known to the QEMU instance.
+func (q *QMP) ExecuteQueryJobs(ctx context.Context) ([]JobInfo, error) {
+	response, err := q.executeCommandWithResponse(ctx, "query-jobs", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract jobs information: %v", err)
+	}
+
+	var jobs []JobInfo
+	if err = json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("unable to convert json to JobInfo: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// ExecuteJobDismiss deletes a concluded job.  id is the identifier of the
+// job to dismiss.
+func (q *QMP) ExecuteJobDismiss(ctx context.Context, id string) error {
+	args := map[string]interface{}{
+		"id": id,
+	}
+
+	return q.executeCommand(ctx, "job-dismiss", args, nil)
+}
+
+// waitForJob polls the QEMU instance until the job identified by id has
+// concluded, dismisses it and returns the error reported by the job, if any.
+func (q *QMP) waitForJob(ctx context.Context, id string) error {
+	for {
+		jobs, err := q.ExecuteQueryJobs(ctx)
+		if err != nil {
+			return err
+		}
+
+		var job *JobInfo
+		for i := range jobs {
+			if jobs[i].ID == id {
+				job = &jobs[i]
+				break
+			}
+		}
+		if job == nil {
+			return fmt.Errorf("job %s not found", id)
+		}
+
+		if job.Status == "concluded" {
+			if err = q.ExecuteJobDismiss(ctx, id); err != nil {
+				q.cfg.Logger.Warningf("Unable to dismiss job %s: %v", id, err)
+			}
+			if job.Error != "" {
+				return fmt.Errorf("job %s failed: %s", id, job.Error)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// executeSnapshotJob starts one of the snapshot-save, snapshot-load and
+// snapshot-delete jobs and waits for it to conclude.
+func (q *QMP) executeSnapshotJob(ctx context.Context, name, jobID, tag, vmstate string, devices []string) error {
+	args := map[string]interface{}{
+		"job-id":  jobID,
+		"tag":     tag,
+		"devices": devices,
+	}
+	if vmstate != "" {
+		args["vmstate"] = vmstate
+	}
+
+	if err := q.executeCommand(ctx, name, args, nil); err != nil {
+		return err
+	}
+
+	return q.waitForJob(ctx, jobID)
+}
+
+// ExecuteSnapshotSave creates an internal snapshot of the whole VM using the
+// snapshot-save job.  jobID is the identifier of the job, it must be a valid
+// QMP identifier.  tag is the name of the snapshot.  vmstate is the name of
+// the block node that will store the VM state, and devices is the list of
+// block nodes to snapshot.  All these nodes must support internal snapshots,
+// e.g., qcow2 nodes created from a BlockDevice with a NodeName.  This function
+// blocks until the job has concluded.
+func (q *QMP) ExecuteSnapshotSave(ctx context.Context, jobID, tag, vmstate string, devices []string) error {
+	return q.executeSnapshotJob(ctx, "snapshot-save", jobID, tag, vmstate, devices)
+}
+
+// ExecuteSnapshotLoad restores the VM from the internal snapshot tag using
+// the snapshot-load job.  Its parameters have the same meaning as the ones
+// of ExecuteSnapshotSave.  This function blocks until the job has concluded.
+func (q *QMP) ExecuteSnapshotLoad(ctx context.Context, jobID, tag, vmstate string, devices []string) error {
+	return q.executeSnapshotJob(ctx, "snapshot-load", jobID, tag, vmstate, devices)
+}
+
+// ExecuteSnapshotDelete deletes the internal snapshot tag from the block nodes
+// listed in devices using the snapshot-delete job.  This function blocks until
+// the job has concluded.
+func (q *QMP) ExecuteSnapshotDelete(ctx context.Context, jobID, tag string, devices []string) error {
+	return q.executeSnapshotJob(ctx, "snapshot-delete", jobID, tag, "", devices)
+}
+
+// ExecuteQuerySnapshots returns the internal snapshots stored in each qcow2
+// block node, indexed by node name.
+func (q *QMP) ExecuteQuerySnapshots(ctx context.Context) (map[string][]SnapshotInfo, error) {
+	args := map[string]interface{}{
+		"flat": true,
+	}
+
+	response, err := q.executeCommandWithResponse(ctx, "query-named-block-nodes", args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract block nodes information: %v", err)
+	}
+
+	var nodes []struct {
+		NodeName string `json:"node-name"`
+		Driver   string `json:"drv"`
+		Image    struct {
+			Snapshots []SnapshotInfo `json:"snapshots"`
+		} `json:"image"`
+	}
+	if err = json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("unable to convert json to block nodes: %v", err)
+	}
+
+	snapshots := make(map[string][]SnapshotInfo)
+	for _, n := range nodes {
+		if n.Driver != string(QCOW2) {
+			continue
+		}
+		snapshots[n.NodeName] = n.Image.Snapshots
+	}
+
+	return snapshots, nil
+}
+
+// RunStateWatcher keeps track of the run state of the guest monitored by a
+// QMP instance, out of the QMP events.
+type RunStateWatcher struct {
+	q    *QMP
+	l    *qmpEventListener
+	done chan struct{}
+
+	lock      sync.Mutex
+	state     RunState
+	changed   chan struct{}
+	callbacks []func(from, to RunState)
+	stopped   bool
+
+	// pending are the events received before the initial state is
+	// known.
+	pending []QMPEvent
+}
+
+// WatchRunState starts tracking the run state of the guest.  The initial
+// state is queried with query-status, and then updated out of the STOP,
+// RESUME, SHUTDOWN, SUSPEND, WAKEUP, GUEST_PANICKED, WATCHDOG and RESET
+// events.  The watcher stops when the QMP connection is lost or Stop is
+// called.
+func (q *QMP) WatchRunState(ctx context.Context) (*RunStateWatcher, error) {
+	w := &RunStateWatcher{
+		q:       q,
+		l:       q.addEventListener(),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go w.loop()
+
+	status, err := q.ExecuteQueryStatus(ctx)
+	if err != nil {
+		w.Stop()
+		return nil, err
+	}
+
+	w.setInitialState(status.RunState())
+
+	return w, nil
+}
+
+// setInitialState sets the state reported by query-status, and applies the
+// events received in the meantime.  Whether these events precede the state
+// or not is unknown, but applying them again leads to the same state.
+func (w *RunStateWatcher) setInitialState(state RunState) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.state = state
+	for _, ev := range w.pending {
+		w.state = nextRunState(w.state, ev)
+	}
+	w.pending = nil
+
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+func (w *RunStateWatcher) loop() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.l.done:
+			return
+		case <-w.q.disconnectedCh:
+			return
+		case ev := <-w.l.ch:
+			w.update(ev)
+		}
+	}
+}
+
+// nextRunState returns the run state following the event ev in the state
+// from.
+func nextRunState(from RunState, ev QMPEvent) RunState {
+	switch ev.Name {
+	case "STOP":
+		// STOP follows the events of the specific paused states.
+		switch from {
+		case RunStateShutdown, RunStateGuestPanicked, RunStateWatchdog, RunStateIOError:
+			return from
+		}
+		return RunStatePaused
+	case "RESUME", "WAKEUP":
+		return RunStateRunning
+	case "SHUTDOWN":
+		return RunStateShutdown
+	case "SUSPEND":
+		return RunStateSuspended
+	case "GUEST_PANICKED":
+		if action, _ := ev.Data["action"].(string); action == "run" {
+			return from
+		}
+		return RunStateGuestPanicked
+	case "WATCHDOG":
+		if action, _ := ev.Data["action"].(string); action == string(WatchdogActionPause) {
+			return RunStateWatchdog
+		}
+		return from
+	case "RESET":
+		// qemu goes back to prelaunch when a stopped guest is reset.
+		switch from {
+		case RunStateRunning, RunStateInMigrate, RunStateFinishMigrate:
+			return from
+		}
+		return RunStatePrelaunch
+	}
+
+	return from
+}
+
+func (w *RunStateWatcher) update(ev QMPEvent) {
+	w.lock.Lock()
+	from := w.state
+	if from == "" {
+		w.pending = append(w.pending, ev)
+		w.lock.Unlock()
+		return
+	}
+
+	to := nextRunState(from, ev)
+	if to == from {
+		w.lock.Unlock()
+		return
+	}
+
+	w.state = to
+	close(w.changed)
+	w.changed = make(chan struct{})
+	callbacks := append([]func(from, to RunState){}, w.callbacks...)
+	w.lock.Unlock()
+
+	for _, fn := range callbacks {
+		fn(from, to)
+	}
+}
+
+// State returns the current run state of the guest.
+func (w *RunStateWatcher) State() RunState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.state
+}
+
+// OnTransition registers fn to be called on each run state transition.  fn
+// is called by the goroutine of the watcher, and must not block.
+func (w *RunStateWatcher) OnTransition(fn func(from, to RunState)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.callbacks = append(w.callbacks, fn)
+}
+
+// WaitForState waits for the guest to be in one of the run states states,
+// and returns the run state.
+func (w *RunStateWatcher) WaitForState(ctx context.Context, states ...RunState) (RunState, error) {
+	for {
+		w.lock.Lock()
+		state := w.state
+		changed := w.changed
+		w.lock.Unlock()
+
+		for _, s := range states {
+			if s == state {
+				return state, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, ctx.Err()
+		case <-w.done:
+			return state, fmt.Errorf("run state watcher stopped in state %s", state)
+		case <-changed:
+		}
+	}
+}
+
+// Stop stops the watcher.
+func (w *RunStateWatcher) Stop() {
+	w.lock.Lock()
+	stopped := w.stopped
+	w.stopped = true
+	w.lock.Unlock()
+
+	if !stopped {
+		w.q.removeEventListener(w.l)
+	}
+	<-w.done
 }
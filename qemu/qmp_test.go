@@ -725,6 +725,101 @@ func TestQMPDeviceDel(t *testing.T) {
 	wg.Wait()
 }
 
+// Checks that memory is hot unplugged and its backend deleted once the
+// guest has released it.
+func TestHotunplugMemory(t *testing.T) {
+	var wg sync.WaitGroup
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_del", nil, "return", nil)
+	buf.AddEvent("DEVICE_DELETED", time.Millisecond*200,
+		map[string]interface{}{
+			"device": "dimmmem0",
+			"path":   "/machine/peripheral/dimmmem0",
+		}, nil)
+	buf.AddCommand("object-del", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	buf.startEventLoop(&wg)
+	err := q.HotunplugMemory(context.Background(), "mem0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+	wg.Wait()
+}
+
+// Checks that a *MemoryUnplugError is returned when the guest refuses to
+// release the memory, and that the memory backend is not deleted.
+func TestHotunplugMemoryRefused(t *testing.T) {
+	var wg sync.WaitGroup
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_del", nil, "return", nil)
+	buf.AddEvent("MEMORY_DEVICE_UNPLUG_ERROR", time.Millisecond*200,
+		map[string]interface{}{
+			"device":   "dimmmem1",
+			"qom-path": "/machine/peripheral/dimmmem1",
+			"msg":      "Memory hotunplug rejected by the guest",
+		}, nil)
+	buf.AddEvent("MEMORY_DEVICE_UNPLUG_ERROR", time.Millisecond*200,
+		map[string]interface{}{
+			"device":   "dimmmem0",
+			"qom-path": "/machine/peripheral/dimmmem0",
+			"msg":      "Memory hotunplug rejected by the guest",
+		}, nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	buf.startEventLoop(&wg)
+	err := q.HotunplugMemory(context.Background(), "mem0")
+	unplugErr, ok := err.(*MemoryUnplugError)
+	if !ok {
+		t.Fatalf("Expected a *MemoryUnplugError, got %v", err)
+	}
+	if unplugErr.Device != "dimmmem0" || unplugErr.Msg != "Memory hotunplug rejected by the guest" {
+		t.Fatalf("Unexpected error %v", unplugErr)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+	wg.Wait()
+}
+
+// Checks that a *MemoryUnplugError is returned when the guest refuses to
+// release the memory and qemu reports it with a DEVICE_UNPLUG_GUEST_ERROR
+// event.
+func TestHotunplugMemoryGuestError(t *testing.T) {
+	var wg sync.WaitGroup
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_del", nil, "return", nil)
+	buf.AddEvent("DEVICE_UNPLUG_GUEST_ERROR", time.Millisecond*200,
+		map[string]interface{}{
+			"device": "dimmmem0",
+			"path":   "/machine/peripheral/dimmmem0",
+		}, nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	buf.startEventLoop(&wg)
+	err := q.HotunplugMemory(context.Background(), "mem0")
+	unplugErr, ok := err.(*MemoryUnplugError)
+	if !ok {
+		t.Fatalf("Expected a *MemoryUnplugError, got %v", err)
+	}
+	if unplugErr.Device != "dimmmem0" || unplugErr.Msg == "" {
+		t.Fatalf("Unexpected error %v", unplugErr)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+	wg.Wait()
+}
+
 // Checks that contexts can be used to timeout a command.
 //
 // We start a QMPLoop and send the device_del command with a context that times
@@ -1213,6 +1308,113 @@ func TestQMPExecuteQueryMemoryDevices(t *testing.T) {
 	<-disconnectedCh
 }
 
+var testVirtioMemDevices = []MemoryDevices{
+	{
+		Type: "dimm",
+		Data: MemoryDevicesData{
+			Memdev: "dimm1",
+			ID:     "mem1",
+			Size:   1 << 30,
+		},
+	},
+	{
+		Type: "virtio-mem",
+		Data: MemoryDevicesData{
+			Memaddr:       1 << 32,
+			Memdev:        "/objects/vmem0",
+			ID:            "vm0",
+			Size:          1 << 30,
+			RequestedSize: 2 << 30,
+			MaxSize:       4 << 30,
+			BlockSize:     2 << 20,
+		},
+	},
+}
+
+// Checks that virtio-mem devices are found in the memory devices
+func TestExecuteQueryVirtioMem(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("query-memory-devices", nil, "return", testVirtioMemDevices)
+	buf.AddCommand("query-memory-devices", nil, "return", testVirtioMemDevices)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	dev, err := q.ExecuteQueryVirtioMem(context.Background(), "vm0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(dev, testVirtioMemDevices[1].Data) {
+		t.Fatalf("Expected %v equals to %v", dev, testVirtioMemDevices[1].Data)
+	}
+	_, err = q.ExecuteQueryVirtioMem(context.Background(), "mem1")
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that a virtio-mem device is resized and that the resize
+// completion is detected
+func TestExecuteVirtioMemResize(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("qom-set", nil, "return", nil)
+	buf.AddCommand("query-memory-devices", nil, "return", testVirtioMemDevices)
+	resized := []MemoryDevices{testVirtioMemDevices[1]}
+	resized[0].Data.Size = resized[0].Data.RequestedSize
+	buf.AddCommand("query-memory-devices", nil, "return", resized)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteVirtioMemResize(context.Background(), "vm0", 2<<30)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dev, err := q.WaitVirtioMemResize(context.Background(), "vm0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if dev.Size != 2<<30 {
+		t.Fatalf("Unexpected virtio-mem device size %d", dev.Size)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that MEMORY_DEVICE_SIZE_CHANGE events are decoded
+func TestDecodeMemoryDeviceSizeChange(t *testing.T) {
+	ev := QMPEvent{
+		Name: "MEMORY_DEVICE_SIZE_CHANGE",
+		Data: map[string]interface{}{
+			"id":       "vm0",
+			"size":     float64(1 << 30),
+			"qom-path": "/machine/peripheral/vm0",
+		},
+	}
+	expected := MemoryDeviceSizeChange{
+		ID:      "vm0",
+		Size:    1 << 30,
+		QOMPath: "/machine/peripheral/vm0",
+	}
+
+	change, err := DecodeMemoryDeviceSizeChange(ev)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if change != expected {
+		t.Fatalf("Expected %v equals to %v", change, expected)
+	}
+
+	ev.Name = "DEVICE_DELETED"
+	if _, err = DecodeMemoryDeviceSizeChange(ev); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
 // Checks that cpus are listed correctly
 func TestQMPExecuteQueryCpus(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
@@ -1287,39 +1489,52 @@ func TestQMPExecuteQueryCpusFast(t *testing.T) {
 	<-disconnectedCh
 }
 
-// Checks that migrate capabilities can be set
-func TestExecSetMigrationCaps(t *testing.T) {
+// Checks query-iothreads
+func TestExecuteQueryIOThreads(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("migrate-set-capabilities", nil, "return", nil)
-	cfg := QMPConfig{Logger: qmpTestLogger{}}
-	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
-	checkVersion(t, connectedCh)
-	caps := []map[string]interface{}{
+	ioThreads := []IOThreadInfo{
 		{
-			"capability": "bypass-shared-memory",
-			"state":      true,
+			ID:         "iothread0",
+			ThreadID:   4242,
+			PollMaxNs:  32768,
+			PollGrow:   2,
+			PollShrink: 2,
 		},
 	}
-	err := q.ExecSetMigrationCaps(context.Background(), caps)
+	buf.AddCommand("query-iothreads", nil, "return", ioThreads)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	threads, err := q.ExecuteQueryIOThreads(context.Background())
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	if !reflect.DeepEqual(threads, ioThreads) {
+		t.Fatalf("Expected %v equals to %v", threads, ioThreads)
+	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks that migrate arguments can be set
-func TestExecSetMigrateArguments(t *testing.T) {
+// Checks that the IO thread polling is tuned
+func TestExecuteSetIOThreadPolling(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("migrate", nil, "return", nil)
+	buf.AddCommand("qom-set", nil, "return", nil)
+	buf.AddCommand("qom-set", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecSetMigrateArguments(context.Background(), "exec:foobar")
+	pollMaxNs := uint64(65536)
+	ioThread := IOThread{
+		ID:        "iothread0",
+		PollMaxNs: &pollMaxNs,
+		PollGrow:  4,
+	}
+	err := q.ExecuteSetIOThreadPolling(context.Background(), ioThread)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -1327,160 +1542,411 @@ func TestExecSetMigrateArguments(t *testing.T) {
 	<-disconnectedCh
 }
 
-// Checks add memory device
-func TestExecMemdevAdd(t *testing.T) {
+// Checks that HotplugVCPUs plugs vCPUs into the first free slots and
+// returns the vCPUs reported by the guest.
+func TestHotplugVCPUs(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("object-add", nil, "return", nil)
+	hotpluggableCPUs := []HotpluggableCPU{
+		{
+			Type:       "host-x86_64-cpu",
+			VcpusCount: 1,
+			Properties: CPUProperties{Socket: 1},
+		},
+		{
+			Type:       "host-x86_64-cpu",
+			VcpusCount: 1,
+			Properties: CPUProperties{Socket: 0},
+			QOMPath:    "/machine/unattached/device[0]",
+		},
+		{
+			Type:       "host-x86_64-cpu",
+			VcpusCount: 1,
+			Properties: CPUProperties{Socket: 2},
+		},
+	}
+	cpus := []CPUInfoFast{
+		{
+			CPUIndex: 0,
+			QomPath:  "/machine/unattached/device[0]",
+			ThreadID: 1000,
+		},
+		{
+			CPUIndex: 1,
+			QomPath:  "/machine/peripheral/cpu-1-0-0-0",
+			ThreadID: 1001,
+			Props:    CPUProperties{Socket: 1},
+		},
+	}
+	buf.AddCommand("query-hotpluggable-cpus", nil, "return", hotpluggableCPUs)
 	buf.AddCommand("device_add", nil, "return", nil)
+	buf.AddCommand("query-cpus-fast", nil, "return", cpus)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecMemdevAdd(context.Background(), "memory-backend-ram", "mem0", "", 128, true, "virtio-mem-pci", "virtiomem0", "0x1", "pci-bridge-0")
+	c, err := q.HotplugVCPUs(context.Background(), 1)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	if !reflect.DeepEqual(c, cpus) {
+		t.Fatalf("Expected %v equals to %v", c, cpus)
+	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks hotplug memory
-func TestExecHotplugMemory(t *testing.T) {
+// Checks that HotplugVCPUs fails when there are not enough free slots.
+func TestHotplugVCPUsNoSlot(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("object-add", nil, "return", nil)
-	buf.AddCommand("device_add", nil, "return", nil)
+	hotpluggableCPUs := []HotpluggableCPU{
+		{
+			Type:    "host-x86_64-cpu",
+			QOMPath: "/machine/unattached/device[0]",
+		},
+		{
+			Type: "host-x86_64-cpu",
+		},
+	}
+	buf.AddCommand("query-hotpluggable-cpus", nil, "return", hotpluggableCPUs)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecHotplugMemory(context.Background(), "memory-backend-ram", "mem0", "", 128, true)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	_, err := q.HotplugVCPUs(context.Background(), 2)
+	if err == nil {
+		t.Fatalf("Expected error")
 	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks vsock-pci hotplug
-func TestExecutePCIVSockAdd(t *testing.T) {
+// Checks that UnplugVCPUs removes the last hotplugged vCPU and waits for
+// the guest to acknowledge the removal.
+func TestUnplugVCPUs(t *testing.T) {
+	var wg sync.WaitGroup
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("device_add", nil, "return", nil)
+	hotpluggableCPUs := []HotpluggableCPU{
+		{
+			Type:       "host-x86_64-cpu",
+			Properties: CPUProperties{Socket: 2},
+			QOMPath:    "/machine/peripheral/cpu-2-0-0-0",
+		},
+		{
+			Type:    "host-x86_64-cpu",
+			QOMPath: "/machine/unattached/device[0]",
+		},
+		{
+			Type:       "host-x86_64-cpu",
+			Properties: CPUProperties{Socket: 1},
+			QOMPath:    "/machine/peripheral/cpu-1-0-0-0",
+		},
+	}
+	cpus := []CPUInfoFast{
+		{
+			CPUIndex: 0,
+			QomPath:  "/machine/unattached/device[0]",
+			ThreadID: 1000,
+		},
+		{
+			CPUIndex: 1,
+			QomPath:  "/machine/peripheral/cpu-1-0-0-0",
+			ThreadID: 1001,
+			Props:    CPUProperties{Socket: 1},
+		},
+	}
+	buf.AddCommand("query-hotpluggable-cpus", nil, "return", hotpluggableCPUs)
+	buf.AddCommand("device_del", nil, "return", nil)
+	buf.AddEvent("DEVICE_DELETED", time.Millisecond*200,
+		map[string]interface{}{
+			"device": "cpu-2-0-0-0",
+			"path":   "/machine/peripheral/cpu-2-0-0-0",
+		}, nil)
+	buf.AddCommand("query-cpus-fast", nil, "return", cpus)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecutePCIVSockAdd(context.Background(), "vsock-pci0", "3", "1", "1", "1", "", true)
+	buf.startEventLoop(&wg)
+	c, err := q.UnplugVCPUs(context.Background(), 1)
 	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(c, cpus) {
+		t.Fatalf("Expected %v equals to %v", c, cpus)
 	}
 	q.Shutdown()
 	<-disconnectedCh
+	wg.Wait()
 }
 
-// Checks vhost-user-pci hotplug
-func TestExecutePCIVhostUserDevAdd(t *testing.T) {
+// Checks that migrate capabilities can be set
+func TestExecSetMigrationCaps(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("device_add", nil, "return", nil)
+	buf.AddCommand("migrate-set-capabilities", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	driver := "vhost-user-blk-pci"
-	devID := "vhost-user-blk0"
-	chardevID := "vhost-user-blk-char0"
-	err := q.ExecutePCIVhostUserDevAdd(context.Background(), driver, devID, chardevID, "1", "1")
+	caps := []map[string]interface{}{
+		{
+			"capability": "bypass-shared-memory",
+			"state":      true,
+		},
+	}
+	err := q.ExecSetMigrationCaps(context.Background(), caps)
 	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks getfd
-func TestExecuteGetFdD(t *testing.T) {
+// Checks that migrate arguments can be set
+func TestExecSetMigrateArguments(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("getfd", nil, "return", nil)
+	buf.AddCommand("migrate", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecuteGetFD(context.Background(), "foo", os.NewFile(0, "foo"))
+	err := q.ExecSetMigrateArguments(context.Background(), "exec:foobar")
 	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks chardev-add unix socket
-func TestExecuteCharDevUnixSocketAdd(t *testing.T) {
+// Checks add memory device
+func TestExecMemdevAdd(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("chardev-add", nil, "return", nil)
+	buf.AddCommand("object-add", nil, "return", nil)
+	buf.AddCommand("device_add", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecuteCharDevUnixSocketAdd(context.Background(), "foo", "foo.sock", false, true)
+	err := q.ExecMemdevAdd(context.Background(), "memory-backend-ram", "mem0", "", 128, true, "virtio-mem-pci", "virtiomem0", "0x1", "pci-bridge-0")
 	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Checks virtio serial port hotplug
-func TestExecuteVirtSerialPortAdd(t *testing.T) {
+// Checks object-add and object-del
+func TestExecuteObjectAddDel(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("device_add", nil, "return", nil)
+	buf.AddCommand("object-add", nil, "return", nil)
+	buf.AddCommand("object-del", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecuteVirtSerialPortAdd(context.Background(), "foo", "foo.channel", "foo")
+	err := q.ExecuteObjectAdd(context.Background(), ThrottleGroup{ID: "limits0", IOPSTotal: 1000})
 	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = q.ExecuteObjectDel(context.Background(), "limits0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 	q.Shutdown()
 	<-disconnectedCh
 }
 
-// Check migration incoming
-func TestExecuteMigrationIncoming(t *testing.T) {
+// Checks that an invalid object is refused without issuing object-add.
+func TestExecuteObjectAddInvalid(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("migrate-incoming", nil, "return", nil)
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-	err := q.ExecuteMigrationIncoming(context.Background(), "uri")
-	if err != nil {
-		t.Fatalf("Unexpected error %v", err)
+	err := q.ExecuteObjectAdd(context.Background(),
+		Secret{ID: "sec0", Data: "password", File: "/etc/password"})
+	if err == nil {
+		t.Fatalf("Expected an error")
 	}
 	q.Shutdown()
 	<-disconnectedCh
+	if buf.currentCmd != 0 {
+		t.Fatalf("Unexpected command issued")
+	}
 }
 
-// Checks migration status
-func TestExecuteQueryMigration(t *testing.T) {
+// Checks memory backend hotplug
+func TestExecuteMemoryBackendAdd(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	status := MigrationStatus{
-		Status: "completed",
-		RAM: MigrationRAM{
-			Total:            100,
-			Remaining:        101,
-			Transferred:      101,
-			TotalTime:        101,
-			SetupTime:        101,
+	buf.AddCommand("object-add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	backend := MemoryBackend{
+		Type:     MemoryBackendMemfd,
+		ID:       "mem0",
+		Size:     "128M",
+		Share:    true,
+		Prealloc: true,
+	}
+	err := q.ExecuteMemoryBackendAdd(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backend.Size = "128X"
+	err = q.ExecuteMemoryBackendAdd(context.Background(), backend)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks hotplug memory
+func TestExecHotplugMemory(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("object-add", nil, "return", nil)
+	buf.AddCommand("device_add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecHotplugMemory(context.Background(), "memory-backend-ram", "mem0", "", 128, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks vsock-pci hotplug
+func TestExecutePCIVSockAdd(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecutePCIVSockAdd(context.Background(), "vsock-pci0", "3", "1", "1", "1", "", true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks vhost-user-pci hotplug
+func TestExecutePCIVhostUserDevAdd(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	driver := "vhost-user-blk-pci"
+	devID := "vhost-user-blk0"
+	chardevID := "vhost-user-blk-char0"
+	err := q.ExecutePCIVhostUserDevAdd(context.Background(), driver, devID, chardevID, "1", "1")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks getfd
+func TestExecuteGetFdD(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("getfd", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteGetFD(context.Background(), "foo", os.NewFile(0, "foo"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks chardev-add unix socket
+func TestExecuteCharDevUnixSocketAdd(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("chardev-add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteCharDevUnixSocketAdd(context.Background(), "foo", "foo.sock", false, true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks virtio serial port hotplug
+func TestExecuteVirtSerialPortAdd(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("device_add", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteVirtSerialPortAdd(context.Background(), "foo", "foo.channel", "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Check migration incoming
+func TestExecuteMigrationIncoming(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("migrate-incoming", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteMigrationIncoming(context.Background(), "uri")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks migration status
+func TestExecuteQueryMigration(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	status := MigrationStatus{
+		Status: "completed",
+		RAM: MigrationRAM{
+			Total:            100,
+			Remaining:        101,
+			Transferred:      101,
+			TotalTime:        101,
+			SetupTime:        101,
 			ExpectedDowntime: 101,
 			Duplicate:        101,
 			Normal:           101,
@@ -1518,6 +1984,84 @@ func TestExecuteQueryMigration(t *testing.T) {
 	<-disconnectedCh
 }
 
+// Checks calc-dirty-rate
+func TestExecuteCalcDirtyRate(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("calc-dirty-rate", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteCalcDirtyRate(context.Background(), 1, 512, DirtyRatePageSampling)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks query-dirty-rate
+func TestExecuteQueryDirtyRate(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	info := DirtyRateInfo{
+		DirtyRate:   42,
+		Status:      DirtyRateMeasured,
+		StartTime:   1000,
+		CalcTime:    1,
+		SamplePages: 512,
+		Mode:        DirtyRatePageSampling,
+	}
+	buf.AddCommand("query-dirty-rate", nil, "return", info)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	i, err := q.ExecuteQueryDirtyRate(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(i, info) {
+		t.Fatalf("expected %v got %v", info, i)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that MeasureDirtyRate waits for the measurement to complete and
+// returns the per vCPU dirty rates.
+func TestMeasureDirtyRate(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	info := DirtyRateInfo{
+		DirtyRate: 96,
+		Status:    DirtyRateMeasured,
+		CalcTime:  1,
+		Mode:      DirtyRateDirtyRing,
+		VCPUDirtyRate: []DirtyRateVCPU{
+			{ID: 0, DirtyRate: 64},
+			{ID: 1, DirtyRate: 32},
+		},
+	}
+	buf.AddCommand("calc-dirty-rate", nil, "return", nil)
+	buf.AddCommand("query-dirty-rate", nil, "return", DirtyRateInfo{Status: DirtyRateMeasuring})
+	buf.AddCommand("query-dirty-rate", nil, "return", info)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	i, err := q.MeasureDirtyRate(context.Background(), 500*time.Millisecond, DirtyRateDirtyRing)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(i, info) {
+		t.Fatalf("expected %v got %v", info, i)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
 // Checks balloon
 func TestExecuteBalloon(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
@@ -1536,6 +2080,80 @@ func TestExecuteBalloon(t *testing.T) {
 	<-disconnectedCh
 }
 
+// Checks query-balloon
+func TestExecuteQueryBalloon(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("query-balloon", nil, "return", map[string]interface{}{"actual": 1 << 30})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	info, err := q.ExecuteQueryBalloon(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if info.Actual != 1<<30 {
+		t.Fatalf("Unexpected balloon size %d", info.Actual)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the balloon guest statistics are read and decoded
+func TestExecuteQueryBalloonStats(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("qom-set", nil, "return", nil)
+	buf.AddCommand("qom-get", nil, "return", map[string]interface{}{
+		"last-update": 1600000000,
+		"stats": map[string]interface{}{
+			"stat-swap-in":          0,
+			"stat-swap-out":         4096,
+			"stat-major-faults":     10,
+			"stat-minor-faults":     1000,
+			"stat-free-memory":      512 << 20,
+			"stat-total-memory":     2 << 30,
+			"stat-available-memory": 1 << 30,
+			"stat-disk-caches":      256 << 20,
+			"stat-htlb-pgalloc":     -1,
+			"stat-htlb-pgfail":      -1,
+		},
+	})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteSetBalloonStatsPollingInterval(context.Background(), "balloon0", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	stats, err := q.ExecuteQueryBalloonStats(context.Background(), "balloon0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := BalloonStats{
+		LastUpdate: 1600000000,
+		Stats: BalloonGuestStats{
+			SwapIn:             0,
+			SwapOut:            4096,
+			MajorFaults:        10,
+			MinorFaults:        1000,
+			FreeMemory:         512 << 20,
+			TotalMemory:        2 << 30,
+			AvailableMemory:    1 << 30,
+			DiskCaches:         256 << 20,
+			HugetlbAllocations: -1,
+			HugetlbFailures:    -1,
+		},
+	}
+	if stats != expected {
+		t.Fatalf("Expected %v equals to %v", stats, expected)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
 func TestErrorDesc(t *testing.T) {
 	errDesc := "Somthing err messages"
 	errData := map[string]string{
@@ -1786,21 +2404,774 @@ func TestExecQomGet(t *testing.T) {
 	<-disconnectedCh
 }
 
-// Checks dump-guest-memory
-func TestExecuteDumpGuestMemory(t *testing.T) {
+// Checks qom-set with values of different types
+func TestExecQomSetValue(t *testing.T) {
 	connectedCh := make(chan *QMPVersion)
 	disconnectedCh := make(chan struct{})
 	buf := newQMPTestCommandBuffer(t)
-	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	values := []interface{}{true, "on", int64(-1), map[string]interface{}{"x": 1}}
+	for range values {
+		buf.AddCommand("qom-set", nil, "return", nil)
+	}
 	cfg := QMPConfig{Logger: qmpTestLogger{}}
 	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
 	checkVersion(t, connectedCh)
-
-	err := q.ExecuteDumpGuestMemory(context.Background(), "file:/tmp/dump.xxx.yyy", false, "elf")
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	for _, v := range values {
+		err := q.ExecQomSetValue(context.Background(), "/machine/peripheral/dev0", "prop", v)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
+	q.Shutdown()
+	<-disconnectedCh
+}
 
+// Checks the typed qom-get helpers
+func TestExecQomGetTyped(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("qom-get", nil, "return", true)
+	buf.AddCommand("qom-get", nil, "return", "virtio-blk-pci")
+	buf.AddCommand("qom-get", nil, "return", 4096)
+	buf.AddCommand("qom-get", nil, "return", map[string]interface{}{"id": "vm0", "size": 1024})
+	buf.AddCommand("qom-get", nil, "return", "not a bool")
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	ctx := context.Background()
+	b, err := q.ExecQomGetBool(ctx, "/machine/peripheral/dev0", "realized")
+	if err != nil || !b {
+		t.Fatalf("Unexpected bool value %v: %v", b, err)
+	}
+	str, err := q.ExecQomGetString(ctx, "/machine/peripheral/dev0", "type")
+	if err != nil || str != "virtio-blk-pci" {
+		t.Fatalf("Unexpected string value %v: %v", str, err)
+	}
+	i, err := q.ExecQomGetInt(ctx, "/machine/peripheral/dev0", "logical_block_size")
+	if err != nil || i != 4096 {
+		t.Fatalf("Unexpected int value %v: %v", i, err)
+	}
+	var obj struct {
+		ID   string `json:"id"`
+		Size int    `json:"size"`
+	}
+	err = q.ExecQomGetObject(ctx, "/machine/peripheral/dev0", "obj", &obj)
+	if err != nil || obj.ID != "vm0" || obj.Size != 1024 {
+		t.Fatalf("Unexpected object value %v: %v", obj, err)
+	}
+	_, err = q.ExecQomGetBool(ctx, "/machine/peripheral/dev0", "realized")
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
 	q.Shutdown()
 	<-disconnectedCh
 }
+
+// Checks qom-list-types
+func TestExecQomListTypes(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	types := []QOMType{
+		{Name: "virtio-blk-pci", Parent: "virtio-blk-pci-base"},
+		{Name: "virtio-net-pci", Parent: "virtio-net-pci-base"},
+	}
+	buf.AddCommand("qom-list-types", nil, "return", types)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	result, err := q.ExecQomListTypes(context.Background(), "virtio-pci", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, types) {
+		t.Fatalf("Expected %v equals to %v", result, types)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks device-list-properties and qom-list-properties
+func TestExecListProperties(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	props := []QOMProperty{
+		{Name: "iothread", Type: "link<iothread>"},
+		{Name: "num-queues", Type: "uint16", DefaultValue: float64(65535)},
+	}
+	buf.AddCommand("device-list-properties", nil, "return", props)
+	buf.AddCommand("qom-list-properties", nil, "return", props)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	result, err := q.ExecDeviceListProperties(context.Background(), "virtio-blk-pci")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, props) {
+		t.Fatalf("Expected %v equals to %v", result, props)
+	}
+	result, err = q.ExecQomListProperties(context.Background(), "virtio-blk-pci")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, props) {
+		t.Fatalf("Expected %v equals to %v", result, props)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks query-machines and query-cpu-definitions
+func TestExecQueryMachinesAndCPUDefinitions(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	machines := []MachineInfo{
+		{Name: "pc-q35-6.2", Alias: "q35", CPUMax: 288, HotpluggableCPUs: true, NUMAMemSupported: false},
+		{Name: "microvm", CPUMax: 288},
+	}
+	cpus := []CPUDefinition{
+		{Name: "host", Typename: "host-x86_64-cpu"},
+		{Name: "Skylake-Server", Typename: "Skylake-Server-x86_64-cpu", MigrationSafe: true, UnavailableFeatures: []string{"avx512f"}},
+	}
+	buf.AddCommand("query-machines", nil, "return", machines)
+	buf.AddCommand("query-cpu-definitions", nil, "return", cpus)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	machinesResult, err := q.ExecQueryMachines(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(machinesResult, machines) {
+		t.Fatalf("Expected %v equals to %v", machinesResult, machines)
+	}
+	cpusResult, err := q.ExecQueryCPUDefinitions(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cpusResult, cpus) {
+		t.Fatalf("Expected %v equals to %v", cpusResult, cpus)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the device database is captured for all device drivers
+func TestCaptureDeviceDatabase(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("qom-list-types", nil, "return", []QOMType{
+		{Name: "virtio-blk-pci"},
+		{Name: "virtio-mem-pci"},
+	})
+	buf.AddCommand("device-list-properties", nil, "return", []QOMProperty{
+		{Name: "iothread", Type: "link<iothread>"},
+	})
+	buf.AddCommand("device-list-properties", nil, "return", []QOMProperty{
+		{Name: "memdev", Type: "link<memory-backend>"},
+		{Name: "requested-size", Type: "size"},
+	})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	db, err := q.CaptureDeviceDatabase(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := DeviceDatabase{
+		"virtio-blk-pci": {"iothread": "link<iothread>"},
+		"virtio-mem-pci": {"memdev": "link<memory-backend>", "requested-size": "size"},
+	}
+	if !reflect.DeepEqual(db, expected) {
+		t.Fatalf("Expected %v equals to %v", db, expected)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the QOM tree is walked with qom-list
+func TestWalkQomTree(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	machineProps := []QOMProperty{
+		{Name: "type", Type: "string"},
+		{Name: "peripheral", Type: "child<container>"},
+		{Name: "kernel", Type: "string", Description: "Linux kernel image"},
+	}
+	peripheralProps := []QOMProperty{
+		{Name: "type", Type: "string"},
+		{Name: "blk0", Type: "child<virtio-blk-pci>"},
+	}
+	blkProps := []QOMProperty{
+		{Name: "type", Type: "string"},
+		{Name: "realized", Type: "bool"},
+	}
+	buf.AddCommand("qom-get", nil, "return", "pc-q35-6.2-machine")
+	buf.AddCommand("qom-list", nil, "return", machineProps)
+	buf.AddCommand("qom-list", nil, "return", peripheralProps)
+	buf.AddCommand("qom-list", nil, "return", blkProps)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	tree, err := q.WalkQomTree(context.Background(), "/machine")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &QOMNode{
+		Path:       "/machine",
+		Type:       "pc-q35-6.2-machine",
+		Properties: machineProps,
+		Children: []*QOMNode{
+			{
+				Path:       "/machine/peripheral",
+				Type:       "container",
+				Properties: peripheralProps,
+				Children: []*QOMNode{
+					{
+						Path:       "/machine/peripheral/blk0",
+						Type:       "virtio-blk-pci",
+						Properties: blkProps,
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("Expected %+v equals to %+v", tree, expected)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks dump-guest-memory
+func TestExecuteDumpGuestMemory(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	err := q.ExecuteDumpGuestMemory(context.Background(), "file:/tmp/dump.xxx.yyy", false, "elf")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks set-action
+func TestExecuteSetAction(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("set-action", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	err := q.ExecuteSetAction(context.Background(), Actions{
+		Panic:    PanicActionPause,
+		Watchdog: WatchdogActionReset,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that WATCHDOG events are decoded
+func TestDecodeWatchdogExpiration(t *testing.T) {
+	ev := QMPEvent{
+		Name: "WATCHDOG",
+		Data: map[string]interface{}{
+			"action": "inject-nmi",
+		},
+	}
+
+	expiration, err := DecodeWatchdogExpiration(ev)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expiration.Action != WatchdogActionInjectNMI {
+		t.Fatalf("Expected %s equals to %s", expiration.Action, WatchdogActionInjectNMI)
+	}
+
+	ev.Name = "GUEST_PANICKED"
+	if _, err = DecodeWatchdogExpiration(ev); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+// Checks query-dump
+func TestExecuteQueryDump(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	expected := DumpQueryResult{
+		Status:    "active",
+		Completed: 1 << 20,
+		Total:     1 << 30,
+	}
+	buf.AddCommand("query-dump", nil, "return", expected)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	result, err := q.ExecuteQueryDump(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != expected {
+		t.Fatalf("Expected %+v equals to %+v", result, expected)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks query-dump-guest-memory-capability
+func TestExecuteQueryDumpGuestMemoryCapability(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("query-dump-guest-memory-capability", nil, "return", map[string]interface{}{
+		"formats": []string{"elf", "kdump-zlib", "kdump-lzo", "kdump-snappy"},
+	})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	formats, err := q.ExecuteQueryDumpGuestMemoryCapability(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []DumpFormat{DumpFormatELF, DumpFormatKdumpZlib, DumpFormatKdumpLZO, DumpFormatKdumpSnappy}
+	if !reflect.DeepEqual(formats, expected) {
+		t.Fatalf("Expected %v equals to %v", formats, expected)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that DUMP_COMPLETED events are decoded
+func TestDecodeDumpCompleted(t *testing.T) {
+	ev := QMPEvent{
+		Name: "DUMP_COMPLETED",
+		Data: map[string]interface{}{
+			"result": map[string]interface{}{
+				"status":    "failed",
+				"completed": float64(1 << 20),
+				"total":     float64(1 << 30),
+			},
+			"error": "No space left on device",
+		},
+	}
+	expected := DumpCompleted{
+		Result: DumpQueryResult{
+			Status:    "failed",
+			Completed: 1 << 20,
+			Total:     1 << 30,
+		},
+		Error: "No space left on device",
+	}
+
+	completed, err := DecodeDumpCompleted(ev)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if completed != expected {
+		t.Fatalf("Expected %+v equals to %+v", completed, expected)
+	}
+
+	ev.Name = "SHUTDOWN"
+	if _, err = DecodeDumpCompleted(ev); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+// Checks that DumpGuestMemory waits for the DUMP_COMPLETED event.
+//
+// We start a QMPLoop, call DumpGuestMemory, and send a DUMP_COMPLETED event
+// before the dump is polled.
+//
+// DumpGuestMemory should return the result of the event.
+func TestDumpGuestMemory(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	buf.AddEvent("DUMP_COMPLETED", 50*time.Millisecond, map[string]interface{}{
+		"result": map[string]interface{}{
+			"status":    "completed",
+			"completed": float64(1 << 30),
+			"total":     float64(1 << 30),
+		},
+	}, nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	var wg sync.WaitGroup
+	buf.startEventLoop(&wg)
+
+	opts := DumpGuestMemoryOptions{
+		Format: DumpFormatKdumpZlib,
+		Begin:  0,
+		Length: 1 << 30,
+	}
+	result, err := q.DumpGuestMemory(context.Background(), "file:/tmp/dump.xxx.yyy", opts, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := DumpQueryResult{
+		Status:    "completed",
+		Completed: 1 << 30,
+		Total:     1 << 30,
+	}
+	if result != expected {
+		t.Fatalf("Expected %+v equals to %+v", result, expected)
+	}
+
+	wg.Wait()
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that DumpGuestMemory reports the progress of the dump.
+//
+// We start a QMPLoop and call DumpGuestMemory.  query-dump reports an
+// active dump, and then a completed one.
+//
+// The progress callback should be called with both results.
+func TestDumpGuestMemoryProgress(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	results := []DumpQueryResult{
+		{Status: "active", Completed: 1 << 29, Total: 1 << 30},
+		{Status: "completed", Completed: 1 << 30, Total: 1 << 30},
+	}
+	buf.AddCommand("dump-guest-memory", nil, "return", nil)
+	buf.AddCommand("query-dump", nil, "return", results[0])
+	buf.AddCommand("query-dump", nil, "return", results[1])
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	var progress []DumpQueryResult
+	result, err := q.DumpGuestMemory(context.Background(), "file:/tmp/dump.xxx.yyy",
+		DumpGuestMemoryOptions{}, func(r DumpQueryResult) {
+			progress = append(progress, r)
+		})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != results[1] {
+		t.Fatalf("Expected %+v equals to %+v", result, results[1])
+	}
+	if !reflect.DeepEqual(progress, results) {
+		t.Fatalf("Expected %+v equals to %+v", progress, results)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks query-jobs
+func TestExecuteQueryJobs(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	jobs := []JobInfo{
+		{
+			ID:              "snap0",
+			Type:            "snapshot-save",
+			Status:          "running",
+			CurrentProgress: 1,
+			TotalProgress:   2,
+		},
+	}
+	buf.AddCommand("query-jobs", nil, "return", jobs)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	j, err := q.ExecuteQueryJobs(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(j, jobs) {
+		t.Fatalf("expected %v got %v", jobs, j)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that snapshot-save waits for its job to conclude and dismisses it.
+func TestExecuteSnapshotSave(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("snapshot-save", nil, "return", nil)
+	buf.AddCommand("query-jobs", nil, "return", []JobInfo{{ID: "snap0", Status: "running"}})
+	buf.AddCommand("query-jobs", nil, "return", []JobInfo{{ID: "snap0", Status: "concluded"}})
+	buf.AddCommand("job-dismiss", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteSnapshotSave(context.Background(), "snap0", "checkpoint", "hd0-qcow2", []string{"hd0-qcow2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the error of a failed snapshot-load job is reported.
+func TestExecuteSnapshotLoadFailed(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("snapshot-load", nil, "return", nil)
+	buf.AddCommand("query-jobs", nil, "return",
+		[]JobInfo{{ID: "snap0", Status: "concluded", Error: "Snapshot 'checkpoint' does not exist"}})
+	buf.AddCommand("job-dismiss", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteSnapshotLoad(context.Background(), "snap0", "checkpoint", "hd0-qcow2", []string{"hd0-qcow2"})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks snapshot-delete
+func TestExecuteSnapshotDelete(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("snapshot-delete", nil, "return", nil)
+	buf.AddCommand("query-jobs", nil, "return", []JobInfo{{ID: "snap0", Status: "concluded"}})
+	buf.AddCommand("job-dismiss", nil, "return", nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	err := q.ExecuteSnapshotDelete(context.Background(), "snap0", "checkpoint", []string{"hd0-qcow2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that the snapshots are listed for qcow2 nodes only.
+func TestExecuteQuerySnapshots(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	snapshot := SnapshotInfo{
+		ID:          "1",
+		Name:        "checkpoint",
+		VMStateSize: 4096,
+		DateSec:     1600000000,
+	}
+	nodes := []map[string]interface{}{
+		{
+			"node-name": "hd0-qcow2",
+			"drv":       "qcow2",
+			"image": map[string]interface{}{
+				"snapshots": []SnapshotInfo{snapshot},
+			},
+		},
+		{
+			"node-name": "hd0-file",
+			"drv":       "file",
+			"image":     map[string]interface{}{},
+		},
+	}
+	buf.AddCommand("query-named-block-nodes", nil, "return", nodes)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+	snapshots, err := q.ExecuteQuerySnapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string][]SnapshotInfo{"hd0-qcow2": {snapshot}}
+	if !reflect.DeepEqual(snapshots, expected) {
+		t.Fatalf("expected %v got %v", expected, snapshots)
+	}
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks the run state transitions on the QMP events.
+func TestNextRunState(t *testing.T) {
+	tests := []struct {
+		from  RunState
+		event string
+		data  map[string]interface{}
+		to    RunState
+	}{
+		{RunStateRunning, "STOP", nil, RunStatePaused},
+		{RunStateShutdown, "STOP", nil, RunStateShutdown},
+		{RunStateGuestPanicked, "STOP", nil, RunStateGuestPanicked},
+		{RunStatePaused, "RESUME", nil, RunStateRunning},
+		{RunStateRunning, "SHUTDOWN", nil, RunStateShutdown},
+		{RunStateRunning, "SUSPEND", nil, RunStateSuspended},
+		{RunStateSuspended, "WAKEUP", nil, RunStateRunning},
+		{RunStateRunning, "GUEST_PANICKED", map[string]interface{}{"action": "pause"}, RunStateGuestPanicked},
+		{RunStateRunning, "GUEST_PANICKED", map[string]interface{}{"action": "run"}, RunStateRunning},
+		{RunStateRunning, "RESET", nil, RunStateRunning},
+		{RunStateShutdown, "RESET", nil, RunStatePrelaunch},
+		{RunStateRunning, "WATCHDOG", map[string]interface{}{"action": "pause"}, RunStateWatchdog},
+		{RunStateWatchdog, "STOP", nil, RunStateWatchdog},
+		{RunStateRunning, "WATCHDOG", map[string]interface{}{"action": "reset"}, RunStateRunning},
+		{RunStateRunning, "POWERDOWN", nil, RunStateRunning},
+	}
+
+	for _, test := range tests {
+		to := nextRunState(test.from, QMPEvent{Name: test.event, Data: test.data})
+		if to != test.to {
+			t.Errorf("%s in %s: expected %s, got %s", test.event, test.from, test.to, to)
+		}
+	}
+}
+
+// Checks that the events received before the initial state is known are
+// applied on top of it.
+func TestRunStateWatcherPending(t *testing.T) {
+	w := &RunStateWatcher{changed: make(chan struct{})}
+
+	w.update(QMPEvent{Name: "RESET"})
+	w.update(QMPEvent{Name: "STOP"})
+	if state := w.State(); state != "" {
+		t.Fatalf("Unexpected state %s", state)
+	}
+
+	w.setInitialState(RunStateRunning)
+	if state := w.State(); state != RunStatePaused {
+		t.Errorf("Expected %s, got %s", RunStatePaused, state)
+	}
+
+	w = &RunStateWatcher{changed: make(chan struct{})}
+	w.update(QMPEvent{Name: "RESET"})
+	w.setInitialState(RunStateRunning)
+	if state := w.State(); state != RunStateRunning {
+		t.Errorf("Expected %s, got %s", RunStateRunning, state)
+	}
+}
+
+// Checks that the run state watcher follows the QMP events.
+//
+// We start a QMPLoop and a run state watcher on a running guest, and send
+// STOP, RESUME, GUEST_PANICKED and STOP events.
+//
+// The watcher should report the transitions to its callbacks, and
+// WaitForState should return once the guest has panicked.
+func TestWatchRunState(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("query-status", nil, "return", StatusInfo{
+		Running: true,
+		Status:  "running",
+	})
+	buf.AddEvent("STOP", 50*time.Millisecond, nil, nil)
+	buf.AddEvent("RESUME", 10*time.Millisecond, nil, nil)
+	buf.AddEvent("GUEST_PANICKED", 10*time.Millisecond, map[string]interface{}{
+		"action": "pause",
+	}, nil)
+	buf.AddEvent("STOP", 10*time.Millisecond, nil, nil)
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	w, err := q.WatchRunState(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := w.State(); state != RunStateRunning {
+		t.Errorf("Expected %s, got %s", RunStateRunning, state)
+	}
+
+	var lock sync.Mutex
+	var transitions []RunState
+	w.OnTransition(func(from, to RunState) {
+		lock.Lock()
+		transitions = append(transitions, from, to)
+		lock.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	buf.startEventLoop(&wg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	state, err := w.WaitForState(ctx, RunStateGuestPanicked, RunStateShutdown)
+	cancel()
+	if err != nil || state != RunStateGuestPanicked {
+		t.Errorf("Expected %s, got %s: %v", RunStateGuestPanicked, state, err)
+	}
+
+	wg.Wait()
+	w.Stop()
+
+	expected := []RunState{
+		RunStateRunning, RunStatePaused,
+		RunStatePaused, RunStateRunning,
+		RunStateRunning, RunStateGuestPanicked,
+	}
+	lock.Lock()
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("Expected %v, got %v", expected, transitions)
+	}
+	lock.Unlock()
+
+	q.Shutdown()
+	<-disconnectedCh
+}
+
+// Checks that WaitForState fails when its context is done, or when the QMP
+// connection is lost.
+func TestWatchRunStateWaitTimeout(t *testing.T) {
+	connectedCh := make(chan *QMPVersion)
+	disconnectedCh := make(chan struct{})
+	buf := newQMPTestCommandBuffer(t)
+	buf.AddCommand("query-status", nil, "return", StatusInfo{Status: "prelaunch"})
+	cfg := QMPConfig{Logger: qmpTestLogger{}}
+	q := startQMPLoop(buf, cfg, connectedCh, disconnectedCh)
+	checkVersion(t, connectedCh)
+
+	w, err := q.WatchRunState(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	state, err := w.WaitForState(ctx, RunStateRunning)
+	cancel()
+	if err != context.DeadlineExceeded || state != RunStatePrelaunch {
+		t.Errorf("Expected a timeout in %s, got %s: %v", RunStatePrelaunch, state, err)
+	}
+
+	q.Shutdown()
+	<-disconnectedCh
+
+	if _, err = w.WaitForState(context.Background(), RunStateRunning); err == nil {
+		t.Errorf("Expected an error after the disconnection")
+	}
+	w.Stop()
+}
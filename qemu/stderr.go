@@ -0,0 +1,199 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// StderrLevel is the severity of a message written by qemu to its standard
+// error.
+type StderrLevel string
+
+const (
+	// StderrError is an error message.
+	StderrError StderrLevel = "error"
+
+	// StderrWarning is a warning message.
+	StderrWarning StderrLevel = "warning"
+
+	// StderrInfo is an informational message.
+	StderrInfo StderrLevel = "info"
+)
+
+// StderrLine is a line written by qemu to its standard error.  The messages
+// reported by qemu have the form
+//
+//	[timestamp ]program: [-option argument: ][warning: |info: ]message
+//
+// where the timestamp is only present with Config.MsgTimestamp, and the
+// option is the command line option the message is about.
+type StderrLine struct {
+	// Raw is the line, without its trailing newline.
+	Raw string
+
+	// Time is the timestamp of the line, when qemu adds timestamps to
+	// its messages.
+	Time time.Time
+
+	// Program is the name of the qemu binary.  It is empty if the line is
+	// not a qemu message, e.g. the output of a chardev.
+	Program string
+
+	// Level is the severity of the message.  It is empty if the line is
+	// not a qemu message.
+	Level StderrLevel
+
+	// Option is the command line option the message is about, e.g.
+	// -device.
+	Option string
+
+	// Argument is the argument of Option, e.g. virtio-net-pci,netdev=net0.
+	Argument string
+
+	// Message is the message, without the prefixes.
+	Message string
+}
+
+// ParseStderrLine parses a line written by qemu to its standard error.
+func ParseStderrLine(line string) StderrLine {
+	l := StderrLine{
+		Raw:     line,
+		Message: line,
+	}
+
+	rest := line
+	if i := strings.IndexByte(rest, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, rest[:i]); err == nil {
+			l.Time = t
+			rest = rest[i+1:]
+			l.Message = rest
+		}
+	}
+
+	i := strings.Index(rest, ": ")
+	if i <= 0 || strings.ContainsAny(rest[:i], " \t") || !strings.Contains(rest[:i], "qemu") {
+		return l
+	}
+	l.Program = rest[:i]
+	l.Level = StderrError
+	rest = rest[i+2:]
+
+	if strings.HasPrefix(rest, "-") {
+		if i = strings.Index(rest, ": "); i > 0 {
+			option := strings.SplitN(rest[:i], " ", 2)
+			l.Option = option[0]
+			if len(option) > 1 {
+				l.Argument = option[1]
+			}
+			rest = rest[i+2:]
+		}
+	}
+
+	for _, level := range []StderrLevel{StderrWarning, StderrInfo} {
+		if prefix := string(level) + ": "; strings.HasPrefix(rest, prefix) {
+			l.Level = level
+			rest = rest[len(prefix):]
+		}
+	}
+	l.Message = rest
+
+	return l
+}
+
+// stderrWriter splits the standard error of qemu into lines, and hands them
+// to the consumers set in the configuration.
+type stderrWriter struct {
+	buf    []byte
+	out    io.Writer
+	fn     func(StderrLine)
+	logger QMPLog
+}
+
+// stderrWriter returns the writer of the standard error of qemu, or nil if
+// the configuration does not consume it.
+func (config *Config) stderrWriter(logger QMPLog) *stderrWriter {
+	if config.Stderr == nil && config.StderrFunc == nil && !config.LogStderr {
+		return nil
+	}
+
+	w := &stderrWriter{
+		out: config.Stderr,
+		fn:  config.StderrFunc,
+	}
+	if config.LogStderr {
+		w.logger = logger
+	}
+
+	return w
+}
+
+// Write never fails, so that qemu is not affected by failing consumers.
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	lines := w.buf
+	for {
+		i := bytes.IndexByte(lines, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(lines[:i]))
+		lines = lines[i+1:]
+	}
+	w.buf = append(w.buf[:0], lines...)
+
+	return len(p), nil
+}
+
+// Flush hands the last line to the consumers if it does not end with a
+// newline.
+func (w *stderrWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *stderrWriter) line(line string) {
+	if w.out != nil {
+		_, _ = io.WriteString(w.out, line+"\n")
+	}
+
+	if w.fn == nil && w.logger == nil {
+		return
+	}
+
+	l := ParseStderrLine(line)
+	if w.fn != nil {
+		w.fn(l)
+	}
+
+	if w.logger != nil {
+		switch l.Level {
+		case StderrError:
+			w.logger.Errorf("%s", line)
+		case StderrWarning:
+			w.logger.Warningf("%s", line)
+		default:
+			w.logger.Infof("%s", line)
+		}
+	}
+}
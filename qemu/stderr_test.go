@@ -0,0 +1,155 @@
+/*
+// Copyright contributors to the Virtual Machine Manager for Go project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package qemu
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStderrLine(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected StderrLine
+	}{
+		{
+			"qemu-system-x86_64: -device virtio-net-pci,netdev=net0: Property 'virtio-net-pci.netdev' can't find value 'net0'",
+			StderrLine{
+				Program:  "qemu-system-x86_64",
+				Level:    StderrError,
+				Option:   "-device",
+				Argument: "virtio-net-pci,netdev=net0",
+				Message:  "Property 'virtio-net-pci.netdev' can't find value 'net0'",
+			},
+		},
+		{
+			"2021-05-10T10:08:55.123456Z qemu-system-x86_64: warning: host doesn't support requested feature",
+			StderrLine{
+				Time:    time.Date(2021, 5, 10, 10, 8, 55, 123456000, time.UTC),
+				Program: "qemu-system-x86_64",
+				Level:   StderrWarning,
+				Message: "host doesn't support requested feature",
+			},
+		},
+		{
+			"qemu-system-s390x: -machine foo: info: unknown machine",
+			StderrLine{
+				Program:  "qemu-system-s390x",
+				Level:    StderrInfo,
+				Option:   "-machine",
+				Argument: "foo",
+				Message:  "unknown machine",
+			},
+		},
+		{
+			"char device redirected to /dev/pts/3 (label charserial0)",
+			StderrLine{
+				Message: "char device redirected to /dev/pts/3 (label charserial0)",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc.expected.Raw = tc.line
+		if l := ParseStderrLine(tc.line); !reflect.DeepEqual(l, tc.expected) {
+			t.Errorf("Expected %+v, got %+v", tc.expected, l)
+		}
+	}
+}
+
+func TestStderrWriter(t *testing.T) {
+	var out bytes.Buffer
+	var lines []StderrLine
+
+	config := &Config{
+		Stderr: &out,
+		StderrFunc: func(l StderrLine) {
+			lines = append(lines, l)
+		},
+		LogStderr: true,
+	}
+
+	w := config.stderrWriter(qmpTestLogger{})
+	_, _ = w.Write([]byte("qemu-system-x86_64: warn"))
+	_, _ = w.Write([]byte("ing: slow\nqemu-system-x86_64: -m 1T: too much\nlast"))
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected lines %v", lines)
+	}
+	w.Flush()
+
+	if out.String() != "qemu-system-x86_64: warning: slow\nqemu-system-x86_64: -m 1T: too much\nlast\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	if len(lines) != 3 || lines[0].Level != StderrWarning || lines[1].Option != "-m" || lines[2].Raw != "last" {
+		t.Errorf("Unexpected lines %+v", lines)
+	}
+
+	if (&Config{}).stderrWriter(qmpTestLogger{}) != nil {
+		t.Errorf("Expected no writer without stderr consumer")
+	}
+}
+
+func TestAppendMsgTimestamp(t *testing.T) {
+	config := &Config{MsgTimestamp: true}
+
+	args, _, err := config.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Join(args, " ") != "-msg timestamp=on" {
+		t.Errorf("Unexpected parameters %v", args)
+	}
+}
+
+// Checks that the standard error of qemu is streamed while qemu runs.
+//
+// A fake qemu binary writing an error to its standard error is started, and
+// its lines are collected with StderrFunc.
+//
+// The line should be parsed and the stderr of the process should still be
+// captured.
+func TestStartQemuStderr(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("StartQemu sets the credentials of qemu, which requires root")
+	}
+
+	lineCh := make(chan StderrLine, 1)
+	config := Config{
+		Path: writeFakeQemuBinary(t, "#!/bin/sh\necho 'qemu-system-x86_64: -device foo: Device not found' >&2\nexit 1\n"),
+		StderrFunc: func(l StderrLine) {
+			lineCh <- l
+		},
+	}
+
+	p, err := StartQemu(config, qmpTestLogger{})
+	if err != nil {
+		t.Fatalf("Unable to start qemu: %v", err)
+	}
+	_ = p.Wait()
+
+	l := <-lineCh
+	if l.Option != "-device" || l.Argument != "foo" || l.Message != "Device not found" {
+		t.Errorf("Unexpected line %+v", l)
+	}
+	if !strings.Contains(p.Stderr(), "Device not found") {
+		t.Errorf("Unexpected stderr %q", p.Stderr())
+	}
+}